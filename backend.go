@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+// Backends
+const (
+	backendSwift  = "swift"
+	backendLocal  = "local"
+	backendMemory = "memory"
+)
+
+// Backend is the storage of the files. Swift is the backend of the server,
+// the others are for testing and development without OpenStack.
+//
+// Object metadata is passed as Swift headers. Entries of listings are
+// SwiftFile whose names start with a slash and end with a slash for
+// directories, like Swift.GetFileInfo returns them.
+type Backend interface {
+	Init() error
+	Config() Config
+
+	// Container returns the container of the backend, "" for the account.
+	Container() string
+	// WithContainer returns a copy of the backend which works on another
+	// container.
+	WithContainer(container string) Backend
+	EndpointURL() string
+	AccountName() string
+
+	ListContainers() ([]*SwiftFile, error)
+	ExistsContainer() (bool, error)
+	CreateContainer() error
+	Usage() (used uint64, quota uint64, err error)
+
+	// ListDirectory returns a lister of the entries of the directory,
+	// without the directory itself.
+	ListDirectory(path string) DirectoryLister
+	// FirstInDirectory returns the first object under the directory including
+	// its marker object, or nil if there is none.
+	FirstInDirectory(path string) (*SwiftFile, error)
+
+	Get(name string) (schwift.ObjectHeaders, error)
+	// GetLink is like Get, but doesn't follow a symlink. If the object is a
+	// symlink, the full name "container/object" of its target is returned too.
+	GetLink(name string) (schwift.ObjectHeaders, string, error)
+	Download(name string) (io.ReadCloser, int64, error)
+	// DownloadRange downloads length bytes of the object starting at offset.
+	// If length is 0, the object is downloaded until the end.
+	DownloadRange(name string, offset, length int64) (io.ReadCloser, error)
+	// Upload replaces the object. If the Etag header is set, it is verified
+	// and schwift.ErrChecksumMismatch is returned if the content differs.
+	Upload(name string, content io.Reader, hdr schwift.ObjectHeaders) error
+	// SetMetadata replaces the metadata of the object with the metadata in
+	// hdr.
+	SetMetadata(name string, hdr schwift.ObjectHeaders) error
+	Delete(name string) error
+	// DeleteWithSegments deletes the object and the segments of a large
+	// object.
+	DeleteWithSegments(name string) error
+	// CopyTo copies the object to the container of dest. The headers are
+	// set to the copy in addition to the metadata of the object.
+	CopyTo(srcName string, dest Backend, destName string, hdr schwift.ObjectHeaders) error
+	MoveTo(srcName string, dest Backend, destName string) error
+}
+
+// NewBackend returns the backend of the configuration, which encrypts the
+// files if encryption_key_file is set.
+func NewBackend(c Config) Backend {
+	var b Backend
+	switch c.Backend {
+	case backendLocal:
+		b = NewLocalBackend(c)
+	case backendMemory:
+		b = NewMemoryBackend(c)
+	default:
+		b = NewSwift(c)
+	}
+	if c.EncryptionKeyFile != "" {
+		b = NewEncryptedBackend(b, c.EncryptionKeyFile)
+	}
+	return b
+}
+
+// DirectoryLister returns the entries of a directory page by page. An empty
+// page means the end of the directory.
+type DirectoryLister interface {
+	NextPage(limit int) ([]*SwiftFile, error)
+}
+
+// largeObjectBackend is implemented by the backends which store large files
+// in segments. The files are uploaded as a whole to other backends.
+type largeObjectBackend interface {
+	NewLargeObject(name string) (*schwift.LargeObject, error)
+	AppendableObject(name string) (*schwift.LargeObject, error)
+	LargeObject(name string) (*schwift.LargeObject, error)
+}
+
+// isNotFound returns true if the object or the container doesn't exist.
+func isNotFound(err error) bool {
+	return schwift.Is(err, http.StatusNotFound) || os.IsNotExist(err)
+}
+
+// isForbidden returns true if the client may not access the object.
+func isForbidden(err error) bool {
+	return schwift.Is(err, http.StatusForbidden) || schwift.Is(err, http.StatusUnauthorized) || os.IsPermission(err)
+}
+
+// readDirectory returns all entries of the directory.
+func readDirectory(b Backend, path string) ([]*SwiftFile, error) {
+	lister := b.ListDirectory(path)
+	files := make([]*SwiftFile, 0)
+	for {
+		page, err := lister.NextPage(listPageSize)
+		if err != nil {
+			return nil, err
+		} else if len(page) == 0 {
+			return files, nil
+		}
+		files = append(files, page...)
+	}
+}
+
+// createDirectory creates a marker object of the directory.
+func createDirectory(b Backend, path string) error {
+	hdr := schwift.NewObjectHeaders()
+	hdr.ContentType().Set(directoryContentType)
+	return b.Upload(path, bytes.NewReader(nil), hdr)
+}
+
+// isEmptyDirectory returns true if there are no objects under the directory
+// except its marker object.
+func isEmptyDirectory(b Backend, path string) (bool, error) {
+	page, err := b.ListDirectory(path).NextPage(1)
+	if err != nil {
+		return false, err
+	}
+	return len(page) == 0, nil
+}
+
+// deleteDirectory deletes the marker objects of the directory.
+func deleteDirectory(b Backend, path string) error {
+	path = strings.TrimSuffix(path, "/")
+	for _, name := range []string{path + "/", path} {
+		hdr, err := b.Get(name)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if name == path && !isDirectoryMarker(hdr) {
+			continue
+		}
+		if err = b.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksum returns the hex encoded checksum of the object for the algorithm
+// "md5" or "sha256". The checksum stored in the object metadata is preferred.
+// MD5 is taken from the ETag unless the object is a large object, whose ETag is
+// not the MD5 of the content. Otherwise the object is downloaded and hashed.
+func checksum(b Backend, name string, algorithm string) (string, error) {
+	h := newHash(algorithm)
+	if h == nil {
+		return "", fmt.Errorf("Unsupported checksum algorithm '%s'", algorithm)
+	}
+
+	hdr, err := b.Get(name)
+	if err != nil {
+		return "", err
+	}
+
+	if sum := hdr.Metadata().Get(algorithm); sum != "" {
+		return sum, nil
+	}
+	if algorithm == "md5" && !isLargeObject(hdr) {
+		if etag := strings.Trim(hdr.Etag().Get(), `"`); etag != "" {
+			return etag, nil
+		}
+	}
+
+	body, _, err := b.Download(name)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	if _, err = io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyObject copies the object by downloading and uploading it, for backends
+// which can't copy to each other.
+func copyObject(src Backend, srcName string, dest Backend, destName string, hdr schwift.ObjectHeaders) error {
+	srcHdr, err := src.Get(srcName)
+	if err != nil {
+		return err
+	}
+	body, _, err := src.Download(srcName)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	copied := storedHeaders(srcHdr)
+	if isLargeObject(srcHdr) {
+		copied.Etag().Del()
+	}
+	for k, v := range hdr.Headers {
+		copied.Set(k, v)
+	}
+	return dest.Upload(destName, body, copied)
+}
+
+// storedHeaders returns the headers of an upload which are stored with the
+// object, for the backends other than Swift. X-Delete-After is converted to
+// X-Delete-At like Swift does.
+func storedHeaders(hdr schwift.ObjectHeaders) schwift.ObjectHeaders {
+	stored := schwift.NewObjectHeaders()
+	for k, v := range hdr.Headers {
+		switch {
+		case k == "Content-Type", k == "Content-Encoding", k == "Content-Disposition",
+			k == "Etag", k == "X-Delete-At", strings.HasPrefix(k, "X-Object-Meta-"):
+			stored.Set(k, v)
+		case k == "X-Delete-After":
+			if sec, err := strconv.Atoi(v); err == nil {
+				stored.ExpiresAt().Set(time.Now().Add(time.Duration(sec) * time.Second))
+			}
+		}
+	}
+	if !stored.ContentType().Exists() {
+		stored.ContentType().Set("application/octet-stream")
+	}
+	return stored
+}
+
+// updateHeaders replaces the metadata in stored with the metadata in hdr, like
+// a POST to an object of Swift does. The content type is kept if hdr has none.
+func updateHeaders(stored, hdr schwift.ObjectHeaders) schwift.ObjectHeaders {
+	updated := storedHeaders(hdr)
+	if !hdr.ContentType().Exists() {
+		updated.ContentType().Set(stored.ContentType().Get())
+	}
+	updated.Etag().Set(stored.Etag().Get())
+	for k, v := range updated.Headers {
+		if v == "" {
+			delete(updated.Headers, k)
+		}
+	}
+	return updated
+}
+
+// isExpired returns true if the object is past its X-Delete-At.
+func isExpired(hdr schwift.ObjectHeaders) bool {
+	return hdr.ExpiresAt().Exists() && !time.Now().Before(hdr.ExpiresAt().Get())
+}
+
+// objectHeaders returns the headers of an object of the size and the
+// modification time, in addition to the stored headers.
+func objectHeaders(stored schwift.ObjectHeaders, size int64, modtime time.Time) schwift.ObjectHeaders {
+	hdr := schwift.NewObjectHeaders()
+	for k, v := range stored.Headers {
+		hdr.Set(k, v)
+	}
+	hdr.SizeBytes().Set(uint64(size))
+	hdr.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	return hdr
+}
+
+// verifyingReader computes the MD5 of the content read through it.
+type verifyingReader struct {
+	io.Reader
+	hash hash.Hash
+}
+
+func newVerifyingReader(r io.Reader) *verifyingReader {
+	h := md5.New()
+	return &verifyingReader{Reader: io.TeeReader(r, h), hash: h}
+}
+
+// verify returns schwift.ErrChecksumMismatch if the Etag header is set and
+// differs from the MD5 of the content.
+func (v *verifyingReader) verify(hdr schwift.ObjectHeaders) (string, error) {
+	sum := hex.EncodeToString(v.hash.Sum(nil))
+	if etag := strings.Trim(hdr.Etag().Get(), `"`); etag != "" && !strings.EqualFold(etag, sum) {
+		return "", schwift.ErrChecksumMismatch
+	}
+	return sum, nil
+}
+
+// pageOf returns the entries after marker, up to limit.
+func pageOf(files []*SwiftFile, marker string, limit int) []*SwiftFile {
+	start := 0
+	if marker != "" {
+		for start < len(files) && files[start].name <= marker {
+			start++
+		}
+	}
+	end := len(files)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return files[start:end]
+}
+
+// sliceLister pages through entries which are listed at once. The marker is
+// the name of the last returned entry, so entries created while listing are
+// returned if they come later.
+type sliceLister struct {
+	list   func() ([]*SwiftFile, error)
+	marker string
+	eof    bool
+}
+
+func (l *sliceLister) NextPage(limit int) ([]*SwiftFile, error) {
+	if l.eof {
+		return nil, nil
+	}
+	files, err := l.list()
+	if err != nil {
+		return nil, err
+	}
+	page := pageOf(files, l.marker, limit)
+	if len(page) == 0 {
+		l.eof = true
+		return nil, nil
+	}
+	l.marker = page[len(page)-1].name
+	return page, nil
+}
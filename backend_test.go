@@ -0,0 +1,291 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+func upload(t *testing.T, b Backend, name, content string) {
+	if err := b.Upload(name, strings.NewReader(content), schwift.NewObjectHeaders()); err != nil {
+		t.Fatalf("upload of %s failed: %v", name, err)
+	}
+}
+
+func download(b Backend, name string, offset, length int64) (string, error) {
+	body, err := b.DownloadRange(name, offset, length)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	return string(data), err
+}
+
+func names(files []*SwiftFile) []string {
+	list := make([]string, 0, len(files))
+	for _, f := range files {
+		list = append(list, f.name)
+	}
+	return list
+}
+
+// testBackend checks the behavior which SwiftFS expects of a backend.
+func testBackend(t *testing.T, backend Backend) {
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+	b := backend.WithContainer("c1")
+	if exists, _ := b.ExistsContainer(); exists {
+		t.Fatal("c1 must not exist yet")
+	}
+	if err := b.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+
+	upload(t, b, "x.txt", "hello world")
+	upload(t, b, "a/b.txt", "in a")
+	if err := createDirectory(b, "d/"); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := schwift.NewObjectHeaders()
+	hdr.Etag().Set("0123456789abcdef0123456789abcdef")
+	if err := b.Upload("bad.txt", strings.NewReader("data"), hdr); err != schwift.ErrChecksumMismatch {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	if _, err := b.Get("bad.txt"); !isNotFound(err) {
+		t.Errorf("object with checksum mismatch must not be stored: %v", err)
+	}
+
+	hdr, err := b.Get("x.txt")
+	if err != nil || hdr.SizeBytes().Get() != 11 || hdr.Etag().Get() != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Errorf("unexpected headers %v %v", hdr.Headers, err)
+	}
+	if hdr.UpdatedAt().Get().IsZero() {
+		t.Errorf("x.txt has no modification time")
+	}
+	if hdr, err = b.Get("d/"); err != nil || !isDirectoryMarker(hdr) {
+		t.Errorf("d is not a directory: %v %v", hdr.Headers, err)
+	}
+	if _, err = b.Get("missing.txt"); !isNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	if data, err := download(b, "x.txt", 6, 0); err != nil || data != "world" {
+		t.Errorf("unexpected range %q %v", data, err)
+	}
+	if data, err := download(b, "x.txt", 0, 5); err != nil || data != "hello" {
+		t.Errorf("unexpected range %q %v", data, err)
+	}
+
+	entries, err := readDirectory(b, "")
+	if expected := []string{"/a/", "/d/", "/x.txt"}; err != nil || strings.Join(names(entries), ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected listing %v %v", names(entries), err)
+	}
+	lister := b.ListDirectory("")
+	for _, expected := range []string{"/a/", "/d/", "/x.txt", ""} {
+		page, err := lister.NextPage(1)
+		if err != nil || strings.Join(names(page), "") != expected {
+			t.Errorf("unexpected page %v %v, expected %s", names(page), err, expected)
+		}
+	}
+	if entries, err = readDirectory(b, "a"); err != nil || len(entries) != 1 || entries[0].name != "/a/b.txt" || entries[0].Size() != 4 {
+		t.Errorf("unexpected listing of a %v %v", names(entries), err)
+	}
+	if f, err := b.FirstInDirectory("a"); err != nil || f == nil {
+		t.Errorf("a is not found %v", err)
+	}
+	if f, err := b.FirstInDirectory("none"); err != nil || f != nil {
+		t.Errorf("unexpected directory %v %v", f, err)
+	}
+	if empty, err := isEmptyDirectory(b, "d"); err != nil || !empty {
+		t.Errorf("d must be empty %v", err)
+	}
+	if empty, err := isEmptyDirectory(b, "a"); err != nil || empty {
+		t.Errorf("a must not be empty %v", err)
+	}
+	if err = deleteDirectory(b, "d"); err != nil {
+		t.Error(err)
+	} else if f, _ := b.FirstInDirectory("d"); f != nil {
+		t.Errorf("d still exists")
+	}
+
+	meta := schwift.NewObjectHeaders()
+	meta.Metadata().Set("owner", "alice")
+	if err = b.SetMetadata("x.txt", meta); err != nil {
+		t.Error(err)
+	} else if hdr, _ = b.Get("x.txt"); hdr.Metadata().Get("owner") != "alice" || hdr.Etag().Get() == "" {
+		t.Errorf("metadata was not set %v", hdr.Headers)
+	}
+
+	// copies to another container
+	c2 := b.WithContainer("c2")
+	c2.CreateContainer()
+	extra := schwift.NewObjectHeaders()
+	extra.Metadata().Set("copied", "yes")
+	if err = b.CopyTo("x.txt", c2, "y.txt", extra); err != nil {
+		t.Error(err)
+	} else if hdr, _ = c2.Get("y.txt"); hdr.Metadata().Get("owner") != "alice" || hdr.Metadata().Get("copied") != "yes" {
+		t.Errorf("metadata was not copied %v", hdr.Headers)
+	}
+	if err = c2.MoveTo("y.txt", b, "z/y.txt"); err != nil {
+		t.Error(err)
+	} else if data, _ := download(b, "z/y.txt", 0, 0); data != "hello world" {
+		t.Errorf("unexpected content after move %q", data)
+	}
+	if _, err = c2.Get("y.txt"); !isNotFound(err) {
+		t.Errorf("y.txt was not moved %v", err)
+	}
+
+	expired := schwift.NewObjectHeaders()
+	expired.ExpiresAt().Set(time.Now().Add(-time.Minute))
+	if err = b.Upload("old.txt", strings.NewReader("old"), expired); err != nil {
+		t.Error(err)
+	} else if _, err = b.Get("old.txt"); !isNotFound(err) {
+		t.Errorf("expired object must not be found %v", err)
+	}
+
+	if err = b.Delete("x.txt"); err != nil {
+		t.Error(err)
+	} else if _, err = b.Get("x.txt"); !isNotFound(err) {
+		t.Errorf("x.txt was not deleted %v", err)
+	}
+	if err = b.Delete("x.txt"); !isNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	containers, err := backend.ListContainers()
+	if err != nil || strings.Join(names(containers), ",") != "c1/,c2/" {
+		t.Errorf("unexpected containers %v %v", names(containers), err)
+	}
+	// expired objects are counted until they are removed, like in Swift
+	if used, _, err := b.Usage(); err != nil || used != 4+11+3 {
+		t.Errorf("unexpected usage %d %v", used, err)
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend(Config{}))
+}
+
+func TestLocalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swift-sftp-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testBackend(t, NewLocalBackend(Config{LocalDir: dir}))
+
+	// objects are plain files
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "c1", "a", "b.txt")); err != nil || string(data) != "in a" {
+		t.Errorf("unexpected file %q %v", data, err)
+	}
+	// names can't point outside of the container
+	b := NewLocalBackend(Config{LocalDir: dir}).WithContainer("c1")
+	upload(t, b, "../../escape.txt", "data")
+	if _, err := os.Stat(filepath.Join(dir, "c1", "escape.txt")); err != nil {
+		t.Errorf("object is not in the container: %v", err)
+	}
+
+	// containers can't point outside of the local directory or to the metadata
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600)
+	for _, name := range []string{"", ".", "..", localMetaDir, "c1/a", `c1\a`} {
+		c := NewLocalBackend(Config{LocalDir: dir}).WithContainer(name)
+		if _, err := c.Get("secret"); err == nil {
+			t.Errorf("%q: the object outside of the container was found", name)
+		}
+		if _, err := download(c, "secret", 0, 0); err == nil {
+			t.Errorf("%q: the object outside of the container was read", name)
+		}
+		if err := c.Upload("meta/c1/a/b.txt.json", strings.NewReader("{}"), schwift.NewObjectHeaders()); err == nil {
+			t.Errorf("%q: the object outside of the container was written", name)
+		}
+		if err := c.CreateContainer(); err == nil {
+			t.Errorf("%q: the container was created", name)
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(data) != "secret" {
+		t.Errorf("the file outside of the container was changed %q", data)
+	}
+}
+
+// TestSwiftFSOffline runs an SFTP session on the memory backend.
+func TestSwiftFSOffline(t *testing.T) {
+	b := NewMemoryBackend(Config{SwiftTimeout: 10}).WithContainer("c1")
+	b.CreateContainer()
+	upload(t, b, "old.txt", "hello")
+
+	client := startFakeSftp(t, b)
+
+	if err := client.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.Create("/dir/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new file"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// appending downloads the object because there are no segments
+	w, err = client.OpenFile("/old.txt", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(" world"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := download(b, "old.txt", 0, 0); data != "hello world" {
+		t.Errorf("unexpected content after append %q", data)
+	}
+
+	if err = client.Rename("/dir/new.txt", "/dir/renamed.txt"); err != nil {
+		t.Error(err)
+	}
+	r, err := client.Open("/dir/renamed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "new file" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	infos, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, fi := range infos {
+		listed = append(listed, fi.Name())
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != "dir,old.txt" {
+		t.Errorf("unexpected listing %v", listed)
+	}
+
+	if err = client.RemoveDirectory("/dir"); err == nil {
+		t.Errorf("directory which is not empty was removed")
+	}
+	if err = client.Remove("/dir/renamed.txt"); err != nil {
+		t.Error(err)
+	}
+	if err = client.RemoveDirectory("/dir"); err != nil {
+		t.Error(err)
+	}
+	if _, err = client.Stat("/dir"); err == nil {
+		t.Errorf("dir still exists")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sharedCacheOnce sync.Once
+	sharedCache     *metaCache
+)
+
+// metaCache holds the metadata of objects and the directories whose entries
+// are all cached, for a limited time. A nil *metaCache caches nothing.
+type metaCache struct {
+	ttl time.Duration
+
+	lock        sync.Mutex
+	entries     map[string]cacheEntry
+	listed      map[string]time.Time // expiry of the listed directories
+	invalidated time.Time            // last time when something was invalidated
+}
+
+type cacheEntry struct {
+	file    SwiftFile
+	expires time.Time
+}
+
+// newMetaCache returns the cache for a session. All sessions use the same
+// cache if SharedCache is set. It returns nil if CacheTTL is 0.
+func newMetaCache(conf Config) *metaCache {
+	if conf.CacheTTL <= 0 {
+		return nil
+	}
+
+	newCache := func() *metaCache {
+		return &metaCache{
+			ttl:     time.Duration(conf.CacheTTL) * time.Second,
+			entries: map[string]cacheEntry{},
+			listed:  map[string]time.Time{},
+		}
+	}
+
+	if !conf.SharedCache {
+		return newCache()
+	}
+	sharedCacheOnce.Do(func() {
+		sharedCache = newCache()
+	})
+	return sharedCache
+}
+
+// get returns the cached metadata of the object or the directory.
+func (c *metaCache) get(container, name string) (*SwiftFile, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := cacheKey(container, name)
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	} else if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	f := e.file
+	return &f, true
+}
+
+// put caches the metadata of f, whose name is the object name or the directory
+// name ending with a slash.
+func (c *metaCache) put(container string, f *SwiftFile) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[cacheKey(container, f.name)] = cacheEntry{
+		file:    *f,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// setListed marks that all entries of the directory are cached, so a missing
+// entry does not exist. since is the time when the listing started; the mark
+// expires no later than the entries.
+func (c *metaCache) setListed(container, dir string, since time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// The listing may miss changes made while it was running.
+	if since.Before(c.invalidated) {
+		return
+	}
+	c.listed[cacheKey(container, dir)] = since.Add(c.ttl)
+}
+
+// isListed returns true if all entries of the directory are cached.
+func (c *metaCache) isListed(container, dir string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := cacheKey(container, dir)
+	expires, ok := c.listed[key]
+	if ok && time.Now().After(expires) {
+		delete(c.listed, key)
+		return false
+	}
+	return ok
+}
+
+// invalidate removes the object and its parent directories from the cache
+// after the object is written, renamed or deleted.
+func (c *metaCache) invalidate(container, name string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.invalidated = time.Now()
+
+	name = strings.Trim(name, "/")
+	delete(c.entries, cacheKey(container, name))
+	delete(c.listed, cacheKey(container, name))
+	for name != "" {
+		name = path.Dir(name)
+		if name == "." {
+			name = ""
+		}
+		delete(c.entries, cacheKey(container, name))
+		delete(c.listed, cacheKey(container, name))
+	}
+}
+
+func cacheKey(container, name string) string {
+	return container + Delimiter + strings.Trim(name, "/")
+}
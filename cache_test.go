@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetaCache(t *testing.T) {
+	c := newMetaCache(Config{CacheTTL: 60})
+
+	c.put("c", &SwiftFile{name: "dir/file.dat", size: 10})
+	c.put("c", &SwiftFile{name: "dir/"})
+	c.setListed("c", "dir", time.Now())
+
+	if f, ok := c.get("c", "dir/file.dat"); !ok || f.Size() != 10 {
+		t.Errorf("file.dat is not cached")
+	}
+	if f, ok := c.get("c", "dir"); !ok || !f.IsDir() {
+		t.Errorf("dir is not cached")
+	}
+	if _, ok := c.get("other", "dir/file.dat"); ok {
+		t.Errorf("file.dat is cached for another container")
+	}
+	if !c.isListed("c", "dir") {
+		t.Errorf("dir is not listed")
+	}
+
+	c.invalidate("c", "dir/file.dat")
+	if _, ok := c.get("c", "dir/file.dat"); ok {
+		t.Errorf("file.dat is still cached")
+	}
+	if _, ok := c.get("c", "dir"); ok {
+		t.Errorf("parent directory is still cached")
+	}
+	if c.isListed("c", "dir") {
+		t.Errorf("parent directory is still listed")
+	}
+
+	// A listing which started before the invalidation is not complete.
+	c.setListed("c", "dir", time.Now().Add(-time.Second))
+	if c.isListed("c", "dir") {
+		t.Errorf("stale listing is marked as listed")
+	}
+}
+
+func TestMetaCacheExpire(t *testing.T) {
+	c := newMetaCache(Config{CacheTTL: 1})
+	c.put("c", &SwiftFile{name: "file.dat"})
+	c.setListed("c", "", time.Now().Add(-2*time.Second))
+
+	if c.isListed("c", "") {
+		t.Errorf("expired listing is marked as listed")
+	}
+
+	c.entries[cacheKey("c", "file.dat")] = cacheEntry{expires: time.Now().Add(-time.Second)}
+	if _, ok := c.get("c", "file.dat"); ok {
+		t.Errorf("expired entry is returned")
+	}
+}
+
+func TestMetaCacheDisabled(t *testing.T) {
+	c := newMetaCache(Config{})
+	if c != nil {
+		t.Fatalf("cache is not disabled")
+	}
+
+	c.put("c", &SwiftFile{name: "file.dat"})
+	if _, ok := c.get("c", "file.dat"); ok {
+		t.Errorf("disabled cache returns an entry")
+	}
+	c.invalidate("c", "file.dat")
+}
+
+func TestMetaCacheSession(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.config.CacheTTL = 60
+	for _, name := range []string{"d/a", "d/b", "d/c"} {
+		s.Put(name, strings.NewReader("x"))
+	}
+	var requests int32
+	f.Fail = func(r *http.Request) int {
+		atomic.AddInt32(&requests, 1)
+		return 0
+	}
+
+	client := startFakeSftp(t, s)
+	if _, err := client.ReadDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt32(&requests)
+	for _, name := range []string{"/d/a", "/d/b", "/d/c"} {
+		if _, err := client.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := client.Stat("/d/none"); err == nil {
+		t.Error("none exists")
+	}
+	if n := atomic.LoadInt32(&requests) - before; n != 0 {
+		t.Errorf("Stats of a listed directory sent %d requests", n)
+	}
+
+	// changes by the session are visible immediately
+	w, _ := client.Create("/d/new")
+	w.Write([]byte("y"))
+	w.Close()
+	if _, err := client.Stat("/d/new"); err != nil {
+		t.Errorf("new is not found: %v", err)
+	}
+	client.Remove("/d/a")
+	if _, err := client.Stat("/d/a"); err == nil {
+		t.Error("a still exists")
+	}
+	client.Rename("/d/b", "/d/b2")
+	if _, err := client.Stat("/d/b2"); err != nil {
+		t.Errorf("b2 is not found: %v", err)
+	}
+	if _, err := client.Stat("/d/b"); err == nil {
+		t.Error("b still exists")
+	}
+}
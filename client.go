@@ -10,4 +10,7 @@ type Client struct {
 	Username   string
 	RemoteAddr net.Addr
 	StartedAt  time.Time
+
+	// Containers the client may access. The first one is the home container.
+	Containers []string
 }
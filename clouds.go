@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// cloudsFile is the clouds.yaml of the OpenStack client tools.
+type cloudsFile struct {
+	Clouds map[string]cloudProfile `yaml:"clouds"`
+}
+
+type cloudProfile struct {
+	Auth       cloudAuth `yaml:"auth"`
+	RegionName string    `yaml:"region_name"`
+	Interface  string    `yaml:"interface"`
+	CACert     string    `yaml:"cacert"`
+	Cert       string    `yaml:"cert"`
+	Key        string    `yaml:"key"`
+}
+
+// cloudAuth has only string fields, so that merge can fill them.
+type cloudAuth struct {
+	AuthURL           string `yaml:"auth_url"`
+	Token             string `yaml:"token"`
+	Username          string `yaml:"username"`
+	UserID            string `yaml:"user_id"`
+	Password          string `yaml:"password"`
+	UserDomainName    string `yaml:"user_domain_name"`
+	UserDomainID      string `yaml:"user_domain_id"`
+	ProjectName       string `yaml:"project_name"`
+	ProjectID         string `yaml:"project_id"`
+	ProjectDomainName string `yaml:"project_domain_name"`
+	ProjectDomainID   string `yaml:"project_domain_id"`
+	// Default domain of the user and the project
+	DomainName string `yaml:"domain_name"`
+	DomainID   string `yaml:"domain_id"`
+
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialName   string `yaml:"application_credential_name"`
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+}
+
+// merge sets the empty fields of a to the values of b.
+func (a *cloudAuth) merge(b cloudAuth) {
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b)
+	for i := 0; i < av.NumField(); i++ {
+		if av.Field(i).String() == "" {
+			av.Field(i).SetString(bv.Field(i).String())
+		}
+	}
+}
+
+// cloudsDirectories returns the directories which are searched for
+// clouds.yaml and secure.yaml, in the order of the OpenStack client tools.
+func cloudsDirectories() []string {
+	dirs := []string{"."}
+	if u, err := user.Current(); err == nil {
+		dirs = append(dirs, filepath.Join(u.HomeDir, ".config", "openstack"))
+	}
+	return append(dirs, "/etc/openstack")
+}
+
+// findCloudsFile returns the first existing file of the name.
+func findCloudsFile(name string) string {
+	for _, dir := range cloudsDirectories() {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func readCloudsFile(path string) (*cloudsFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f cloudsFile
+	if err = yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Couldn't parse '%s' [%v]", path, err)
+	}
+	return &f, nil
+}
+
+// loadCloud reads the profile of the cloud from the clouds.yaml. If path is
+// empty, OS_CLIENT_CONFIG_FILE or the default locations are used. Secrets in a
+// secure.yaml next to it are merged.
+func loadCloud(path string, name string) (*cloudProfile, error) {
+	if path == "" {
+		path = os.Getenv("OS_CLIENT_CONFIG_FILE")
+	}
+	if path == "" {
+		if path = findCloudsFile("clouds.yaml"); path == "" {
+			return nil, fmt.Errorf("clouds.yaml is not found")
+		}
+	}
+
+	f, err := readCloudsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := f.Clouds[name]
+	if !ok {
+		return nil, fmt.Errorf("Cloud '%s' is not found in '%s'", name, path)
+	}
+
+	secure := filepath.Join(filepath.Dir(path), "secure.yaml")
+	if _, err := os.Stat(secure); err == nil {
+		sf, err := readCloudsFile(secure)
+		if err != nil {
+			return nil, err
+		}
+		p.Auth.merge(sf.Clouds[name].Auth)
+		if p.RegionName == "" {
+			p.RegionName = sf.Clouds[name].RegionName
+		}
+	}
+
+	log.Debugf("Loaded cloud '%s' from '%s'", name, path)
+	return &p, nil
+}
+
+// applyCloud sets the OpenStack parameters which are not configured to the
+// values of the profile.
+func (c *Config) applyCloud(p *cloudProfile) {
+	fill := func(field *string, values ...string) {
+		for _, v := range values {
+			if *field == "" {
+				*field = v
+			}
+		}
+	}
+
+	a := p.Auth
+	fill(&c.OsIdentityEndpoint, a.AuthURL)
+	fill(&c.OsToken, a.Token)
+	fill(&c.OsUsername, a.Username)
+	fill(&c.OsUserID, a.UserID)
+	fill(&c.OsPassword, a.Password)
+	fill(&c.OsUserDomainName, a.UserDomainName, a.DomainName)
+	fill(&c.OsUserDomainID, a.UserDomainID, a.DomainID)
+	fill(&c.OsProjectName, a.ProjectName)
+	fill(&c.OsProjectID, a.ProjectID)
+	fill(&c.OsProjectDomainName, a.ProjectDomainName, a.DomainName)
+	fill(&c.OsProjectDomainID, a.ProjectDomainID, a.DomainID)
+	fill(&c.OsApplicationCredentialID, a.ApplicationCredentialID)
+	fill(&c.OsApplicationCredentialName, a.ApplicationCredentialName)
+	fill(&c.OsApplicationCredentialSecret, a.ApplicationCredentialSecret)
+	fill(&c.OsRegion, p.RegionName)
+	fill(&c.OsInterface, p.Interface)
+	fill(&c.TLSCAFile, p.CACert)
+	fill(&c.TLSCertFile, p.Cert)
+	fill(&c.TLSKeyFile, p.Key)
+}
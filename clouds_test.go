@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testCloudsYAML = `
+clouds:
+  prod:
+    auth:
+      auth_url: https://keystone.example.com/v3
+      application_credential_id: 0123456789abcdef
+    region_name: region1
+  dev:
+    auth:
+      auth_url: https://keystone.example.com/v3
+      username: demo
+      domain_name: Default
+      project_name: demo-project
+`
+
+const testSecureYAML = `
+clouds:
+  prod:
+    auth:
+      application_credential_secret: s3cr3t
+  dev:
+    auth:
+      password: passw0rd
+`
+
+func TestLoadCloud(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swift-sftp-clouds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "clouds.yaml")
+	ioutil.WriteFile(path, []byte(testCloudsYAML), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "secure.yaml"), []byte(testSecureYAML), 0600)
+
+	p, err := loadCloud(path, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{OsRegion: "region2"}
+	c.applyCloud(p)
+	if c.OsIdentityEndpoint != "https://keystone.example.com/v3" ||
+		c.OsApplicationCredentialID != "0123456789abcdef" ||
+		c.OsApplicationCredentialSecret != "s3cr3t" {
+		t.Errorf("unexpected config %+v", c)
+	}
+	if c.OsRegion != "region2" {
+		t.Errorf("configured values must take precedence, got region %s", c.OsRegion)
+	}
+
+	p, err = loadCloud(path, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = Config{}
+	c.applyCloud(p)
+	if c.OsUsername != "demo" || c.OsPassword != "passw0rd" ||
+		c.OsUserDomainName != "Default" || c.OsProjectDomainName != "Default" {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	if _, err = loadCloud(path, "missing"); err == nil {
+		t.Errorf("missing cloud must be an error")
+	}
+}
+
+func TestAuthOptions(t *testing.T) {
+	s := NewSwift(Config{
+		OsApplicationCredentialID:     "id",
+		OsApplicationCredentialSecret: "secret",
+		OsProjectName:                 "ignored",
+	})
+	opts, err := s.authOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ApplicationCredentialID != "id" || opts.ApplicationCredentialSecret != "secret" || opts.Scope != nil {
+		t.Errorf("unexpected options for application credentials %+v", opts)
+	}
+
+	s = NewSwift(Config{OsToken: "token", OsProjectID: "project"})
+	opts, _ = s.authOptions()
+	if opts.TokenID != "token" || opts.AllowReauth || opts.Scope == nil || opts.Scope.ProjectID != "project" {
+		t.Errorf("unexpected options for a token %+v", opts)
+	}
+
+	s = NewSwift(Config{
+		OsUserID:            "user",
+		OsPassword:          "password",
+		OsUserDomainName:    "ignored",
+		OsProjectName:       "project",
+		OsProjectDomainName: "domain",
+	})
+	opts, _ = s.authOptions()
+	if opts.UserID != "user" || opts.Password != "password" || opts.DomainName != "" ||
+		opts.Scope.ProjectName != "project" || opts.Scope.DomainName != "domain" {
+		t.Errorf("unexpected options for a password %+v", opts)
+	}
+}
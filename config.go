@@ -22,6 +22,9 @@ type Config struct {
 	// container creation
 	CreateContainerIfNotExists bool `toml:"create_container"`
 
+	// Expose the containers of the account as top-level directories
+	MultiContainer bool `toml:"multi_container"`
+
 	// password file for password authentication
 	PasswordFilePath string `toml:"password_file"`
 
@@ -36,15 +39,128 @@ type Config struct {
 	SwiftTimeout int `toml:"swift_timeout"`
 	SwiftExpire  int `toml:"swift_expire"`
 
+	// Timeout for connecting to Swift and for waiting for the response headers
+	// (sec), 0 for the default of 30 seconds and no timeout
+	SwiftConnectTimeout  int `toml:"swift_connect_timeout"`
+	SwiftResponseTimeout int `toml:"swift_response_timeout"`
+
+	// Retries of transient failures of Swift, -1 disables retries
+	RetryMax int `toml:"retry_max"`
+	// Wait before the first retry (msec). It doubles for each retry.
+	RetryWait int `toml:"retry_wait"`
+	// Maximum wait between retries (sec)
+	RetryMaxWait int `toml:"retry_max_wait"`
+	// Suspend requests after this number of consecutive failures, -1 disables it
+	CircuitThreshold int `toml:"circuit_threshold"`
+	// Time to suspend requests before Swift is tried again (sec)
+	CircuitTimeout int `toml:"circuit_timeout"`
+
+	// Upload to a temporary object and rename it to the file when it is complete
+	AtomicUpload bool `toml:"atomic_upload"`
+	// Size of segments (MB). Larger files are uploaded as static large objects.
+	// Appended data is uploaded as segments of this size too.
+	SegmentSize int `toml:"segment_size"`
+	// Store the SHA-256 of uploaded files in the object metadata
+	ChecksumSHA256 bool `toml:"checksum_sha256"`
+	// Files with these suffixes are uploads in progress and hidden until renamed
+	PartialSuffixes []string `toml:"partial_suffixes"`
+
+	// Directory for temporary files, os.TempDir() if empty
+	TmpDir string `toml:"tmp_dir"`
+	// Total size of temporary files (MB), 0 for no limit
+	TmpMaxSize int `toml:"tmp_max_size"`
+	// Time to wait for temporary space before a transfer fails (sec)
+	TmpWait int `toml:"tmp_wait"`
+
+	// Lifetime of cached object metadata and directory listings (sec), 0 disables the cache
+	CacheTTL int `toml:"cache_ttl"`
+	// Share the cache between the sessions
+	SharedCache bool `toml:"shared_cache"`
+
+	// Enable versioning on the containers created by the server
+	Versioning bool `toml:"versioning"`
+	// Expose the prior versions of files in the virtual directory .versions
+	ShowVersions bool `toml:"show_versions"`
+
+	// Expiry of uploaded files by user and path. The first matching rule is
+	// applied, swift_expire if none matches.
+	ExpiryRules []ExpiryRule `toml:"expiry"`
+
+	// Send the headers of files as extended attributes of stat
+	ShowMetadata bool `toml:"show_metadata"`
+
+	// Content types by file extension, in addition to the MIME types of the
+	// system
+	ContentTypes map[string]string `toml:"content_types"`
+
+	// Move removed files to the directory .trash instead of deleting them
+	Trash bool `toml:"trash"`
+	// Lifetime of files in the trash (day), -1 keeps them until removed
+	TrashDays int `toml:"trash_days"`
+
+	// File of the master key (32 bytes in hex) to encrypt the uploaded files.
+	// Empty disables the encryption.
+	EncryptionKeyFile string `toml:"encryption_key_file"`
+
+	// Storage of the files: swift (default), local or memory. local stores the
+	// containers as directories of local_dir, memory keeps them until the
+	// server stops. Both are for development and testing without Swift.
+	Backend  string `toml:"backend"`
+	LocalDir string `toml:"local_dir"`
+
+	// Authentication method: keystone (default), tempauth or static.
+	// static uses os_swift_url and os_token without Keystone.
+	AuthType string `toml:"auth_type"`
+	// TempAuth (v1.0) parameters. ST_AUTH, ST_USER and ST_KEY are used if empty.
+	SwiftAuthURL string `toml:"swift_auth_url"`
+	SwiftUser    string `toml:"swift_user"`
+	SwiftKey     string `toml:"swift_key"`
+
 	// Optional parameters for OpenStack
 	// If those are not given, We use environment variables like OS_USERNAME to authenticate the client.
 	OsIdentityEndpoint  string `toml:"os_identity_endpoint"`
 	OsUsername          string `toml:"os_username"`
+	OsUserID            string `toml:"os_user_id"`
 	OsPassword          string `toml:"os_password"`
 	OsUserDomainName    string `toml:"os_user_domain_name"`
+	OsUserDomainID      string `toml:"os_user_domain_id"`
 	OsProjectName       string `toml:"os_project_name"`
+	OsProjectID         string `toml:"os_project_id"`
 	OsProjectDomainName string `toml:"os_project_domain_name"`
+	OsProjectDomainID   string `toml:"os_project_domain_id"`
 	OsRegion            string `toml:"os_region"`
+
+	// Endpoint of Swift including the account, used instead of the service catalog
+	OsSwiftURL string `toml:"os_swift_url"`
+	// Interface of the endpoint in the service catalog: public, internal or admin
+	OsInterface string `toml:"os_interface"`
+
+	// CA bundle to verify Keystone and Swift, in addition to the system CAs
+	TLSCAFile string `toml:"tls_ca_file"`
+	// Client certificate and key
+	TLSCertFile string `toml:"tls_cert_file"`
+	TLSKeyFile  string `toml:"tls_key_file"`
+	// Proxy for Keystone and Swift. HTTPS_PROXY and HTTP_PROXY are used if empty.
+	HTTPProxy string `toml:"http_proxy"`
+
+	// Application credentials, used instead of a password
+	OsApplicationCredentialID     string `toml:"os_application_credential_id"`
+	OsApplicationCredentialName   string `toml:"os_application_credential_name"`
+	OsApplicationCredentialSecret string `toml:"os_application_credential_secret"`
+
+	// Pre-issued token, used instead of a password
+	OsToken string `toml:"os_token"`
+
+	// Profile in clouds.yaml. The parameters above take precedence over it.
+	OsCloud string `toml:"os_cloud"`
+	// Path of clouds.yaml. OS_CLIENT_CONFIG_FILE or the default locations if empty.
+	OsCloudsFile string `toml:"os_clouds_file"`
+}
+
+// hasOsCredentials reports whether credentials for OpenStack are configured.
+func (c *Config) hasOsCredentials() bool {
+	return c.OsApplicationCredentialID != "" || c.OsApplicationCredentialName != "" ||
+		c.OsToken != "" || ((c.OsUsername != "" || c.OsUserID != "") && c.OsPassword != "")
 }
 
 func (c *Config) LoadFromContext(ctx *cli.Context) error {
@@ -53,8 +169,33 @@ func (c *Config) LoadFromContext(ctx *cli.Context) error {
 	c.ServerKeyPath = ctx.String("server-key")
 	c.AuthorizedKeysPath = ctx.String("authorized-keys")
 	c.CreateContainerIfNotExists = ctx.Bool("create-container")
+	c.MultiContainer = ctx.Bool("multi-container")
 	c.SwiftTimeout = ctx.Int("swift-timeout")
 	c.SwiftExpire = ctx.Int("swift-expire")
+	c.RetryMax = ctx.Int("retry-max")
+	c.RetryWait = ctx.Int("retry-wait")
+	c.RetryMaxWait = ctx.Int("retry-max-wait")
+	c.CircuitThreshold = ctx.Int("circuit-threshold")
+	c.CircuitTimeout = ctx.Int("circuit-timeout")
+	c.AtomicUpload = ctx.Bool("atomic-upload")
+	c.ChecksumSHA256 = ctx.Bool("checksum-sha256")
+	c.SegmentSize = ctx.Int("segment-size")
+	if suffixes := ctx.String("partial-suffixes"); suffixes != "" {
+		c.PartialSuffixes = strings.Split(suffixes, ",")
+	}
+	c.TmpDir = ctx.String("tmp-dir")
+	c.TmpMaxSize = ctx.Int("tmp-max-size")
+	c.TmpWait = ctx.Int("tmp-wait")
+	c.CacheTTL = ctx.Int("cache-ttl")
+	c.SharedCache = ctx.Bool("shared-cache")
+	c.Versioning = ctx.Bool("versioning")
+	c.ShowVersions = ctx.Bool("show-versions")
+	c.ShowMetadata = ctx.Bool("show-metadata")
+	c.Trash = ctx.Bool("trash")
+	c.TrashDays = ctx.Int("trash-days")
+	c.EncryptionKeyFile = ctx.String("encryption-key-file")
+	c.Backend = ctx.String("backend")
+	c.LocalDir = ctx.String("local-dir")
 
 	return nil
 }
@@ -129,11 +270,119 @@ func (c *Config) Init() (err error) {
 		return fmt.Errorf("Authorized keys file is required")
 	}
 
+	absPath := func(path *string) (err error) {
+		if *path == "" {
+			return nil
+		}
+		p := *path
+		if u, err := user.Current(); err == nil {
+			p = strings.Replace(p, "~", u.HomeDir, 1)
+		}
+		*path, err = filepath.Abs(p)
+		return err
+	}
+
+	if err = absPath(&c.TmpDir); err != nil {
+		return err
+	}
+
 	// Default timeout
 	if c.SwiftTimeout == 0 {
 		c.SwiftTimeout = 180
 	}
 
+	// Default retries and circuit breaker, the same as the flags
+	if c.RetryMax == 0 {
+		c.RetryMax = 5
+	}
+	if c.RetryWait == 0 {
+		c.RetryWait = 500
+	}
+	if c.RetryMaxWait == 0 {
+		c.RetryMaxWait = 30
+	}
+	if c.CircuitThreshold == 0 {
+		c.CircuitThreshold = 10
+	}
+	if c.CircuitTimeout == 0 {
+		c.CircuitTimeout = 30
+	}
+
+	// Default lifetime of files in the trash
+	if c.TrashDays == 0 {
+		c.TrashDays = 30
+	}
+
+	if c.ContentTypes, err = normalizeContentTypes(c.ContentTypes); err != nil {
+		return err
+	}
+
+	for i := range c.ExpiryRules {
+		if err := c.ExpiryRules[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	if err = absPath(&c.EncryptionKeyFile); err != nil {
+		return err
+	}
+	// Encrypted files are uploaded as a whole.
+	if c.EncryptionKeyFile != "" && c.SegmentSize > 0 {
+		return fmt.Errorf("encryption_key_file can't be used with segment_size")
+	}
+
+	// The parameters of Swift are not used by the other backends.
+	switch c.Backend {
+	case "", backendSwift:
+	case backendLocal:
+		if c.LocalDir == "" {
+			return fmt.Errorf("local_dir is required for the local backend")
+		}
+		return absPath(&c.LocalDir)
+	case backendMemory:
+		return nil
+	default:
+		return fmt.Errorf("Invalid backend '%s', must be swift, local or memory", c.Backend)
+	}
+
+	// ST_AUTH selects TempAuth like in python-swiftclient if nothing else is configured.
+	if c.AuthType == "" && c.OsCloud == "" && !c.hasOsCredentials() && os.Getenv("ST_AUTH") != "" {
+		c.AuthType = authTypeTempAuth
+	}
+	if c.AuthType == authTypeTempAuth {
+		c.tempAuthFromEnv()
+	}
+	if err = c.validateAuthType(); err != nil {
+		return err
+	}
+
+	// OS_CLOUD is used like other environment variables if no credentials are configured.
+	if c.OsCloud == "" && !c.hasOsCredentials() && (c.AuthType == "" || c.AuthType == authTypeKeystone) {
+		c.OsCloud = os.Getenv("OS_CLOUD")
+	}
+	if c.OsCloud != "" {
+		if err = absPath(&c.OsCloudsFile); err != nil {
+			return err
+		}
+		p, err := loadCloud(c.OsCloudsFile, c.OsCloud)
+		if err != nil {
+			return err
+		}
+		c.applyCloud(p)
+	}
+
+	for _, path := range []*string{&c.TLSCAFile, &c.TLSCertFile, &c.TLSKeyFile} {
+		if err = absPath(path); err != nil {
+			return err
+		}
+	}
+	if c.TLSCertFile != "" && c.TLSKeyFile == "" {
+		return fmt.Errorf("Key file of the client certificate is required")
+	}
+	if _, err = endpointAvailability(c.OsInterface); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -3,8 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/urfave/cli"
@@ -114,3 +117,68 @@ func checkInitializedConfig(c1 Config, targets []string) error {
 	}
 	return nil
 }
+
+func TestInitDefaults(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "swift-sftp.conf")
+	conf := fmt.Sprintf("backend = \"memory\"\nserver_key = %q\nauthorized_keys = \"misc/testing/authorized_keys\"\n", filepath.Join(dir, "server.key"))
+	if err := ioutil.WriteFile(filename, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{}
+	if err := c.LoadFromFile(filename); err != nil {
+		t.Fatal(err)
+	} else if err = c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if c.RetryMax != 5 || c.RetryWait != 500 || c.RetryMaxWait != 30 {
+		t.Errorf("Unexpected retries %d %d %d", c.RetryMax, c.RetryWait, c.RetryMaxWait)
+	}
+	if c.CircuitThreshold != 10 || c.CircuitTimeout != 30 {
+		t.Errorf("Unexpected circuit breaker %d %d", c.CircuitThreshold, c.CircuitTimeout)
+	}
+	if c.TrashDays != 30 {
+		t.Errorf("Unexpected lifetime of the trash %d", c.TrashDays)
+	}
+
+	// disabled explicitly
+	c = Config{RetryMax: -1, CircuitThreshold: -1, TrashDays: -1}
+	c.Backend = backendMemory
+	c.ServerKeyPath = filepath.Join(dir, "server.key")
+	c.AuthorizedKeysPath = "misc/testing/authorized_keys"
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if p := newRetryPolicy(c); p.max > 0 {
+		t.Errorf("Retries are not disabled (%d)", p.max)
+	}
+	if newCircuitBreaker(c.CircuitThreshold, time.Second) != nil {
+		t.Error("The circuit breaker is not disabled")
+	}
+	if c.TrashDays != -1 {
+		t.Errorf("Unexpected lifetime of the trash %d", c.TrashDays)
+	}
+}
+
+func TestInitEncryption(t *testing.T) {
+	config := func() Config {
+		return Config{
+			Backend:            backendMemory,
+			ServerKeyPath:      filepath.Join(t.TempDir(), "server.key"),
+			AuthorizedKeysPath: "misc/testing/authorized_keys",
+			EncryptionKeyFile:  "encryption.key",
+		}
+	}
+	c := config()
+	if err := c.Init(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// segments are not encrypted
+	c = config()
+	c.SegmentSize = 100
+	if err := c.Init(); err == nil {
+		t.Error("segment_size was accepted with encryption_key_file")
+	}
+}
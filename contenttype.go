@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// Bytes of the content used to detect its type
+	sniffLength = 512
+	// Extension and content type of gzip-compressed files
+	gzipExtension   = ".gz"
+	gzipContentType = "application/gzip"
+)
+
+// Content types of the extensions of formats which are compressed with gzip as
+// a whole. They are stored with Content-Encoding: gzip, so that browsers
+// decompress and show them. Other compressed files like "name.tar.gz" are
+// archives which must be downloaded as they are.
+var gzipEncodedTypes = map[string]string{
+	".svgz": "image/svg+xml",
+}
+
+// normalizeContentTypes validates the configured content types and returns
+// them by lower-case extension with a leading dot.
+func normalizeContentTypes(types map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(types))
+	for ext, ct := range types {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return nil, fmt.Errorf("Invalid content type '%s' of '%s': %s", ct, ext, err)
+		}
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized[ext] = ct
+	}
+	return normalized, nil
+}
+
+// contentTypeByExtension returns the content type of the extension from the
+// configuration or the MIME types of the system.
+func contentTypeByExtension(c Config, ext string) string {
+	ext = strings.ToLower(ext)
+	if ct, ok := c.ContentTypes[ext]; ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// detectContentType returns the content type and the content encoding of a
+// file from its name, or from its first bytes if the extension is unknown.
+// Only the formats in gzipEncodedTypes get an encoding, unless their
+// extensions have content types in the configuration.
+func detectContentType(c Config, name string, head []byte) (string, string) {
+	ext := path.Ext(path.Base(name))
+	if _, ok := c.ContentTypes[strings.ToLower(ext)]; !ok {
+		if ct, ok := gzipEncodedTypes[strings.ToLower(ext)]; ok {
+			return ct, "gzip"
+		} else if strings.ToLower(ext) == gzipExtension {
+			return gzipContentType, ""
+		}
+	}
+
+	if ct := contentTypeByExtension(c, ext); ext != "" && ct != "" {
+		return ct, ""
+	}
+	if len(head) > 0 {
+		if len(head) > sniffLength {
+			head = head[:sniffLength]
+		}
+		if ct := http.DetectContentType(head); ct != "application/octet-stream" {
+			return ct, ""
+		}
+	}
+	return "", ""
+}
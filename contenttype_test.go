@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	types, err := normalizeContentTypes(map[string]string{"CSV": "text/csv", ".log": "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{ContentTypes: types}
+	gzipped := []byte{0x1f, 0x8b, 0x08, 0x00}
+
+	cases := []struct {
+		name     string
+		head     []byte
+		ct       string
+		encoding string
+	}{
+		{"d/a.json", nil, "application/json", ""},
+		{"a.CSV", nil, "text/csv", ""},
+		{"a.log", []byte("<html>"), "text/plain", ""},
+		{"a.json.gz", gzipped, "application/gzip", ""},
+		{"a.tar.GZ", gzipped, "application/gzip", ""},
+		{"a.svgz", gzipped, "image/svg+xml", "gzip"},
+		{"a", gzipped, "application/x-gzip", ""},
+		{"a", []byte("<html><body></body></html>"), "text/html; charset=utf-8", ""},
+		{"a", []byte{0, 1, 2, 3}, "", ""},
+		{"a", nil, "", ""},
+	}
+	for _, tc := range cases {
+		ct, encoding := detectContentType(c, tc.name, tc.head)
+		if ct != tc.ct || encoding != tc.encoding {
+			t.Errorf("%s: expected %q %q, but %q %q", tc.name, tc.ct, tc.encoding, ct, encoding)
+		}
+	}
+
+	// The configuration overrides the types of compressed files, and
+	// disables the encoding.
+	c.ContentTypes[gzipExtension] = "application/x-gzip"
+	c.ContentTypes[".svgz"] = "image/svg+xml"
+	if ct, encoding := detectContentType(c, "a.json.gz", gzipped); ct != "application/x-gzip" || encoding != "" {
+		t.Errorf("Expected application/x-gzip, but %q %q", ct, encoding)
+	}
+	if ct, encoding := detectContentType(c, "a.svgz", gzipped); ct != "image/svg+xml" || encoding != "" {
+		t.Errorf("Expected image/svg+xml without encoding, but %q %q", ct, encoding)
+	}
+
+	if _, err = normalizeContentTypes(map[string]string{".x": "invalid/"}); err == nil {
+		t.Error("An invalid content type was accepted")
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{SwiftTimeout: 10, ContentTypes: map[string]string{".csv": "text/csv"}})
+
+	client := startFakeSftp(t, s)
+	files := map[string]string{
+		"/a.csv":     "a,b\n",
+		"/b.json.gz": "\x1f\x8b\x08\x00",
+		"/c":         "<html><body></body></html>",
+	}
+	for name, content := range files {
+		w, err := client.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string][2]string{
+		"a.csv":     {"text/csv", ""},
+		"b.json.gz": {"application/gzip", ""},
+		"c":         {"text/html; charset=utf-8", ""},
+	}
+	for name, e := range expected {
+		hdr, err := s.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct, encoding := hdr.ContentType().Get(), hdr.Get("Content-Encoding"); ct != e[0] || encoding != e[1] {
+			t.Errorf("%s: expected %q %q, but %q %q", name, e[0], e[1], ct, encoding)
+		}
+	}
+}
+
+func TestDownloadGzip(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(bytes.Repeat([]byte("compressed data\n"), 1000))
+	gz.Close()
+	data := buf.Bytes()
+
+	// a file stored with Content-Encoding: gzip is downloaded as it is
+	client := startFakeSftp(t, s)
+	w, err := client.Create("/a.svgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if hdr, err := s.Get("a.svgz"); err != nil || hdr.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Unexpected headers %v %v", hdr.Headers, err)
+	}
+
+	r, err := client.Open("/a.svgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("Downloaded data differs (size=%d, expected %d) %v", len(downloaded), len(data), err)
+	}
+	if part, err := download(s, "a.svgz", 10, 20); err != nil || part != string(data[10:30]) {
+		t.Errorf("Downloaded range differs %q %v", part, err)
+	}
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/majewsky/schwift"
+)
+
+const (
+	// Plaintext of an encrypted object is sealed in chunks of this size. Each
+	// chunk is followed by its tag.
+	encryptionChunkSize = 64 * 1024
+	encryptionTagSize   = 16
+	encryptionKeySize   = 32
+
+	// Metadata of encrypted objects. The data key is wrapped by the master
+	// key, the checksums of the plaintext are sealed by the data key.
+	cryptoKeyMeta             = "crypto-key"
+	cryptoKeyIDMeta           = "crypto-key-id"
+	cryptoSizeMeta            = "crypto-size"
+	cryptoContentTypeMeta     = "crypto-content-type"
+	cryptoContentEncodingMeta = "crypto-content-encoding"
+	cryptoPrefixMeta          = "crypto-"
+
+	// Content type of encrypted objects, which marks them in listings. The
+	// content type and the encoding of the plaintext are in the metadata.
+	encryptedContentType = "application/x-swift-sftp-encrypted"
+)
+
+// Checksums of the plaintext in the metadata, which are sealed because they
+// would reveal whether an object has a known content.
+var sealedMeta = []string{"md5", "sha256"}
+
+// keyProvider wraps the data keys of objects with a master key, like a KMS.
+type keyProvider interface {
+	// wrapKey encrypts a data key and returns it with the ID of the master key.
+	wrapKey(key []byte) (id string, wrapped []byte, err error)
+	// unwrapKey decrypts a data key wrapped by the master key of the ID.
+	unwrapKey(id string, wrapped []byte) ([]byte, error)
+}
+
+// fileKeyProvider is a keyProvider with a master key read from a file, which
+// has 32 bytes in hex or raw. The ID of the key is derived from it.
+type fileKeyProvider struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newFileKeyProvider(path string) (*fileKeyProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := data
+	if trimmed := strings.TrimSpace(string(data)); len(trimmed) == 2*encryptionKeySize {
+		if key, err = hex.DecodeString(trimmed); err != nil {
+			return nil, fmt.Errorf("Invalid encryption key in '%s': %s", path, err)
+		}
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("Encryption key in '%s' must be %d bytes", path, encryptionKeySize)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &fileKeyProvider{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+func (p *fileKeyProvider) wrapKey(key []byte) (string, []byte, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return p.id, p.aead.Seal(nonce, nonce, key, []byte(p.id)), nil
+}
+
+func (p *fileKeyProvider) unwrapKey(id string, wrapped []byte) ([]byte, error) {
+	if id != p.id {
+		return nil, fmt.Errorf("Unknown encryption key '%s'", id)
+	} else if len(wrapped) < p.aead.NonceSize() {
+		return nil, errors.New("Invalid wrapped key")
+	}
+	n := p.aead.NonceSize()
+	return p.aead.Open(nil, wrapped[:n], wrapped[n:], []byte(id))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk. The last chunk is marked so that a
+// truncated object can't be decrypted. The data key is unique to the object,
+// so the counter doesn't repeat for a key.
+func chunkNonce(counter int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:], uint64(counter))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptedChunks returns the number of chunks of a plaintext of the size. An
+// empty plaintext has an empty chunk.
+func encryptedChunks(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + encryptionChunkSize - 1) / encryptionChunkSize
+}
+
+// encryptedSize returns the size of the object of a plaintext of the size.
+func encryptedSize(size int64) int64 {
+	return size + encryptedChunks(size)*encryptionTagSize
+}
+
+// decryptedSize returns the size of the plaintext of an object of the size, or
+// false if it can't be an encrypted object.
+func decryptedSize(size int64) (int64, bool) {
+	full, rest := size/(encryptionChunkSize+encryptionTagSize), size%(encryptionChunkSize+encryptionTagSize)
+	if rest == 0 && full > 0 {
+		return full * encryptionChunkSize, true
+	} else if rest < encryptionTagSize {
+		return 0, false
+	}
+	return full*encryptionChunkSize + rest - encryptionTagSize, true
+}
+
+// encryptingReader encrypts a plaintext of a known size in chunks.
+type encryptingReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	chunks int64
+	count  int64
+	rest   int64 // plaintext not read yet
+	plain  []byte
+	buf    []byte // sealed chunk not returned yet
+}
+
+func newEncryptingReader(src io.Reader, aead cipher.AEAD, size int64) *encryptingReader {
+	return &encryptingReader{
+		src:    src,
+		aead:   aead,
+		chunks: encryptedChunks(size),
+		rest:   size,
+		plain:  make([]byte, encryptionChunkSize),
+	}
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.count == r.chunks {
+			if n, _ := r.src.Read(r.plain[:1]); n > 0 {
+				return 0, errors.New("The content is longer than its size")
+			}
+			return 0, io.EOF
+		}
+
+		n := r.rest
+		if n > encryptionChunkSize {
+			n = encryptionChunkSize
+		}
+		if _, err := io.ReadFull(r.src, r.plain[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.buf = r.aead.Seal(r.buf[:0], chunkNonce(r.count, r.count == r.chunks-1), r.plain[:n], nil)
+		r.count++
+		r.rest -= n
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// decryptingReader decrypts the chunks of an object from the chunk count. The
+// first skip bytes of the plaintext are dropped and rest bytes are returned.
+type decryptingReader struct {
+	src   io.ReadCloser
+	aead  cipher.AEAD
+	count int64
+	last  int64 // the last chunk of the object
+	skip  int64
+	rest  int64
+	chunk []byte
+	buf   []byte // opened chunk not returned yet
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.rest == 0 {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.src, r.chunk)
+		if err == io.ErrUnexpectedEOF && r.count == r.last {
+			err = nil
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		r.buf, err = r.aead.Open(r.chunk[:0], chunkNonce(r.count, r.count == r.last), r.chunk[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("Couldn't decrypt chunk %d [%v]", r.count, err)
+		}
+		r.count++
+		if r.skip > 0 {
+			r.buf = r.buf[r.skip:]
+			r.skip = 0
+		}
+		if int64(len(r.buf)) > r.rest {
+			r.buf = r.buf[:r.rest]
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.rest -= int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.src.Close()
+}
+
+// encryptedBackend encrypts the objects of a backend with AES-GCM, so the
+// operators of the storage can't read them. Each object has its own data key,
+// which is stored in the metadata wrapped by the master key. Directory markers
+// and objects uploaded before encryption was enabled are not encrypted.
+//
+// Large objects are not supported, so files are uploaded as a whole.
+type encryptedBackend struct {
+	Backend
+	keyFile string
+	keys    keyProvider
+}
+
+// NewEncryptedBackend returns a backend which encrypts the objects of b with
+// the master key in keyFile. The key is read by Init.
+func NewEncryptedBackend(b Backend, keyFile string) Backend {
+	return (&encryptedBackend{keyFile: keyFile}).with(b)
+}
+
+// with returns the backend encrypting the objects of inner with the same key.
+// It keeps the prior versions if inner does.
+func (b *encryptedBackend) with(inner Backend) Backend {
+	c := *b
+	c.Backend = inner
+	if _, ok := inner.(versionedBackend); ok {
+		return &encryptedVersionedBackend{&c}
+	}
+	return &c
+}
+
+// unencrypted returns the backend of the encrypted objects of b, or false if b
+// doesn't encrypt them.
+func unencrypted(b Backend) (Backend, bool) {
+	switch e := b.(type) {
+	case *encryptedBackend:
+		return e.Backend, true
+	case *encryptedVersionedBackend:
+		return e.Backend, true
+	}
+	return nil, false
+}
+
+func (b *encryptedBackend) Init() error {
+	if err := b.Backend.Init(); err != nil {
+		return err
+	}
+	keys, err := newFileKeyProvider(b.keyFile)
+	if err != nil {
+		return err
+	}
+	b.keys = keys
+	return nil
+}
+
+func (b *encryptedBackend) WithContainer(container string) Backend {
+	return b.with(b.Backend.WithContainer(container))
+}
+
+// dataKey returns the cipher of the data key of an object, or nil if it is not
+// encrypted.
+func (b *encryptedBackend) dataKey(hdr schwift.ObjectHeaders) (cipher.AEAD, error) {
+	wrapped := hdr.Metadata().Get(cryptoKeyMeta)
+	if wrapped == "" {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	key, err := b.keys.unwrapKey(hdr.Metadata().Get(cryptoKeyIDMeta), data)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// decryptedHeaders returns the headers of an object as if it was not
+// encrypted: the size of the plaintext, its MD5 as the ETag and the checksums
+// in the metadata, without the metadata of the encryption.
+func (b *encryptedBackend) decryptedHeaders(hdr schwift.ObjectHeaders) (schwift.ObjectHeaders, error) {
+	aead, err := b.dataKey(hdr)
+	if err != nil || aead == nil {
+		return hdr, err
+	}
+	size, err := strconv.ParseUint(hdr.Metadata().Get(cryptoSizeMeta), 10, 64)
+	if err != nil {
+		return hdr, err
+	}
+
+	decrypted := schwift.NewObjectHeaders()
+	for k, v := range hdr.Headers {
+		if !strings.HasPrefix(strings.ToLower(k), strings.ToLower(objectMetaPrefix+cryptoPrefixMeta)) {
+			decrypted.Set(k, v)
+		}
+	}
+	decrypted.SizeBytes().Set(size)
+	decrypted.Etag().Del()
+	if decrypted.ContentType().Get() == encryptedContentType {
+		decrypted.ContentType().Del()
+	}
+	if ct := hdr.Metadata().Get(cryptoContentTypeMeta); ct != "" {
+		decrypted.ContentType().Set(ct)
+	}
+	if ce := hdr.Metadata().Get(cryptoContentEncodingMeta); ce != "" {
+		decrypted.Set("Content-Encoding", ce)
+	}
+	for _, key := range sealedMeta {
+		if sealed := hdr.Metadata().Get(cryptoPrefixMeta + key); sealed != "" {
+			sum, err := openMeta(aead, sealed)
+			if err != nil {
+				return hdr, err
+			}
+			decrypted.Metadata().Set(key, sum)
+		}
+	}
+	if sum := decrypted.Metadata().Get("md5"); sum != "" {
+		decrypted.Etag().Set(sum)
+		decrypted.Metadata().Del("md5")
+	}
+	return decrypted, nil
+}
+
+// encryptedHeaders returns the headers for an encrypted object, with the
+// content type and the encoding of the plaintext in the metadata.
+func encryptedHeaders(hdr schwift.ObjectHeaders) schwift.ObjectHeaders {
+	encrypted := schwift.NewObjectHeaders()
+	for k, v := range hdr.Headers {
+		encrypted.Set(k, v)
+	}
+	if ct := encrypted.ContentType().Get(); ct != "" && ct != encryptedContentType {
+		encrypted.Metadata().Set(cryptoContentTypeMeta, ct)
+		encrypted.ContentType().Set(encryptedContentType)
+	}
+	if ce := encrypted.Get("Content-Encoding"); ce != "" {
+		encrypted.Metadata().Set(cryptoContentEncodingMeta, ce)
+		encrypted.Del("Content-Encoding")
+	}
+	return encrypted
+}
+
+func sealMeta(aead cipher.AEAD, value string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+func openMeta(aead cipher.AEAD, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	} else if len(data) < aead.NonceSize() {
+		return "", errors.New("Invalid sealed metadata")
+	}
+	n := aead.NonceSize()
+	value, err := aead.Open(nil, data[:n], data[n:], nil)
+	return string(value), err
+}
+
+func (b *encryptedBackend) Get(name string) (schwift.ObjectHeaders, error) {
+	hdr, err := b.Backend.Get(name)
+	if err != nil {
+		return hdr, err
+	}
+	return b.decryptedHeaders(hdr)
+}
+
+func (b *encryptedBackend) GetLink(name string) (schwift.ObjectHeaders, string, error) {
+	hdr, target, err := b.Backend.GetLink(name)
+	if err != nil {
+		return hdr, target, err
+	}
+	hdr, err = b.decryptedHeaders(hdr)
+	return hdr, target, err
+}
+
+func (b *encryptedBackend) Download(name string) (io.ReadCloser, int64, error) {
+	hdr, err := b.Backend.Get(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := b.dataKey(hdr)
+	if err != nil {
+		return nil, 0, err
+	} else if aead == nil {
+		return b.Backend.Download(name)
+	}
+	return b.decrypt(name, hdr, aead, 0, 0)
+}
+
+func (b *encryptedBackend) DownloadRange(name string, offset, length int64) (io.ReadCloser, error) {
+	hdr, err := b.Backend.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := b.dataKey(hdr)
+	if err != nil {
+		return nil, err
+	} else if aead == nil {
+		return b.Backend.DownloadRange(name, offset, length)
+	}
+	body, _, err := b.decrypt(name, hdr, aead, offset, length)
+	return body, err
+}
+
+// decrypt downloads the chunks of the range of the plaintext and decrypts
+// them. It returns the size of the plaintext too.
+func (b *encryptedBackend) decrypt(name string, hdr schwift.ObjectHeaders, aead cipher.AEAD, offset, length int64) (io.ReadCloser, int64, error) {
+	size, err := strconv.ParseInt(hdr.Metadata().Get(cryptoSizeMeta), 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	end := size
+	if length > 0 && offset+length < size {
+		end = offset + length
+	}
+	if offset >= end {
+		return ioutil.NopCloser(bytes.NewReader(nil)), size, nil
+	}
+
+	const sealedChunkSize = encryptionChunkSize + encryptionTagSize
+	first := offset / encryptionChunkSize
+	chunks := (end+encryptionChunkSize-1)/encryptionChunkSize - first
+	body, err := b.Backend.DownloadRange(name, first*sealedChunkSize, chunks*sealedChunkSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &decryptingReader{
+		src:   body,
+		aead:  aead,
+		count: first,
+		last:  encryptedChunks(size) - 1,
+		skip:  offset - first*encryptionChunkSize,
+		rest:  end - offset,
+		chunk: make([]byte, sealedChunkSize),
+	}, size, nil
+}
+
+// Upload encrypts the content with a new data key. The ETag, which is the MD5
+// of the plaintext, is verified after the upload, and the object is deleted
+// if it differs.
+func (b *encryptedBackend) Upload(name string, content io.Reader, hdr schwift.ObjectHeaders) error {
+	if hdr.ContentType().Get() == directoryContentType {
+		return b.Backend.Upload(name, content, hdr)
+	}
+
+	content, size, cleanup, err := sizedContent(content)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	key := make([]byte, encryptionKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	id, wrapped, err := b.keys.wrapKey(key)
+	if err != nil {
+		return err
+	}
+
+	encrypted := encryptedHeaders(hdr)
+	encrypted.ContentType().Set(encryptedContentType)
+	encrypted.Etag().Del()
+	encrypted.Metadata().Set(cryptoKeyMeta, base64.StdEncoding.EncodeToString(wrapped))
+	encrypted.Metadata().Set(cryptoKeyIDMeta, id)
+	encrypted.Metadata().Set(cryptoSizeMeta, strconv.FormatInt(size, 10))
+	sums := map[string]string{"md5": strings.Trim(hdr.Etag().Get(), `"`), "sha256": hdr.Metadata().Get("sha256")}
+	for _, k := range sealedMeta {
+		encrypted.Metadata().Del(k)
+		if sums[k] == "" {
+			continue
+		}
+		sealed, err := sealMeta(aead, sums[k])
+		if err != nil {
+			return err
+		}
+		encrypted.Metadata().Set(cryptoPrefixMeta+k, sealed)
+	}
+
+	verifier := newVerifyingReader(content)
+	if err = b.Backend.Upload(name, newEncryptingReader(verifier, aead, size), encrypted); err != nil {
+		return err
+	}
+	if _, err = verifier.verify(hdr); err != nil {
+		b.Backend.Delete(name)
+		return err
+	}
+	return nil
+}
+
+// sizedContent returns the content with its size, which is written to a
+// temporary file if it can't be seeked.
+func sizedContent(content io.Reader) (io.Reader, int64, func(), error) {
+	if s, ok := content.(io.Seeker); ok {
+		cur, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		end, err := s.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if _, err = s.Seek(cur, io.SeekStart); err != nil {
+			return nil, 0, nil, err
+		}
+		return content, end - cur, func() {}, nil
+	}
+
+	fname, err := createTmpFile()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	f, err := os.OpenFile(fname, os.O_RDWR, 0600)
+	if err != nil {
+		os.Remove(fname)
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(fname)
+	}
+	size, err := io.Copy(f, content)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, size, cleanup, nil
+}
+
+// SetMetadata keeps the metadata of the encryption.
+func (b *encryptedBackend) SetMetadata(name string, hdr schwift.ObjectHeaders) error {
+	stored, err := b.Backend.Get(name)
+	if err != nil {
+		return err
+	}
+
+	updated := schwift.NewObjectHeaders()
+	for k, v := range hdr.Headers {
+		updated.Set(k, v)
+	}
+	for k, v := range stored.Headers {
+		if strings.HasPrefix(strings.ToLower(k), strings.ToLower(objectMetaPrefix+cryptoPrefixMeta)) {
+			updated.Set(k, v)
+		}
+	}
+	if updated.Metadata().Get(cryptoKeyMeta) != "" {
+		for _, k := range sealedMeta {
+			updated.Metadata().Del(k)
+		}
+		updated = encryptedHeaders(updated)
+	}
+	return b.Backend.SetMetadata(name, updated)
+}
+
+// CopyTo copies the encrypted object as it is if dest is encrypted too.
+func (b *encryptedBackend) CopyTo(srcName string, dest Backend, destName string, hdr schwift.ObjectHeaders) error {
+	d, ok := unencrypted(dest)
+	if !ok {
+		return copyObject(b, srcName, dest, destName, hdr)
+	}
+
+	if hdr.ContentType().Exists() || hdr.Get("Content-Encoding") != "" {
+		stored, err := b.Backend.Get(srcName)
+		if err != nil {
+			return err
+		} else if stored.Metadata().Get(cryptoKeyMeta) != "" {
+			hdr = encryptedHeaders(hdr)
+		}
+	}
+	return b.Backend.CopyTo(srcName, d, destName, hdr)
+}
+
+func (b *encryptedBackend) MoveTo(srcName string, dest Backend, destName string) error {
+	if d, ok := unencrypted(dest); ok {
+		return b.Backend.MoveTo(srcName, d, destName)
+	}
+	if err := copyObject(b, srcName, dest, destName, schwift.NewObjectHeaders()); err != nil {
+		return err
+	}
+	return b.Backend.DeleteWithSegments(srcName)
+}
+
+func (b *encryptedBackend) ListDirectory(path string) DirectoryLister {
+	return decryptedLister{b.Backend.ListDirectory(path)}
+}
+
+// encryptedVersionedBackend is an encryptedBackend of a backend which keeps
+// the prior versions of the objects.
+type encryptedVersionedBackend struct {
+	*encryptedBackend
+}
+
+// Versions returns the versions of the object in the history container, which
+// are encrypted too.
+func (b *encryptedVersionedBackend) Versions(name string) (Backend, []*SwiftFile, error) {
+	history, versions, err := b.Backend.(versionedBackend).Versions(name)
+	if err != nil || history == nil {
+		return nil, versions, err
+	}
+	for i, f := range versions {
+		versions[i] = decryptedFile(f)
+	}
+	return b.with(history), versions, nil
+}
+
+// decryptedLister returns the entries of a listing with the sizes of the
+// plaintexts.
+type decryptedLister struct {
+	DirectoryLister
+}
+
+func (l decryptedLister) NextPage(limit int) ([]*SwiftFile, error) {
+	page, err := l.DirectoryLister.NextPage(limit)
+	for i, f := range page {
+		page[i] = decryptedFile(f)
+	}
+	return page, err
+}
+
+// decryptedFile returns the entry of a listing with the size of the plaintext
+// if the object is encrypted. Encrypted objects are known by their content
+// type, so that the metadata doesn't have to be requested for each entry.
+// Objects stored before encryption was enabled keep their size.
+func decryptedFile(f *SwiftFile) *SwiftFile {
+	if f.IsDir() || f.symlink != "" || !strings.HasPrefix(f.contentType, encryptedContentType) {
+		return f
+	}
+	size, ok := decryptedSize(f.size)
+	if !ok {
+		return f
+	}
+	c := *f
+	c.size = size
+	return &c
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/majewsky/schwift"
+)
+
+// encryptedForTesting returns b encrypted with a new key.
+func encryptedForTesting(t *testing.T, b Backend) Backend {
+	dir, err := ioutil.TempDir("", "swift-sftp-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	keyFile := filepath.Join(dir, "key")
+	key := strings.Repeat("0123456789abcdef", 4) + "\n"
+	if err = ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEncryptedBackend(b, keyFile)
+	if err = e.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptedSize(t *testing.T) {
+	for _, size := range []int64{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		if s, ok := decryptedSize(encryptedSize(size)); !ok || s != size {
+			t.Errorf("%d: unexpected size %d %v", size, s, ok)
+		}
+	}
+	for _, size := range []int64{0, 1, encryptionTagSize - 1, encryptionChunkSize + encryptionTagSize + 1} {
+		if _, ok := decryptedSize(size); ok {
+			t.Errorf("%d is not a size of an encrypted object", size)
+		}
+	}
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	plain := NewMemoryBackend(Config{}).WithContainer("c1")
+	plain.CreateContainer()
+	b := encryptedForTesting(t, plain)
+
+	content := bytes.Repeat([]byte("0123456789"), encryptionChunkSize/4)
+	if err := b.Upload("a.bin", bytes.NewReader(content), schwift.NewObjectHeaders()); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored encrypted
+	raw, err := download(plain, "a.bin", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if int64(len(raw)) != encryptedSize(int64(len(content))) || strings.Contains(raw, "0123456789") {
+		t.Errorf("The object is not encrypted (%d bytes)", len(raw))
+	}
+
+	hdr, err := b.Get("a.bin")
+	if err != nil {
+		t.Fatal(err)
+	} else if size := hdr.SizeBytes().Get(); size != uint64(len(content)) {
+		t.Errorf("Expected size %d, but %d", len(content), size)
+	}
+	for k := range hdr.Headers {
+		if strings.HasPrefix(k, objectMetaPrefix+"Crypto-") {
+			t.Errorf("Unexpected header %s", k)
+		}
+	}
+	files, err := readDirectory(b, "")
+	if err != nil || len(files) != 1 || files[0].Size() != int64(len(content)) {
+		t.Errorf("Unexpected listing %v %v", files, err)
+	}
+
+	ranges := [][2]int64{{0, 0}, {5, 10}, {encryptionChunkSize - 3, 10}, {2*encryptionChunkSize + 1, 0}, {int64(len(content)), 0}}
+	for _, r := range ranges {
+		expected := content[r[0]:]
+		if r[1] > 0 {
+			expected = expected[:r[1]]
+		}
+		if data, err := download(b, "a.bin", r[0], r[1]); err != nil || data != string(expected) {
+			t.Errorf("%v: unexpected content (%d bytes) %v", r, len(data), err)
+		}
+	}
+
+	// The ETag is the MD5 of the plaintext.
+	upload(t, b, "empty", "")
+	hdr = schwift.NewObjectHeaders()
+	hdr.Etag().Set("8d777f385d3dfec8815d20f7496026dc")
+	if err = b.Upload("b.txt", strings.NewReader("data"), hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr, err = b.Get("b.txt"); err != nil || hdr.Etag().Get() != "8d777f385d3dfec8815d20f7496026dc" {
+		t.Errorf("Unexpected ETag %q %v", hdr.Etag().Get(), err)
+	}
+	hdr = schwift.NewObjectHeaders()
+	hdr.Etag().Set("0123456789abcdef0123456789abcdef")
+	if err = b.Upload("bad.txt", strings.NewReader("data"), hdr); err != schwift.ErrChecksumMismatch {
+		t.Errorf("Expected a checksum mismatch, but %v", err)
+	} else if _, err = plain.Get("bad.txt"); !isNotFound(err) {
+		t.Errorf("The bad object was kept: %v", err)
+	}
+
+	// The key is kept when the metadata is changed.
+	hdr = schwift.NewObjectHeaders()
+	hdr.Metadata().Set("owner", "alice")
+	if err = b.SetMetadata("b.txt", hdr); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(b, "b.txt", 0, 0); err != nil || data != "data" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	hdr = schwift.NewObjectHeaders()
+	hdr.ContentType().Set("text/plain")
+	if err = b.SetMetadata("b.txt", hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr, err = plain.Get("b.txt"); err != nil || hdr.ContentType().Get() != encryptedContentType {
+		t.Errorf("The encrypted object is not marked: %q %v", hdr.ContentType().Get(), err)
+	} else if hdr, err = b.Get("b.txt"); err != nil || hdr.ContentType().Get() != "text/plain" {
+		t.Errorf("Unexpected headers %v %v", hdr.Headers, err)
+	}
+
+	// copies are encrypted with the same key, or decrypted for other backends
+	encrypted := b.WithContainer("c2")
+	encrypted.CreateContainer()
+	other := plain.WithContainer("c3")
+	other.CreateContainer()
+	if err = b.CopyTo("b.txt", encrypted, "c.txt", schwift.NewObjectHeaders()); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(encrypted, "c.txt", 0, 0); err != nil || data != "data" {
+		t.Errorf("Unexpected copy %q %v", data, err)
+	}
+	hdr = schwift.NewObjectHeaders()
+	hdr.ContentType().Set("text/csv")
+	if err = b.CopyTo("b.txt", encrypted, "e.csv", hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr, err = plain.WithContainer("c2").Get("e.csv"); err != nil || hdr.ContentType().Get() != encryptedContentType {
+		t.Errorf("The copy is not marked: %q %v", hdr.ContentType().Get(), err)
+	} else if hdr, err = encrypted.Get("e.csv"); err != nil || hdr.ContentType().Get() != "text/csv" {
+		t.Errorf("Unexpected content type of the copy %q %v", hdr.ContentType().Get(), err)
+	}
+	if err = b.MoveTo("b.txt", other, "d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(other, "d.txt", 0, 0); err != nil || data != "data" {
+		t.Errorf("Unexpected decrypted copy %q %v", data, err)
+	}
+
+	// objects uploaded before the encryption are read as they are
+	upload(t, plain, "old.txt", "old")
+	if data, err := download(b, "old.txt", 0, 0); err != nil || data != "old" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	if err = createDirectory(b, "d/"); err != nil {
+		t.Fatal(err)
+	} else if hdr, err = plain.Get("d/"); err != nil || hdr.SizeBytes().Get() != 0 {
+		t.Errorf("Unexpected directory %v %v", hdr.Headers, err)
+	}
+}
+
+func TestEncryptedSftp(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	b := encryptedForTesting(t, s)
+
+	client := startFakeSftp(t, b)
+	w, err := client.Create("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// appended without segments
+	if w, err = client.OpenFile("/a.txt", os.O_WRONLY|os.O_APPEND); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(" world"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := client.Stat("/a.txt"); err != nil || fi.Size() != 11 {
+		t.Errorf("Unexpected stat %v %v", fi, err)
+	}
+	r, err := client.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	if raw, err := download(s, "a.txt", 0, 0); err != nil || strings.Contains(raw, "hello") {
+		t.Errorf("The object is not encrypted %q %v", raw, err)
+	}
+
+	if err = client.Rename("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(b, "b.txt", 0, 0); err != nil || data != "hello world" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+}
+
+func TestEncryptedLegacySize(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	b := encryptedForTesting(t, s)
+
+	// The size of an object stored before the encryption was enabled could be
+	// the size of an encrypted one.
+	content := strings.Repeat("x", 100000)
+	if _, ok := decryptedSize(int64(len(content))); !ok {
+		t.Fatal("The size can't be taken for an encrypted one")
+	}
+	upload(t, s, "old.dat", content)
+	hdr := schwift.NewObjectHeaders()
+	hdr.ContentType().Set("text/plain")
+	if err := b.Upload("new.dat", strings.NewReader(content), hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypted objects are marked by their content type, so the listing
+	// doesn't request the headers of each object.
+	if hdr, err := s.Get("new.dat"); err != nil || hdr.ContentType().Get() != encryptedContentType {
+		t.Errorf("Unexpected stored content type %q %v", hdr.ContentType().Get(), err)
+	}
+	if hdr, err := b.Get("new.dat"); err != nil || hdr.ContentType().Get() != "text/plain" {
+		t.Errorf("Unexpected content type %q %v", hdr.ContentType().Get(), err)
+	}
+	var heads int32
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "HEAD" {
+			atomic.AddInt32(&heads, 1)
+		}
+		return 0
+	}
+	files, err := readDirectory(b, "")
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Unexpected listing %v %v", files, err)
+	}
+	for _, fi := range files {
+		if fi.Size() != int64(len(content)) {
+			t.Errorf("%s: unexpected size %d", fi.Name(), fi.Size())
+		}
+	}
+	if n := atomic.LoadInt32(&heads); n != 0 {
+		t.Errorf("%d objects were requested for the listing", n)
+	}
+	f.Fail = nil
+
+	client := startFakeSftp(t, b)
+	for _, name := range []string{"/old.dat", "/new.dat"} {
+		if fi, err := client.Stat(name); err != nil || fi.Size() != int64(len(content)) {
+			t.Errorf("%s: unexpected stat %v %v", name, fi, err)
+		}
+	}
+	entries, err := client.ReadDir("/")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Unexpected entries %v %v", entries, err)
+	}
+	for _, fi := range entries {
+		if fi.Size() != int64(len(content)) {
+			t.Errorf("%s: unexpected size %d", fi.Name(), fi.Size())
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// execCommands is the allow-list of commands which are handled in-process for
+// "exec" requests. Any other command is rejected.
+var execCommands = map[string]func(e *execSession, args []string) uint32{
+	"md5sum": func(e *execSession, args []string) uint32 {
+		return e.checksum("md5", args)
+	},
+	"sha256sum": func(e *execSession, args []string) uint32 {
+		return e.checksum("sha256", args)
+	},
+	"df": func(e *execSession, args []string) uint32 {
+		return e.df(args)
+	},
+	"ls": func(e *execSession, args []string) uint32 {
+		return e.ls(args)
+	},
+	"cp": func(e *execSession, args []string) uint32 {
+		return e.cp(args)
+	},
+}
+
+// Exit status for commands which are not on the allow-list (same as shells).
+const execStatusNotFound = 127
+
+type execSession struct {
+	log    *logrus.Entry
+	swift  Backend
+	fs     *SwiftFS
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func StartExecSession(swift Backend, channel ssh.Channel, client *Client, command string) (err error) {
+	// logger with client
+	clog := log.WithFields(logrus.Fields{
+		"client": client,
+	})
+
+	clog.Infof("Exec %s", command)
+
+	fs := NewSwiftFS(swift)
+	fs.SetLogger(clog)
+	fs.SetUser(client.Username)
+	fs.SetContainers(client.Containers)
+
+	e := &execSession{
+		log:    clog,
+		swift:  swift,
+		fs:     fs,
+		stdout: channel,
+		stderr: channel.Stderr(),
+	}
+	status := e.run(command)
+
+	clog.Debugf("Exec finished [status=%d]", status)
+
+	msg := struct {
+		Status uint32
+	}{status}
+	if _, err = channel.SendRequest("exit-status", false, ssh.Marshal(&msg)); err != nil {
+		return err
+	}
+	return channel.Close()
+}
+
+func (e *execSession) run(command string) uint32 {
+	args, err := splitCommandLine(command)
+	if err != nil {
+		fmt.Fprintf(e.stderr, "%s\n", err.Error())
+		return 2
+	} else if len(args) == 0 {
+		return 0
+	}
+
+	cmd, ok := execCommands[args[0]]
+	if !ok {
+		e.log.Warnf("Unsupported command '%s'", args[0])
+		fmt.Fprintf(e.stderr, "%s: command not found\n", args[0])
+		return execStatusNotFound
+	}
+	return cmd(e, args[1:])
+}
+
+// md5sum, sha256sum
+func (e *execSession) checksum(algorithm string, args []string) uint32 {
+	name := algorithm + "sum"
+
+	_, paths := splitOptions(args)
+	if len(paths) == 0 {
+		fmt.Fprintf(e.stderr, "%s: missing operand\n", name)
+		return 1
+	}
+
+	var status uint32
+	for _, p := range paths {
+		sum, err := e.checksumOf(p, algorithm)
+		if err != nil {
+			e.log.Warnf("%s %s", p, err.Error())
+			fmt.Fprintf(e.stderr, "%s: %s: %s\n", name, p, execErrorMessage(err))
+			status = 1
+			continue
+		}
+		fmt.Fprintf(e.stdout, "%s  %s\n", sum, p)
+	}
+	return status
+}
+
+// checksumOf returns the checksum of a file.
+func (e *execSession) checksumOf(p string, algorithm string) (string, error) {
+	s, name, err := e.fs.resolve(p)
+	if err != nil {
+		return "", err
+	} else if s == nil || name == "" {
+		return "", errors.New("Is a directory")
+	}
+	return checksum(s, name, algorithm)
+}
+
+// df
+func (e *execSession) df(args []string) uint32 {
+	opts, _ := splitOptions(args)
+	human := strings.Contains(opts, "h")
+
+	used, quota, err := e.swift.Usage()
+	if err != nil {
+		e.log.Warnf("df %s", err.Error())
+		fmt.Fprintf(e.stderr, "df: %s\n", execErrorMessage(err))
+		return 1
+	}
+
+	format := func(n uint64) string {
+		if human {
+			return humanSize(n)
+		}
+		return fmt.Sprintf("%d", (n+1023)/1024)
+	}
+
+	size, avail, percent := "-", "-", "-"
+	if quota > 0 {
+		size = format(quota)
+		if quota > used {
+			avail = format(quota - used)
+		} else {
+			avail = format(0)
+		}
+		percent = fmt.Sprintf("%d%%", (used*100+quota-1)/quota)
+	}
+
+	blocks := "1K-blocks"
+	if human {
+		blocks = "Size"
+	}
+	fmt.Fprintf(e.stdout, "%-20s %10s %10s %10s %5s %s\n", "Filesystem", blocks, "Used", "Available", "Use%", "Mounted on")
+	filesystem := e.swift.Container()
+	if filesystem == "" {
+		// multi-container mode
+		filesystem = e.swift.AccountName()
+	}
+	fmt.Fprintf(e.stdout, "%-20s %10s %10s %10s %5s %s\n", filesystem, size, format(used), avail, percent, "/")
+	return 0
+}
+
+// ls
+func (e *execSession) ls(args []string) uint32 {
+	opts, paths := splitOptions(args)
+	long := strings.Contains(opts, "l")
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var status uint32
+	for i, p := range paths {
+		files, err := e.listFiles(p)
+		if err != nil {
+			e.log.Warnf("ls %s %s", p, err.Error())
+			fmt.Fprintf(e.stderr, "ls: cannot access '%s': %s\n", p, execErrorMessage(err))
+			status = 2
+			continue
+		}
+
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(e.stdout)
+			}
+			fmt.Fprintf(e.stdout, "%s:\n", p)
+		}
+		for _, f := range files {
+			if long {
+				fmt.Fprintln(e.stdout, longListing(f))
+			} else {
+				fmt.Fprintln(e.stdout, f.Name())
+			}
+		}
+	}
+	return status
+}
+
+// cp copies files on the server side. A path like "container:/path" refers
+// to another container the client may access.
+func (e *execSession) cp(args []string) uint32 {
+	opts, paths := splitOptions(args)
+	overwrite := !strings.Contains(opts, "n")
+	if len(paths) < 2 {
+		fmt.Fprintf(e.stderr, "cp: missing destination file operand\n")
+		return 1
+	}
+
+	dest := paths[len(paths)-1]
+	srcs := paths[:len(paths)-1]
+	destDir := len(srcs) > 1 || strings.HasSuffix(dest, "/") || e.isDirectory(dest)
+	if len(srcs) > 1 && !destDir {
+		fmt.Fprintf(e.stderr, "cp: target '%s' is not a directory\n", dest)
+		return 1
+	}
+
+	var status uint32
+	for _, src := range srcs {
+		target := dest
+		if destDir {
+			_, name := splitContainerPath(src)
+			target = strings.TrimSuffix(dest, "/") + "/" + path.Base(name)
+		}
+
+		if !overwrite && e.exists(target) {
+			continue
+		}
+		if err := e.fs.CopyFile(src, target, overwrite); err != nil {
+			fmt.Fprintf(e.stderr, "cp: cannot copy '%s' to '%s': %s\n", src, target, execErrorMessage(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// exists returns true if the object exists.
+func (e *execSession) exists(p string) bool {
+	s, name, err := e.fs.resolve(p)
+	if err != nil || s == nil {
+		return false
+	}
+
+	_, err = s.Get(name)
+	return err == nil
+}
+
+// isDirectory returns true if the path is a directory.
+func (e *execSession) isDirectory(p string) bool {
+	s, name, err := e.fs.resolve(p)
+	if err != nil {
+		return false
+	} else if name == "" {
+		return true
+	}
+
+	f, err := e.fs.statObject(s, name)
+	return err == nil && f.IsDir()
+}
+
+// listFiles returns the entries of a directory, or the file itself.
+func (e *execSession) listFiles(p string) ([]os.FileInfo, error) {
+	s, name, err := e.fs.resolve(p)
+	if err != nil {
+		return nil, err
+	} else if s == nil {
+		// the root of multi-container mode
+		return e.fs.listContainers()
+	}
+
+	if name != "" {
+		f, err := e.fs.statObject(s, name)
+		if err == os.ErrNotExist {
+			return nil, sftp.ErrSshFxNoSuchFile
+		} else if err != nil {
+			return nil, err
+		} else if !f.IsDir() {
+			f, ok := visibleFile(f)
+			if !ok {
+				return nil, sftp.ErrSshFxNoSuchFile
+			}
+			return []os.FileInfo{f}, nil
+		}
+	}
+
+	entries, err := readDirectory(s, name)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if f, ok := visibleFile(entry); ok {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files, nil
+}
+
+// longListing formats the file like "ls -l" does.
+func longListing(f os.FileInfo) string {
+	mtime := f.ModTime().Format("Jan _2 15:04")
+	if f.ModTime().Before(time.Now().AddDate(0, -6, 0)) {
+		mtime = f.ModTime().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s %4d %-8s %-8s %12d %s %s", f.Mode(), 1, "swift", "swift", f.Size(), mtime, f.Name())
+}
+
+func humanSize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func execErrorMessage(err error) string {
+	if isNotFound(err) || err == sftp.ErrSshFxNoSuchFile {
+		return "No such file or directory"
+	} else if isForbidden(err) || err == sftp.ErrSshFxPermissionDenied {
+		return "Permission denied"
+	} else if err == sftp.ErrSshFxFailure {
+		return "Operation failed"
+	}
+	return err.Error()
+}
+
+// splitOptions separates short options like "-l" from operands. All option
+// letters are returned concatenated. Arguments after "--" are operands.
+func splitOptions(args []string) (opts string, operands []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return opts, append(operands, args[i+1:]...)
+		} else if strings.HasPrefix(arg, "--") {
+			// Long options are accepted but ignored.
+			continue
+		} else if len(arg) > 1 && strings.HasPrefix(arg, "-") {
+			opts += arg[1:]
+		} else {
+			operands = append(operands, arg)
+		}
+	}
+	return opts, operands
+}
+
+// splitCommandLine splits a command line into words like a POSIX shell does
+// for single quotes, double quotes and backslash escapes.
+func splitCommandLine(s string) ([]string, error) {
+	var (
+		args    []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				word.WriteRune(c)
+			}
+
+		case c == '\\':
+			escaped = true
+			inWord = true
+
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("Unterminated quoted string")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := map[string][]string{
+		`md5sum file.dat`:            {"md5sum", "file.dat"},
+		`  ls   -l  /dir `:           {"ls", "-l", "/dir"},
+		`sha256sum "my file.dat"`:    {"sha256sum", "my file.dat"},
+		`sha256sum 'it''s'`:          {"sha256sum", "its"},
+		`md5sum my\ file.dat "a\"b"`: {"md5sum", "my file.dat", `a"b`},
+		`md5sum ""`:                  {"md5sum", ""},
+		``:                           nil,
+	}
+
+	for line, expected := range tests {
+		args, err := splitCommandLine(line)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("%s: %#v != %#v", line, args, expected)
+		}
+	}
+
+	if _, err := splitCommandLine(`md5sum "file`); err == nil {
+		t.Error("Unterminated quote should be an error")
+	}
+}
+
+func TestSplitOptions(t *testing.T) {
+	opts, operands := splitOptions([]string{"-l", "-ah", "--color=never", "dir", "--", "-file"})
+	if opts != "lah" {
+		t.Errorf("Invalid options [%s]", opts)
+	}
+	if !reflect.DeepEqual(operands, []string{"dir", "-file"}) {
+		t.Errorf("Invalid operands %v", operands)
+	}
+}
+
+func TestExecCommands(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	c2 := s.WithContainer("c2")
+	c2.CreateContainer()
+	s.WithContainer("c3").CreateContainer()
+	s.Put("a.txt", strings.NewReader("hello world"))
+	upload(t, c2, "x.txt", "from c2")
+	upload(t, s.WithContainer("c3"), "y.txt", "from c3")
+
+	fs := NewSwiftFS(s)
+	fs.SetContainers([]string{"c1", "c2"})
+	var stdout, stderr bytes.Buffer
+	e := &execSession{log: log, swift: s, fs: fs, stdout: &stdout, stderr: &stderr}
+
+	tests := []struct {
+		command string
+		status  uint32
+		stdout  string
+	}{
+		{"md5sum a.txt", 0, "5eb63bbbe01eeed093cb22bb8f5acdc3  a.txt\n"},
+		{"md5sum none.txt", 1, ""},
+		{"cp a.txt b.txt", 0, ""},
+		{"cp -n x.txt b.txt", 0, ""},
+		{"cp c2:/x.txt /", 0, ""},
+		{"cp a.txt c2:/dir/", 0, ""},
+		{"cp a.txt c3:/z.txt", 1, ""},
+		{"cp c3:/y.txt y.txt", 1, ""},
+		{"cp none.txt z.txt", 1, ""},
+		{"rm a.txt", execStatusNotFound, ""},
+	}
+	for _, test := range tests {
+		stdout.Reset()
+		stderr.Reset()
+		status := e.run(test.command)
+		if status != test.status || (test.stdout != "" && stdout.String() != test.stdout) {
+			t.Errorf("%s: unexpected status %d [%s] [%s]", test.command, status, stdout.String(), stderr.String())
+		}
+	}
+
+	for _, expected := range []struct {
+		b       Backend
+		name    string
+		content string
+	}{
+		{s, "b.txt", "hello world"},
+		{s, "x.txt", "from c2"},
+		{c2, "dir/a.txt", "hello world"},
+	} {
+		if data, err := download(expected.b, expected.name, 0, 0); err != nil || data != expected.content {
+			t.Errorf("Unexpected content of %s %q %v", expected.name, data, err)
+		}
+	}
+	if _, err := s.Get("y.txt"); !isNotFound(err) {
+		t.Errorf("Object of a container which is not permitted was copied")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+// Calendar boundaries which an expiry can be aligned to
+const (
+	alignDay   = "day"
+	alignWeek  = "week"
+	alignMonth = "month"
+	alignYear  = "year"
+)
+
+// ExpiryRule is the expiry of the uploaded files which match the path
+// pattern, optionally only for a user.
+type ExpiryRule struct {
+	// User of the session, "" for all users
+	User string `toml:"user"`
+	// Pattern of the path from the root of the session, like "tmp/**". "*"
+	// matches within a path element and "**" any number of elements.
+	Path string `toml:"path"`
+	// Lifetime of the files (day), 0 keeps them forever
+	Days int `toml:"days"`
+	// Extends the lifetime to the end of the day, week, month or year in the
+	// time zone of the server, "" to not align it
+	Align string `toml:"align"`
+}
+
+// validate returns an error if the rule is invalid.
+func (e *ExpiryRule) validate() error {
+	if _, err := path.Match(strings.Replace(e.Path, "**", "*", -1), ""); err != nil {
+		return fmt.Errorf("Invalid path '%s' of expiry: %s", e.Path, err)
+	} else if e.Days < 0 {
+		return fmt.Errorf("Invalid days %d of expiry '%s'", e.Days, e.Path)
+	}
+
+	switch e.Align {
+	case "", alignDay, alignWeek, alignMonth, alignYear:
+		return nil
+	}
+	return fmt.Errorf("Invalid align '%s' of expiry '%s', must be day, week, month or year", e.Align, e.Path)
+}
+
+// matches returns true if the rule applies to the file of the user. The name
+// is the path from the root of the session without a leading slash.
+func (e *ExpiryRule) matches(user, name string) bool {
+	if e.User != "" && e.User != user {
+		return false
+	}
+	return matchPath(strings.Split(strings.Trim(e.Path, Delimiter), Delimiter), strings.Split(name, Delimiter))
+}
+
+// deleteAt returns the time when a file uploaded at now expires, or the zero
+// time if it is kept forever.
+func (e *ExpiryRule) deleteAt(now time.Time) time.Time {
+	if e.Days == 0 {
+		return time.Time{}
+	}
+
+	t := now.AddDate(0, 0, e.Days).Local()
+	y, m, d := t.Date()
+	switch e.Align {
+	case alignDay:
+		return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	case alignWeek:
+		// weeks start on Monday
+		return time.Date(y, m, d+7-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	case alignMonth:
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, t.Location())
+	case alignYear:
+		return time.Date(y+1, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
+
+// matchPath matches the path elements with the elements of a pattern. "**"
+// matches any number of elements.
+func matchPath(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchPath(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+		return false
+	}
+	return matchPath(pattern[1:], elems[1:])
+}
+
+// expiryHeaders returns the headers of the expiry of a file uploaded by the
+// user. The first matching rule is applied, swift_expire if none matches.
+func expiryHeaders(c Config, user, name string, now time.Time) schwift.ObjectHeaders {
+	hdr := schwift.NewObjectHeaders()
+	name = strings.TrimPrefix(name, Delimiter)
+	for i := range c.ExpiryRules {
+		rule := &c.ExpiryRules[i]
+		if !rule.matches(user, name) {
+			continue
+		}
+		if rule.Align != "" {
+			if at := rule.deleteAt(now); !at.IsZero() {
+				hdr.ExpiresAt().Set(at)
+			}
+		} else if rule.Days > 0 {
+			hdr.Set("X-Delete-After", strconv.Itoa(rule.Days*24*60*60))
+		}
+		return hdr
+	}
+
+	if c.SwiftExpire > 0 {
+		hdr.Set("X-Delete-After", strconv.Itoa(c.SwiftExpire))
+	}
+	return hdr
+}
+
+// expiryTime returns the time when a file uploaded by the user at now expires,
+// or the zero time if it doesn't expire.
+func expiryTime(c Config, user, name string, now time.Time) time.Time {
+	hdr := expiryHeaders(c, user, name, now)
+	if sec, err := strconv.Atoi(hdr.Get("X-Delete-After")); err == nil {
+		return now.Add(time.Duration(sec) * time.Second)
+	}
+	return hdr.ExpiresAt().Get()
+}
+
+// applyExpiry sets the expiry of a file copied or moved to name by the rules
+// for the destination. Swift keeps the expiry of the source otherwise.
+func (fs *SwiftFS) applyExpiry(s Backend, name string) error {
+	p := name
+	if fs.multi {
+		p = path.Join(s.Container(), name)
+	}
+	return setExpiry(s, name, expiryTime(fs.swift.Config(), fs.user, p, time.Now()))
+}
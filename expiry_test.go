@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+func TestExpiryRuleMatches(t *testing.T) {
+	cases := []struct {
+		rule  ExpiryRule
+		user  string
+		name  string
+		match bool
+	}{
+		{ExpiryRule{Path: "tmp/**"}, "u", "tmp/a.txt", true},
+		{ExpiryRule{Path: "tmp/**"}, "u", "tmp/d/a.txt", true},
+		{ExpiryRule{Path: "tmp/**"}, "u", "tmpx/a.txt", false},
+		{ExpiryRule{Path: "/tmp/*"}, "u", "tmp/a.txt", true},
+		{ExpiryRule{Path: "tmp/*"}, "u", "tmp/d/a.txt", false},
+		{ExpiryRule{Path: "**/*.log"}, "u", "a.log", true},
+		{ExpiryRule{Path: "**/*.log"}, "u", "d/e/a.log", true},
+		{ExpiryRule{Path: "**/*.log"}, "u", "d/e/a.txt", false},
+		{ExpiryRule{Path: "**"}, "u", "a.txt", true},
+		{ExpiryRule{User: "u", Path: "**"}, "u", "a.txt", true},
+		{ExpiryRule{User: "v", Path: "**"}, "u", "a.txt", false},
+	}
+	for _, c := range cases {
+		if actual := c.rule.matches(c.user, c.name); actual != c.match {
+			t.Errorf("%+v %s %s: expected %v, but %v", c.rule, c.user, c.name, c.match, actual)
+		}
+	}
+}
+
+func TestExpiryRuleDeleteAt(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, 1, 10, 15, 30, 0, 0, time.Local)
+	cases := map[string]time.Time{
+		"":         time.Date(2024, 1, 12, 15, 30, 0, 0, time.Local),
+		alignDay:   time.Date(2024, 1, 13, 0, 0, 0, 0, time.Local),
+		alignWeek:  time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local),
+		alignMonth: time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local),
+		alignYear:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local),
+	}
+	for align, expected := range cases {
+		rule := ExpiryRule{Days: 2, Align: align}
+		if actual := rule.deleteAt(now); !actual.Equal(expected) {
+			t.Errorf("%q: expected %v, but %v", align, expected, actual)
+		}
+	}
+
+	// A Sunday is the end of the week.
+	rule := ExpiryRule{Days: 4, Align: alignWeek}
+	if actual := rule.deleteAt(now); !actual.Equal(time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Unexpected end of the week %v", actual)
+	}
+	if actual := (&ExpiryRule{Align: alignMonth}).deleteAt(now); !actual.IsZero() {
+		t.Errorf("Expected no expiry, but %v", actual)
+	}
+}
+
+func TestExpiryHeaders(t *testing.T) {
+	now := time.Date(2024, 1, 10, 15, 30, 0, 0, time.Local)
+	c := Config{
+		SwiftExpire: 3600,
+		ExpiryRules: []ExpiryRule{
+			{User: "partner", Path: "**", Days: 7},
+			{Path: "tmp/**", Days: 1},
+			{Path: "exports/**", Days: 30, Align: alignMonth},
+			{Path: "archive/**"},
+		},
+	}
+
+	if hdr := expiryHeaders(c, "u", "/tmp/a.txt", now); hdr.Get("X-Delete-After") != "86400" {
+		t.Errorf("Unexpected headers of tmp %v", hdr.Headers)
+	}
+	if hdr := expiryHeaders(c, "partner", "/tmp/a.txt", now); hdr.Get("X-Delete-After") != "604800" {
+		t.Errorf("Unexpected headers of the user %v", hdr.Headers)
+	}
+	if hdr := expiryHeaders(c, "u", "/exports/a.txt", now); !hdr.ExpiresAt().Get().Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Unexpected headers of exports %v", hdr.Headers)
+	}
+	if hdr := expiryHeaders(c, "u", "/archive/a.txt", now); len(hdr.Headers) != 0 {
+		t.Errorf("Unexpected headers of archive %v", hdr.Headers)
+	}
+	if hdr := expiryHeaders(c, "u", "/a.txt", now); hdr.Get("X-Delete-After") != "3600" {
+		t.Errorf("Unexpected headers without a rule %v", hdr.Headers)
+	}
+}
+
+func TestExpiryRuleValidate(t *testing.T) {
+	for _, rule := range []ExpiryRule{{Path: "[a"}, {Path: "a", Days: -1}, {Path: "a", Align: "hour"}} {
+		if err := rule.validate(); err == nil {
+			t.Errorf("%+v is valid", rule)
+		}
+	}
+	if err := (&ExpiryRule{Path: "tmp/**", Days: 1, Align: alignDay}).validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpiryUpload(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{
+		SwiftTimeout: 10,
+		ExpiryRules:  []ExpiryRule{{Path: "tmp/**", Days: 1}},
+	})
+
+	client := startFakeSftp(t, s)
+	for _, name := range []string{"/tmp/a.txt", "/a.txt"} {
+		w, err := client.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data"))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hdr, err := s.Get("tmp/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Now().Add(24 * time.Hour)
+	if at := hdr.ExpiresAt().Get(); at.Before(expected.Add(-time.Minute)) || at.After(expected.Add(time.Minute)) {
+		t.Errorf("Unexpected expiry %v", at)
+	}
+	if hdr, err = s.Get("a.txt"); err != nil || hdr.ExpiresAt().Exists() {
+		t.Errorf("Unexpected expiry %v %v", hdr.Headers, err)
+	}
+}
+
+func TestExpiryCopy(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{
+		SwiftTimeout: 10,
+		ExpiryRules:  []ExpiryRule{{Path: "tmp/**", Days: 1}},
+	})
+	upload(t, s, "tmp/a.txt", "data")
+	if err := setExpiry(s, "tmp/a.txt", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, expires bool) {
+		t.Helper()
+		hdr, err := s.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := time.Now().Add(24 * time.Hour)
+		at := hdr.ExpiresAt().Get()
+		if !expires && hdr.ExpiresAt().Exists() {
+			t.Errorf("%s expires at %v", name, at)
+		} else if expires && (at.Before(expected.Add(-time.Minute)) || at.After(expected.Add(time.Minute))) {
+			t.Errorf("%s: unexpected expiry %v", name, at)
+		}
+	}
+
+	// the rules of the destination are applied instead of the expiry of the
+	// source
+	client := startFakeSftp(t, s)
+	if err := client.Link("/tmp/a.txt", "/tmp/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	check("tmp/b.txt", true)
+	if err := client.Rename("/tmp/a.txt", "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	check("a.txt", false)
+	if err := client.Rename("/a.txt", "/tmp/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	check("tmp/a.txt", true)
+
+	fs := NewSwiftFS(s)
+	if err := fs.CopyFile("/tmp/a.txt", "/c.txt", false); err != nil {
+		t.Fatal(err)
+	}
+	check("c.txt", false)
+	if err := fs.CopyFile("/c.txt", "/tmp/c.txt", false); err != nil {
+		t.Fatal(err)
+	}
+	check("tmp/c.txt", true)
+
+	wa, err := fs.Filewrite(sftp.NewRequest("Put", "/d.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.CopyData("/tmp/a.txt", 0, 0, "/d.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = wa.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	check("d.txt", false)
+}
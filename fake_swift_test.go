@@ -0,0 +1,769 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	fakeSwiftAccount = "AUTH_test"
+	fakeSwiftToken   = "fake-token"
+)
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	etag        string
+	modified    time.Time
+	headers     http.Header // X-Object-Meta-*, X-Delete-At, Content-Encoding, ...
+	slo         []fakeSegment
+	dlo         string
+}
+
+type fakeSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes uint64 `json:"size_bytes"`
+}
+
+type fakeContainer struct {
+	headers http.Header
+	objects map[string]*fakeObject
+}
+
+// fakeSwift is an in-memory Swift and Keystone v3 server for testing.
+type fakeSwift struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	account    http.Header
+	containers map[string]*fakeContainer
+
+	// Fail is called for every request to Swift. If it returns a status code
+	// other than 0, the request fails with it.
+	Fail func(r *http.Request) int
+}
+
+func newFakeSwift() *fakeSwift {
+	f := &fakeSwift{
+		account:    http.Header{},
+		containers: map[string]*fakeContainer{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeSwift) StorageURL() string {
+	return f.URL + "/v1/" + fakeSwiftAccount + "/"
+}
+
+func (f *fakeSwift) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v3/auth/tokens" && r.Method == "POST":
+		f.keystoneToken(w, r)
+		return
+	case r.URL.Path == "/auth/v1.0":
+		if r.Header.Get("X-Auth-User") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Auth-Token", fakeSwiftToken)
+		w.Header().Set("X-Storage-Url", f.URL+"/v1/"+fakeSwiftAccount)
+		w.WriteHeader(http.StatusOK)
+		return
+	case r.URL.Path == "/info":
+		fmt.Fprint(w, `{"swift":{"max_file_size":5368709122},"slo":{},"bulk_delete":{"max_deletes_per_request":10000,"max_failed_deletes":1000}}`)
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != fakeSwiftToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if f.Fail != nil {
+		if code := f.Fail(r); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/"), "/", 3)
+	if parts[0] != fakeSwiftAccount {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch len(parts) {
+	case 1:
+		f.serveAccount(w, r)
+	case 2:
+		if parts[1] == "" {
+			f.serveAccount(w, r)
+		} else {
+			f.serveContainer(w, r, parts[1])
+		}
+	default:
+		if parts[2] == "" {
+			f.serveContainer(w, r, parts[1])
+		} else {
+			f.serveObject(w, r, parts[1], parts[2])
+		}
+	}
+}
+
+func (f *fakeSwift) keystoneToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string
+				Password struct {
+					User struct {
+						Name     string
+						Password string
+					}
+				}
+				ApplicationCredential struct {
+					ID     string
+					Secret string
+				} `json:"application_credential"`
+				Token struct {
+					ID string
+				}
+			}
+		}
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	id := body.Auth.Identity
+	if !(id.Password.User.Password == "secret" || id.ApplicationCredential.Secret == "secret" || id.Token.ID == fakeSwiftToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("X-Subject-Token", fakeSwiftToken)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"token":{"expires_at":"%s","catalog":[{"type":"object-store","name":"swift","endpoints":[
+		{"interface":"public","region":"RegionOne","region_id":"RegionOne","url":"%s"},
+		{"interface":"internal","region":"RegionOne","region_id":"RegionOne","url":"%s"}]}]}}`,
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339), f.URL+"/v1/"+fakeSwiftAccount, f.URL+"/v1/"+fakeSwiftAccount)
+}
+
+func (f *fakeSwift) serveAccount(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "HEAD", "GET":
+		var used, count uint64
+		for _, c := range f.containers {
+			for _, o := range c.objects {
+				used += uint64(len(o.data))
+				count++
+			}
+		}
+		copyHeader(w.Header(), f.account)
+		w.Header().Set("X-Account-Bytes-Used", strconv.FormatUint(used, 10))
+		w.Header().Set("X-Account-Object-Count", strconv.FormatUint(count, 10))
+		w.Header().Set("X-Account-Container-Count", strconv.Itoa(len(f.containers)))
+		if _, ok := r.URL.Query()["bulk-delete"]; ok {
+			break
+		}
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		names := make([]string, 0, len(f.containers))
+		for name := range f.containers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		type entry struct {
+			Name         string `json:"name"`
+			Count        int    `json:"count"`
+			Bytes        uint64 `json:"bytes"`
+			LastModified string `json:"last_modified"`
+		}
+		list := []entry{}
+		for _, name := range filterNames(names, r.URL.Query()) {
+			var bytes uint64
+			var modified time.Time
+			for _, o := range f.containers[name].objects {
+				bytes += uint64(len(o.data))
+				if o.modified.After(modified) {
+					modified = o.modified
+				}
+			}
+			list = append(list, entry{name, len(f.containers[name].objects), bytes,
+				modified.UTC().Format("2006-01-02T15:04:05.000000")})
+		}
+		writeList(w, r, list, names)
+	case "POST", "DELETE":
+		if _, ok := r.URL.Query()["bulk-delete"]; ok {
+			f.bulkDelete(w, r)
+			return
+		} else if r.Method == "DELETE" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		copyMeta(f.account, r.Header, "X-Account-Meta-")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeSwift) bulkDelete(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	deleted := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		line, _ = url.PathUnescape(strings.TrimSpace(line))
+		parts := strings.SplitN(strings.TrimPrefix(line, "/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if c, ok := f.containers[parts[0]]; ok {
+			if _, ok := c.objects[parts[1]]; ok {
+				delete(c.objects, parts[1])
+				deleted++
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"Number Deleted":%d,"Number Not Found":0,"Response Status":"200 OK","Errors":[]}`, deleted)
+}
+
+func (f *fakeSwift) serveContainer(w http.ResponseWriter, r *http.Request, name string) {
+	c, exists := f.containers[name]
+
+	switch r.Method {
+	case "PUT":
+		if !exists {
+			c = &fakeContainer{headers: http.Header{}, objects: map[string]*fakeObject{}}
+			f.containers[name] = c
+		}
+		copyMeta(c.headers, r.Header, "X-Container-Meta-", "X-Versions-Enabled", "X-History-Location", "X-Versions-Location")
+		if exists {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		return
+	}
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD", "GET":
+		var used uint64
+		for _, o := range c.objects {
+			used += uint64(len(o.data))
+		}
+		copyHeader(w.Header(), c.headers)
+		w.Header().Set("X-Container-Bytes-Used", strconv.FormatUint(used, 10))
+		w.Header().Set("X-Container-Object-Count", strconv.Itoa(len(c.objects)))
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f.listObjects(w, r, c)
+	case "POST":
+		copyMeta(c.headers, r.Header, "X-Container-Meta-", "X-Versions-Enabled", "X-History-Location", "X-Versions-Location")
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if len(c.objects) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		delete(f.containers, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeSwift) listObjects(w http.ResponseWriter, r *http.Request, c *fakeContainer) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+
+	names := make([]string, 0, len(c.objects))
+	for name := range c.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// condense into pseudo directories
+	type entry struct {
+		Name         string `json:"name,omitempty"`
+		Hash         string `json:"hash,omitempty"`
+		Bytes        uint64 `json:"bytes"`
+		ContentType  string `json:"content_type,omitempty"`
+		LastModified string `json:"last_modified,omitempty"`
+		Subdir       string `json:"subdir,omitempty"`
+	}
+	keys := []string{}
+	entries := map[string]entry{}
+	for _, name := range names {
+		if delimiter != "" {
+			if pos := strings.Index(name[len(prefix):], delimiter); pos >= 0 {
+				subdir := name[:len(prefix)+pos+len(delimiter)]
+				if _, ok := entries[subdir]; !ok {
+					keys = append(keys, subdir)
+					entries[subdir] = entry{Subdir: subdir}
+				}
+				continue
+			}
+		}
+		o := c.objects[name]
+		keys = append(keys, name)
+		entries[name] = entry{
+			Name:         name,
+			Hash:         o.etag,
+			Bytes:        f.objectSize(o),
+			ContentType:  o.contentType,
+			LastModified: o.modified.UTC().Format("2006-01-02T15:04:05.000000"),
+		}
+	}
+
+	keys = filterNames(keys, q)
+	list := make([]entry, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, entries[k])
+	}
+	writeList(w, r, list, keys)
+}
+
+func filterNames(names []string, q url.Values) []string {
+	result := []string{}
+	marker := q.Get("marker")
+	endMarker := q.Get("end_marker")
+	for _, name := range names {
+		if marker != "" && name <= marker {
+			continue
+		}
+		if endMarker != "" && name >= endMarker {
+			continue
+		}
+		if p := q.Get("prefix"); p != "" && !strings.HasPrefix(name, p) {
+			continue
+		}
+		result = append(result, name)
+	}
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit >= 0 && limit < len(result) {
+		result = result[:limit]
+	}
+	if q.Get("reverse") == "true" {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+	return result
+}
+
+func writeList(w http.ResponseWriter, r *http.Request, list interface{}, names []string) {
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	if len(names) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
+
+func (f *fakeSwift) lookupObject(container, name string) *fakeObject {
+	c, ok := f.containers[container]
+	if !ok {
+		return nil
+	}
+	o := c.objects[name]
+	if o != nil {
+		if at := o.headers.Get("X-Delete-At"); at != "" {
+			if t, err := strconv.ParseInt(at, 10, 64); err == nil && time.Now().Unix() >= t {
+				delete(c.objects, name)
+				return nil
+			}
+		}
+	}
+	return o
+}
+
+// content returns the content of the object including large objects.
+func (f *fakeSwift) content(o *fakeObject) []byte {
+	if o.slo != nil {
+		var buf bytes.Buffer
+		for _, s := range o.slo {
+			parts := strings.SplitN(strings.TrimPrefix(s.Path, "/"), "/", 2)
+			if seg := f.lookupObject(parts[0], parts[1]); seg != nil {
+				buf.Write(seg.data)
+			}
+		}
+		return buf.Bytes()
+	}
+	if o.dlo != "" {
+		parts := strings.SplitN(o.dlo, "/", 2)
+		c, ok := f.containers[parts[0]]
+		if !ok {
+			return nil
+		}
+		names := []string{}
+		for name := range c.objects {
+			if strings.HasPrefix(name, parts[1]) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		var buf bytes.Buffer
+		for _, name := range names {
+			buf.Write(c.objects[name].data)
+		}
+		return buf.Bytes()
+	}
+	return o.data
+}
+
+func (f *fakeSwift) objectSize(o *fakeObject) uint64 {
+	if o.slo != nil {
+		var size uint64
+		for _, s := range o.slo {
+			size += s.SizeBytes
+		}
+		return size
+	}
+	return uint64(len(f.content(o)))
+}
+
+func (f *fakeSwift) serveObject(w http.ResponseWriter, r *http.Request, container, name string) {
+	c, ok := f.containers[container]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+
+	switch r.Method {
+	case "PUT":
+		if src := r.Header.Get("X-Copy-From"); src != "" {
+			parts := strings.SplitN(strings.TrimPrefix(src, "/"), "/", 2)
+			f.copyObject(w, r, parts[0], parts[1], container, name)
+			return
+		}
+
+		data, _ := ioutil.ReadAll(r.Body)
+		o := &fakeObject{
+			contentType: r.Header.Get("Content-Type"),
+			modified:    time.Now(),
+			headers:     http.Header{},
+		}
+		if q.Get("multipart-manifest") == "put" {
+			if err := json.Unmarshal(data, &o.slo); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			h := md5.New()
+			for _, s := range o.slo {
+				h.Write([]byte(s.Etag))
+			}
+			o.etag = hex.EncodeToString(h.Sum(nil))
+			o.data = data
+		} else {
+			sum := md5.Sum(data)
+			o.etag = hex.EncodeToString(sum[:])
+			if etag := r.Header.Get("Etag"); etag != "" && strings.Trim(etag, `"`) != o.etag {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+			o.data = data
+			o.dlo = r.Header.Get("X-Object-Manifest")
+		}
+		if o.contentType == "" {
+			o.contentType = "application/octet-stream"
+		}
+		f.setObjectHeaders(o, r.Header)
+		f.archiveVersion(c, container, name)
+		c.objects[name] = o
+		w.Header().Set("Etag", o.etag)
+		w.WriteHeader(http.StatusCreated)
+		return
+
+	case "COPY":
+		dest := strings.SplitN(strings.TrimPrefix(r.Header.Get("Destination"), "/"), "/", 2)
+		if len(dest) != 2 {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if _, ok := f.containers[dest[0]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.copyObject(w, r, container, name, dest[0], dest[1])
+		return
+	}
+
+	o := f.lookupObject(container, name)
+	if o == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// follow symlinks
+	if target := o.headers.Get("X-Symlink-Target"); target != "" && q.Get("symlink") != "get" && (r.Method == "HEAD" || r.Method == "GET") {
+		parts := strings.SplitN(target, "/", 2)
+		if o = f.lookupObject(parts[0], parts[1]); o == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "HEAD", "GET":
+		copyHeader(w.Header(), o.headers)
+		w.Header().Set("Content-Type", o.contentType)
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Timestamp", fmt.Sprintf("%d.%05d", o.modified.Unix(), o.modified.Nanosecond()/10000))
+		if o.slo != nil {
+			w.Header().Set("X-Static-Large-Object", "True")
+			w.Header().Set("Etag", `"`+o.etag+`"`)
+		} else {
+			w.Header().Set("Etag", o.etag)
+		}
+		if o.dlo != "" {
+			w.Header().Set("X-Object-Manifest", o.dlo)
+		}
+
+		content := f.content(o)
+		if q.Get("multipart-manifest") == "get" && o.slo != nil {
+			content = o.data
+		}
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" && strings.HasPrefix(rng, "bytes=") {
+			var first, last int64 = 0, int64(len(content)) - 1
+			spec := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+			if spec[0] == "" {
+				n, _ := strconv.ParseInt(spec[1], 10, 64)
+				first = int64(len(content)) - n
+			} else {
+				first, _ = strconv.ParseInt(spec[0], 10, 64)
+				if spec[1] != "" {
+					last, _ = strconv.ParseInt(spec[1], 10, 64)
+				}
+			}
+			if last >= int64(len(content)) {
+				last = int64(len(content)) - 1
+			}
+			if first < 0 || first > last {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(content)))
+			content = content[first : last+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+
+	case "POST":
+		for k := range o.headers {
+			if strings.HasPrefix(k, "X-Object-Meta-") {
+				o.headers.Del(k)
+			}
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			o.contentType = ct
+		}
+		f.setObjectHeaders(o, r.Header)
+		w.WriteHeader(http.StatusAccepted)
+
+	case "DELETE":
+		f.archiveVersion(c, container, name)
+		f.markDeleted(c, name)
+		delete(c.objects, name)
+		if q.Get("multipart-manifest") == "delete" {
+			for _, s := range o.slo {
+				parts := strings.SplitN(strings.TrimPrefix(s.Path, "/"), "/", 2)
+				if sc, ok := f.containers[parts[0]]; ok {
+					delete(sc.objects, parts[1])
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeSwift) setObjectHeaders(o *fakeObject, h http.Header) {
+	copyMeta(o.headers, h, "X-Object-Meta-", "Content-Encoding", "Content-Disposition", "X-Delete-At", "X-Symlink-Target")
+	if after := h.Get("X-Delete-After"); after != "" {
+		if n, err := strconv.ParseInt(after, 10, 64); err == nil {
+			o.headers.Set("X-Delete-At", strconv.FormatInt(time.Now().Unix()+n, 10))
+		}
+	}
+}
+
+func (f *fakeSwift) copyObject(w http.ResponseWriter, r *http.Request, srcContainer, srcName, dstContainer, dstName string) {
+	src := f.lookupObject(srcContainer, srcName)
+	dst, ok := f.containers[dstContainer]
+	if src == nil || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data := f.content(src)
+	sum := md5.Sum(data)
+	o := &fakeObject{
+		data:        data,
+		contentType: src.contentType,
+		etag:        hex.EncodeToString(sum[:]),
+		modified:    time.Now(),
+		headers:     http.Header{},
+	}
+	if r.URL.Query().Get("multipart-manifest") == "get" && (src.slo != nil || src.dlo != "") {
+		// copy the manifest itself
+		o.data, o.etag, o.slo, o.dlo = src.data, src.etag, src.slo, src.dlo
+	}
+	if r.Header.Get("X-Fresh-Metadata") != "true" {
+		// X-Delete-At is copied like the metadata.
+		copyHeader(o.headers, src.headers)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		o.contentType = ct
+	}
+	f.setObjectHeaders(o, r.Header)
+	f.archiveVersion(dst, dstContainer, dstName)
+	dst.objects[dstName] = o
+	w.Header().Set("Etag", o.etag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// archiveVersion keeps the current version of an object if the container has
+// X-History-Location set.
+func (f *fakeSwift) archiveVersion(c *fakeContainer, container, name string) {
+	location := c.headers.Get("X-History-Location")
+	if location == "" {
+		return
+	}
+	old, ok := c.objects[name]
+	hc, hok := f.containers[location]
+	if !ok || !hok {
+		return
+	}
+	versioned := fmt.Sprintf("%03x%s/%d.%05d", len(name), name, old.modified.Unix(), old.modified.Nanosecond()/10000)
+	hc.objects[versioned] = old
+}
+
+// markDeleted adds a marker of the deletion of an object to the history
+// container, like Swift does.
+func (f *fakeSwift) markDeleted(c *fakeContainer, name string) {
+	hc, ok := f.containers[c.headers.Get("X-History-Location")]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	marker := fmt.Sprintf("%03x%s/%d.%05d", len(name), name, now.Unix(), now.Nanosecond()/10000)
+	hc.objects[marker] = &fakeObject{
+		contentType: "application/x-deleted;swift_versions_deleted=1",
+		etag:        fmt.Sprintf("%x", md5.Sum(nil)),
+		modified:    now,
+		headers:     http.Header{},
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+func copyMeta(dst, src http.Header, prefixes ...string) {
+	for k, v := range src {
+		for _, p := range prefixes {
+			if strings.HasPrefix(k, p) {
+				if len(v) == 0 || v[0] == "" {
+					dst.Del(k)
+				} else {
+					dst[k] = append([]string(nil), v...)
+				}
+			}
+		}
+	}
+}
+
+// fakeSwiftClient returns a client of the container of the fake server. The
+// container is created.
+func fakeSwiftClient(f *fakeSwift, container string) *Swift {
+	return fakeSwiftClientWith(f, container, Config{SwiftTimeout: 10})
+}
+
+// fakeSwiftClientWith is fakeSwiftClient with a configuration. The static
+// authentication is used with the token of the fake server.
+func fakeSwiftClientWith(f *fakeSwift, container string, conf Config) *Swift {
+	conf.AuthType = authTypeStatic
+	conf.OsSwiftURL = f.StorageURL()
+	conf.OsToken = fakeSwiftToken
+
+	s := NewSwift(conf)
+	if err := s.Init(); err != nil {
+		panic(err)
+	}
+	s.setContainer(container)
+	if err := s.CreateContainer(); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// startFakeSftp serves an SFTP session on the backend and returns a client
+// connected to it.
+func startFakeSftp(t *testing.T, b Backend) *sftp.Client {
+	return startFakeSftpSession(t, NewSwiftFS(b))
+}
+
+// startFakeSftpSession is startFakeSftp with a SwiftFS set up by the test.
+func startFakeSftpSession(t *testing.T, fs *SwiftFS) *sftp.Client {
+	c1, c2 := net.Pipe()
+	handler := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+	server := sftp.NewRequestServer(newExtensionChannel(c2, fs, log), handler)
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(c1, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
@@ -15,4 +15,5 @@ require (
 	golang.org/x/crypto v0.0.0-20210317152858-513c2a44f670
 	golang.org/x/sys v0.0.0-20210319071255-635bc2c9138d // indirect
 	golang.org/x/term v0.0.0-20210317153231-de623e64d2a6 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/majewsky/schwift"
+)
+
+// Directory under the local directory for the metadata of the objects and for
+// files being uploaded. It is not a container.
+const localMetaDir = ".swift-sftp"
+
+// LocalBackend stores the containers as directories of a local directory,
+// for development without Swift. Objects are files and directories are
+// directories. The metadata of an object is stored in a JSON file under
+// localMetaDir.
+type LocalBackend struct {
+	config    Config
+	root      string
+	container string
+}
+
+func NewLocalBackend(c Config) *LocalBackend {
+	return &LocalBackend{
+		config: c,
+		root:   c.LocalDir,
+	}
+}
+
+func (l *LocalBackend) Init() error {
+	if l.root == "" {
+		return fmt.Errorf("local_dir is required for the local backend")
+	}
+	return os.MkdirAll(filepath.Join(l.root, localMetaDir, "tmp"), 0755)
+}
+
+func (l *LocalBackend) Config() Config {
+	return l.config
+}
+
+func (l *LocalBackend) Container() string {
+	return l.container
+}
+
+func (l *LocalBackend) WithContainer(container string) Backend {
+	c := *l
+	c.container = container
+	return &c
+}
+
+func (l *LocalBackend) EndpointURL() string {
+	return "file://" + filepath.ToSlash(l.root) + "/"
+}
+
+func (l *LocalBackend) AccountName() string {
+	return filepath.Base(l.root)
+}
+
+// validLocalContainer reports whether the container is a directory directly
+// under the local directory.
+func validLocalContainer(container string) bool {
+	return container != "" && container != "." && container != ".." &&
+		container != localMetaDir && !strings.ContainsAny(container, `/\`)
+}
+
+// containerPath returns the directory of the container.
+func (l *LocalBackend) containerPath() (string, error) {
+	if !validLocalContainer(l.container) {
+		return "", fmt.Errorf("Invalid container name '%s'", l.container)
+	}
+	return filepath.Join(l.root, l.container), nil
+}
+
+// path returns the path of the object. Names can't point outside of the
+// container.
+func (l *LocalBackend) path(name string) (string, error) {
+	dir, err := l.containerPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name))), nil
+}
+
+// metaPath returns the path of the metadata of the object.
+func (l *LocalBackend) metaPath(name string) (string, error) {
+	if _, err := l.containerPath(); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, localMetaDir, "meta", l.container, filepath.FromSlash(path.Clean("/"+name))+".json"), nil
+}
+
+func (l *LocalBackend) ListContainers() ([]*SwiftFile, error) {
+	infos, err := ioutil.ReadDir(l.root)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*SwiftFile, 0, len(infos))
+	for _, fi := range infos {
+		if fi.IsDir() && fi.Name() != localMetaDir {
+			list = append(list, &SwiftFile{
+				name:    fi.Name() + Delimiter,
+				modtime: fi.ModTime(),
+			})
+		}
+	}
+	return list, nil
+}
+
+func (l *LocalBackend) ExistsContainer() (bool, error) {
+	dir, err := l.containerPath()
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+func (l *LocalBackend) CreateContainer() error {
+	dir, err := l.containerPath()
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// Usage returns the bytes of the files in the container, or in all
+// containers for the account. There is no quota.
+func (l *LocalBackend) Usage() (used uint64, quota uint64, err error) {
+	meta := filepath.Join(l.root, localMetaDir)
+	dir := l.root
+	if l.container != "" {
+		if dir, err = l.containerPath(); err != nil {
+			return 0, 0, err
+		}
+	}
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if p == meta {
+			return filepath.SkipDir
+		} else if fi.Mode().IsRegular() {
+			used += uint64(fi.Size())
+		}
+		return nil
+	})
+	return used, 0, err
+}
+
+func (l *LocalBackend) ListDirectory(dir string) DirectoryLister {
+	prefix := dir
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &sliceLister{list: func() ([]*SwiftFile, error) {
+		return l.list(prefix)
+	}}
+}
+
+// list returns the entries of the directory of the prefix.
+func (l *LocalBackend) list(prefix string) ([]*SwiftFile, error) {
+	p, err := l.path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(p)
+	if os.IsNotExist(err) {
+		// Swift lists nothing for a directory which doesn't exist.
+		if _, err := os.Stat(filepath.Join(l.root, l.container)); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := make([]*SwiftFile, 0, len(infos))
+	for _, fi := range infos {
+		f := &SwiftFile{
+			name:    Delimiter + prefix + fi.Name(),
+			size:    fi.Size(),
+			modtime: fi.ModTime(),
+		}
+		if fi.IsDir() {
+			f.name += Delimiter
+			f.size = 0
+		} else if hdr, err := l.readMeta(prefix + fi.Name()); err == nil {
+			f.contentType = hdr.ContentType().Get()
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	return files, nil
+}
+
+// FirstInDirectory returns the directory itself if it exists.
+func (l *LocalBackend) FirstInDirectory(dir string) (*SwiftFile, error) {
+	p, err := l.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &SwiftFile{
+		name:    Delimiter + strings.TrimSuffix(dir, "/") + Delimiter,
+		modtime: fi.ModTime(),
+	}, nil
+}
+
+// Get returns the headers of the object. A directory is returned as a marker
+// object.
+func (l *LocalBackend) Get(name string) (schwift.ObjectHeaders, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return schwift.ObjectHeaders{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return schwift.ObjectHeaders{}, err
+	}
+
+	if fi.IsDir() {
+		hdr := schwift.NewObjectHeaders()
+		hdr.ContentType().Set(directoryContentType)
+		return objectHeaders(hdr, 0, fi.ModTime()), nil
+	} else if strings.HasSuffix(name, "/") {
+		return schwift.ObjectHeaders{}, os.ErrNotExist
+	}
+
+	stored, err := l.readMeta(name)
+	if err != nil {
+		return schwift.ObjectHeaders{}, err
+	} else if isExpired(stored) {
+		return schwift.ObjectHeaders{}, os.ErrNotExist
+	}
+	return objectHeaders(stored, fi.Size(), fi.ModTime()), nil
+}
+
+// GetLink is the same as Get because symlinks are not supported.
+func (l *LocalBackend) GetLink(name string) (schwift.ObjectHeaders, string, error) {
+	hdr, err := l.Get(name)
+	return hdr, "", err
+}
+
+// readMeta returns the stored headers of the object.
+func (l *LocalBackend) readMeta(name string) (schwift.ObjectHeaders, error) {
+	hdr := schwift.NewObjectHeaders()
+	p, err := l.metaPath(name)
+	if err != nil {
+		return hdr, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		// a file which was not uploaded through the backend
+		return storedHeaders(hdr), nil
+	} else if err != nil {
+		return hdr, err
+	}
+	return hdr, json.Unmarshal(data, &hdr.Headers)
+}
+
+func (l *LocalBackend) writeMeta(name string, hdr schwift.ObjectHeaders) error {
+	data, err := json.Marshal(hdr.Headers)
+	if err != nil {
+		return err
+	}
+	p, err := l.metaPath(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+// open opens the file of the object for reading.
+func (l *LocalBackend) open(name string) (*os.File, int64, error) {
+	if _, err := l.Get(name); err != nil {
+		return nil, 0, err
+	}
+	p, err := l.path(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	} else if fi.IsDir() {
+		f.Close()
+		return nil, 0, os.ErrNotExist
+	}
+	return f, fi.Size(), nil
+}
+
+func (l *LocalBackend) Download(name string) (io.ReadCloser, int64, error) {
+	return l.open(name)
+}
+
+func (l *LocalBackend) DownloadRange(name string, offset, length int64) (io.ReadCloser, error) {
+	f, size, err := l.open(name)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 || offset+length > size {
+		length = size - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+// Upload writes the content to a temporary file and renames it to the
+// object. A directory marker creates the directory.
+func (l *LocalBackend) Upload(name string, content io.Reader, hdr schwift.ObjectHeaders) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	} else if strings.HasSuffix(name, "/") || isDirectoryMarker(hdr) {
+		return os.MkdirAll(p, 0755)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(l.root, localMetaDir, "tmp"), "upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	v := newVerifyingReader(content)
+	_, err = io.Copy(tmp, v)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	sum, err := v.verify(hdr)
+	if err != nil {
+		return err
+	}
+
+	stored := storedHeaders(hdr)
+	stored.Etag().Set(sum)
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	return l.writeMeta(name, stored)
+}
+
+func (l *LocalBackend) SetMetadata(name string, hdr schwift.ObjectHeaders) error {
+	if _, err := l.Get(name); err != nil {
+		return err
+	}
+	stored, err := l.readMeta(name)
+	if err != nil {
+		return err
+	}
+	return l.writeMeta(name, updateHeaders(stored, hdr))
+}
+
+// Delete removes the file of the object, or the directory if it is empty.
+func (l *LocalBackend) Delete(name string) error {
+	if _, err := l.Get(name); err != nil {
+		return err
+	}
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	} else if err = os.Remove(p); err != nil {
+		return err
+	}
+	if p, err = l.metaPath(name); err != nil {
+		return err
+	} else if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteWithSegments is the same as Delete because there are no large
+// objects.
+func (l *LocalBackend) DeleteWithSegments(name string) error {
+	return l.Delete(name)
+}
+
+func (l *LocalBackend) CopyTo(srcName string, dest Backend, destName string, hdr schwift.ObjectHeaders) error {
+	return copyObject(l, srcName, dest, destName, hdr)
+}
+
+// MoveTo renames the file if dest is a local backend too.
+func (l *LocalBackend) MoveTo(srcName string, dest Backend, destName string) error {
+	d, ok := dest.(*LocalBackend)
+	if !ok || d.root != l.root {
+		if err := l.CopyTo(srcName, dest, destName, schwift.NewObjectHeaders()); err != nil {
+			return err
+		}
+		return l.Delete(srcName)
+	}
+
+	if _, err := l.Get(srcName); err != nil {
+		return err
+	}
+	stored, err := l.readMeta(srcName)
+	if err != nil {
+		return err
+	}
+	src, err := l.path(srcName)
+	if err != nil {
+		return err
+	}
+	p, err := d.path(destName)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err = os.Rename(src, p); err != nil {
+		return err
+	}
+	if err = d.writeMeta(destName, stored); err != nil {
+		return err
+	}
+	if p, err = l.metaPath(srcName); err != nil {
+		return err
+	} else if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
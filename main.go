@@ -38,6 +38,10 @@ func main() {
 					Name:  "create-container",
 					Usage: "Create container if not exist",
 				},
+				cli.BoolFlag{
+					Name:  "multi-container",
+					Usage: "List the containers of the account as top-level directories",
+				},
 				cli.StringFlag{
 					Name:  "config-file,f",
 					Usage: "Set configuration file",
@@ -73,6 +77,109 @@ func main() {
 					Usage: "Set experation for uploaded objects",
 					Value: 0,
 				},
+				cli.IntFlag{
+					Name:  "retry-max",
+					Usage: "Set number of retries of failed Swift requests. -1 disables retries",
+					Value: 5,
+				},
+				cli.IntFlag{
+					Name:  "retry-wait",
+					Usage: "Set wait before the first retry (msec)",
+					Value: 500,
+				},
+				cli.IntFlag{
+					Name:  "retry-max-wait",
+					Usage: "Set maximum wait between retries (sec)",
+					Value: 30,
+				},
+				cli.StringFlag{
+					Name:  "encryption-key-file",
+					Usage: "Set file of the master key to encrypt uploaded files",
+					Value: "",
+				},
+				cli.IntFlag{
+					Name:  "circuit-threshold",
+					Usage: "Suspend Swift requests after this number of consecutive failures. -1 never suspends",
+					Value: 10,
+				},
+				cli.IntFlag{
+					Name:  "circuit-timeout",
+					Usage: "Set time to suspend Swift requests (sec)",
+					Value: 30,
+				},
+				cli.BoolFlag{
+					Name:  "atomic-upload",
+					Usage: "Publish uploaded files only when they are complete",
+				},
+				cli.IntFlag{
+					Name:  "segment-size",
+					Usage: "Set segment size of large objects (MB). 0 uploads files as a whole",
+					Value: 0,
+				},
+				cli.BoolFlag{
+					Name:  "checksum-sha256",
+					Usage: "Store SHA-256 of uploaded files in the object metadata",
+				},
+				cli.StringFlag{
+					Name:  "partial-suffixes",
+					Usage: "Set suffixes of files being uploaded (comma-separated, e.g. .part,.filepart)",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "tmp-dir",
+					Usage: "Set directory for temporary files",
+					Value: "",
+				},
+				cli.IntFlag{
+					Name:  "tmp-max-size",
+					Usage: "Set total size of temporary files (MB). 0 is unlimited",
+					Value: 0,
+				},
+				cli.IntFlag{
+					Name:  "tmp-wait",
+					Usage: "Set time to wait for temporary space before a transfer fails (sec)",
+					Value: 0,
+				},
+				cli.IntFlag{
+					Name:  "cache-ttl",
+					Usage: "Set lifetime of cached metadata (sec). 0 disables the cache",
+					Value: 0,
+				},
+				cli.BoolFlag{
+					Name:  "shared-cache",
+					Usage: "Share the metadata cache between sessions",
+				},
+				cli.BoolFlag{
+					Name:  "versioning",
+					Usage: "Enable versioning on created containers",
+				},
+				cli.BoolFlag{
+					Name:  "show-versions",
+					Usage: "Expose prior versions of files in .versions directories",
+				},
+				cli.BoolFlag{
+					Name:  "show-metadata",
+					Usage: "Send headers of files as extended attributes of stat",
+				},
+				cli.BoolFlag{
+					Name:  "trash",
+					Usage: "Move removed files to .trash directories instead of deleting them",
+				},
+				cli.IntFlag{
+					Name:  "trash-days",
+					Usage: "Set lifetime of files in the trash (day). -1 keeps them until removed",
+					Value: 30,
+				},
+				cli.StringFlag{
+					Name:  "backend",
+					Usage: "Set storage backend: swift, local or memory",
+					Value: "swift",
+				},
+				cli.StringFlag{
+					Name:  "local-dir",
+					Usage: "Set directory of the local backend",
+					Value: "",
+				},
 			},
 
 			HideHelp: true,
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+// MemoryBackend keeps the containers in memory until the server stops. The
+// copies returned by WithContainer share the containers.
+type MemoryBackend struct {
+	config    Config
+	container string
+	store     *memoryStore
+}
+
+type memoryStore struct {
+	lock       sync.Mutex
+	containers map[string]*memoryContainer
+}
+
+type memoryContainer struct {
+	created time.Time
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	hdr     schwift.ObjectHeaders // stored headers
+	modtime time.Time
+}
+
+func NewMemoryBackend(c Config) *MemoryBackend {
+	return &MemoryBackend{
+		config: c,
+		store:  &memoryStore{containers: map[string]*memoryContainer{}},
+	}
+}
+
+func (m *MemoryBackend) Init() error {
+	return nil
+}
+
+func (m *MemoryBackend) Config() Config {
+	return m.config
+}
+
+func (m *MemoryBackend) Container() string {
+	return m.container
+}
+
+func (m *MemoryBackend) WithContainer(container string) Backend {
+	c := *m
+	c.container = container
+	return &c
+}
+
+func (m *MemoryBackend) EndpointURL() string {
+	return "memory:///"
+}
+
+func (m *MemoryBackend) AccountName() string {
+	return "memory"
+}
+
+// objects returns the objects of the container. The store must be locked.
+func (m *MemoryBackend) objects() (map[string]*memoryObject, error) {
+	c, ok := m.store.containers[m.container]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return c.objects, nil
+}
+
+// object returns the object unless it is expired. The store must be locked.
+func (m *MemoryBackend) object(name string) (*memoryObject, error) {
+	objects, err := m.objects()
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := objects[name]
+	if !ok || isExpired(obj.hdr) {
+		return nil, os.ErrNotExist
+	}
+	return obj, nil
+}
+
+func (m *MemoryBackend) ListContainers() ([]*SwiftFile, error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	list := make([]*SwiftFile, 0, len(m.store.containers))
+	for name, c := range m.store.containers {
+		list = append(list, &SwiftFile{
+			name:    name + Delimiter,
+			modtime: c.created,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list, nil
+}
+
+func (m *MemoryBackend) ExistsContainer() (bool, error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	_, ok := m.store.containers[m.container]
+	return ok, nil
+}
+
+func (m *MemoryBackend) CreateContainer() error {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	if _, ok := m.store.containers[m.container]; !ok {
+		m.store.containers[m.container] = &memoryContainer{
+			created: time.Now(),
+			objects: map[string]*memoryObject{},
+		}
+	}
+	return nil
+}
+
+// Usage returns the bytes of the container, or of all containers for the
+// account. There is no quota.
+func (m *MemoryBackend) Usage() (used uint64, quota uint64, err error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	for name, c := range m.store.containers {
+		if m.container != "" && name != m.container {
+			continue
+		}
+		for _, obj := range c.objects {
+			used += uint64(len(obj.data))
+		}
+	}
+	return used, 0, nil
+}
+
+func (m *MemoryBackend) ListDirectory(path string) DirectoryLister {
+	prefix := path
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &sliceLister{list: func() ([]*SwiftFile, error) {
+		return m.list(prefix)
+	}}
+}
+
+// list returns the entries under the prefix with the delimiter "/".
+func (m *MemoryBackend) list(prefix string) ([]*SwiftFile, error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	objects, err := m.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]*SwiftFile{}
+	for name, obj := range objects {
+		if !strings.HasPrefix(name, prefix) || name == prefix || isExpired(obj.hdr) {
+			continue
+		}
+
+		f := &SwiftFile{
+			name:        Delimiter + name,
+			size:        int64(len(obj.data)),
+			modtime:     obj.modtime,
+			contentType: obj.hdr.ContentType().Get(),
+		}
+		if pos := strings.Index(name[len(prefix):], Delimiter); pos >= 0 {
+			// subdirectory
+			f = &SwiftFile{name: Delimiter + name[:len(prefix)+pos+1]}
+		} else if isDirectoryMarker(obj.hdr) {
+			f.name += Delimiter
+			f.size = 0
+		}
+		if e, ok := entries[f.name]; !ok || e.modtime.IsZero() {
+			entries[f.name] = f
+		}
+	}
+
+	files := make([]*SwiftFile, 0, len(entries))
+	for _, f := range entries {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	return files, nil
+}
+
+func (m *MemoryBackend) FirstInDirectory(path string) (*SwiftFile, error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	objects, err := m.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	var first *SwiftFile
+	for name, obj := range objects {
+		if strings.HasPrefix(name, prefix) && !isExpired(obj.hdr) && (first == nil || Delimiter+name < first.name) {
+			first = &SwiftFile{
+				name:        Delimiter + name,
+				size:        int64(len(obj.data)),
+				modtime:     obj.modtime,
+				contentType: obj.hdr.ContentType().Get(),
+			}
+		}
+	}
+	return first, nil
+}
+
+func (m *MemoryBackend) Get(name string) (schwift.ObjectHeaders, error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	obj, err := m.object(name)
+	if err != nil {
+		return schwift.ObjectHeaders{}, err
+	}
+	return objectHeaders(obj.hdr, int64(len(obj.data)), obj.modtime), nil
+}
+
+// GetLink is the same as Get because there are no symlinks.
+func (m *MemoryBackend) GetLink(name string) (schwift.ObjectHeaders, string, error) {
+	hdr, err := m.Get(name)
+	return hdr, "", err
+}
+
+func (m *MemoryBackend) Download(name string) (io.ReadCloser, int64, error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	obj, err := m.object(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), int64(len(obj.data)), nil
+}
+
+func (m *MemoryBackend) DownloadRange(name string, offset, length int64) (io.ReadCloser, error) {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	obj, err := m.object(name)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(len(obj.data))
+	if offset > size {
+		offset = size
+	}
+	end := size
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data[offset:end])), nil
+}
+
+func (m *MemoryBackend) Upload(name string, content io.Reader, hdr schwift.ObjectHeaders) error {
+	v := newVerifyingReader(content)
+	data, err := ioutil.ReadAll(v)
+	if err != nil {
+		return err
+	}
+	sum, err := v.verify(hdr)
+	if err != nil {
+		return err
+	}
+
+	stored := storedHeaders(hdr)
+	stored.Etag().Set(sum)
+
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	objects, err := m.objects()
+	if err != nil {
+		return err
+	}
+	objects[name] = &memoryObject{
+		data:    data,
+		hdr:     stored,
+		modtime: time.Now(),
+	}
+	return nil
+}
+
+func (m *MemoryBackend) SetMetadata(name string, hdr schwift.ObjectHeaders) error {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	obj, err := m.object(name)
+	if err != nil {
+		return err
+	}
+	obj.hdr = updateHeaders(obj.hdr, hdr)
+	return nil
+}
+
+func (m *MemoryBackend) Delete(name string) error {
+	m.store.lock.Lock()
+	defer m.store.lock.Unlock()
+
+	if _, err := m.object(name); err != nil {
+		return err
+	}
+	objects, _ := m.objects()
+	delete(objects, name)
+	return nil
+}
+
+// DeleteWithSegments is the same as Delete because there are no large
+// objects.
+func (m *MemoryBackend) DeleteWithSegments(name string) error {
+	return m.Delete(name)
+}
+
+func (m *MemoryBackend) CopyTo(srcName string, dest Backend, destName string, hdr schwift.ObjectHeaders) error {
+	return copyObject(m, srcName, dest, destName, hdr)
+}
+
+func (m *MemoryBackend) MoveTo(srcName string, dest Backend, destName string) error {
+	if err := m.CopyTo(srcName, dest, destName, schwift.NewObjectHeaders()); err != nil {
+		return err
+	}
+	return m.Delete(srcName)
+}
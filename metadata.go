@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// Flag of extended attributes in the attributes of SFTP
+	sshFileXferAttrExtended = 0x80000000
+
+	// Names of the extended attributes of the objects. The custom metadata
+	// is "user.<key>" like extended attributes of Linux.
+	xattrContentType = "swift.content-type"
+	xattrEtag        = "swift.etag"
+	xattrDeleteAt    = "swift.delete-at"
+	xattrUserPrefix  = "user."
+
+	objectMetaPrefix = "X-Object-Meta-"
+)
+
+// extendedAttributes returns the headers of an object as extended attributes.
+// The expiry is in RFC 3339.
+func extendedAttributes(hdr schwift.ObjectHeaders) []sftp.StatExtended {
+	var attrs []sftp.StatExtended
+	if ct := hdr.ContentType().Get(); ct != "" {
+		attrs = append(attrs, sftp.StatExtended{ExtType: xattrContentType, ExtData: ct})
+	}
+	if etag := hdr.Etag().Get(); etag != "" {
+		attrs = append(attrs, sftp.StatExtended{ExtType: xattrEtag, ExtData: strings.Trim(etag, `"`)})
+	}
+	if hdr.ExpiresAt().Exists() {
+		attrs = append(attrs, sftp.StatExtended{
+			ExtType: xattrDeleteAt,
+			ExtData: hdr.ExpiresAt().Get().UTC().Format(time.RFC3339),
+		})
+	}
+
+	var keys []string
+	for k := range hdr.Headers {
+		if strings.HasPrefix(k, objectMetaPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		attrs = append(attrs, sftp.StatExtended{
+			ExtType: xattrUserPrefix + strings.ToLower(strings.TrimPrefix(k, objectMetaPrefix)),
+			ExtData: hdr.Get(k),
+		})
+	}
+	return attrs
+}
+
+// applyAttributes sets extended attributes to the stored headers of an
+// object. An empty value removes the attribute. Only the custom metadata can
+// be set; the content type, the ETag and the expiry are read-only, so that
+// users can't keep files longer than the expiry rules allow.
+func applyAttributes(hdr schwift.ObjectHeaders, attrs []sftp.StatExtended) error {
+	for _, attr := range attrs {
+		switch {
+		case strings.HasPrefix(attr.ExtType, xattrUserPrefix) && len(attr.ExtType) > len(xattrUserPrefix):
+			key := objectMetaPrefix + strings.TrimPrefix(attr.ExtType, xattrUserPrefix)
+			if attr.ExtData == "" {
+				hdr.Clear(key)
+			} else {
+				hdr.Set(key, attr.ExtData)
+			}
+
+		case attr.ExtType == xattrContentType, attr.ExtType == xattrEtag, attr.ExtType == xattrDeleteAt:
+			return sftp.ErrSshFxPermissionDenied
+		default:
+			return sftp.ErrSshFxOpUnsupported
+		}
+	}
+	return nil
+}
+
+// Attributes returns the headers of the file as extended attributes.
+// Directories have none.
+func (fs *SwiftFS) Attributes(p string) ([]sftp.StatExtended, error) {
+	s, f, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	} else if f.IsDir() {
+		return nil, nil
+	}
+
+	if f.hdr.Headers == nil {
+		// the entry of a listing in the cache
+		if f.hdr, err = s.Get(f.name); err != nil {
+			return nil, err
+		}
+		fs.cache.put(s.Container(), f)
+	}
+	return extendedAttributes(f.hdr), nil
+}
+
+// loadAttributes loads the extended attributes of the file for the response
+// to a stat request if show_metadata is set. extensionChannel takes them with
+// loadedAttributes, so that it doesn't request Swift while it sends responses.
+func (fs *SwiftFS) loadAttributes(p string) {
+	if !fs.swift.Config().ShowMetadata {
+		return
+	}
+	attrs, err := fs.Attributes(p)
+	if err != nil {
+		fs.log.Warnf("%s %s", p, err.Error())
+	}
+
+	fs.attrsLock.Lock()
+	fs.attrs[p] = append(fs.attrs[p], attrs)
+	fs.attrsLock.Unlock()
+}
+
+// loadedAttributes returns the extended attributes loaded for the earliest
+// stat request of the path, and forgets them.
+func (fs *SwiftFS) loadedAttributes(p string) []sftp.StatExtended {
+	fs.attrsLock.Lock()
+	defer fs.attrsLock.Unlock()
+
+	loaded := fs.attrs[p]
+	if len(loaded) == 0 {
+		return nil
+	} else if len(loaded) == 1 {
+		delete(fs.attrs, p)
+	} else {
+		fs.attrs[p] = loaded[1:]
+	}
+	return loaded[0]
+}
+
+// setAttributes sets the extended attributes of a Setstat request to the file.
+// The other attributes are not supported.
+func (fs *SwiftFS) setAttributes(r *sftp.Request) error {
+	if r.Flags&sshFileXferAttrExtended == 0 {
+		fs.log.Warnf("%s Only extended attributes can be set", r.Filepath)
+		return sftp.ErrSshFxOpUnsupported
+	}
+
+	if _, v := fs.version(r.Filepath); v != nil {
+		fs.log.Warnf("%s Couldn't set attributes of a version", r.Filepath)
+		return sftp.ErrSshFxPermissionDenied
+	}
+
+	s, f, err := fs.lookup(r.Filepath)
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return sftp.ErrSshFxNoSuchFile
+	} else if f.IsDir() {
+		fs.log.Warnf("%s Couldn't set attributes of a directory", r.Filepath)
+		return sftp.ErrSshFxPermissionDenied
+	}
+
+	hdr, err := s.Get(f.name)
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return sftp.ErrSshFxFailure
+	}
+	meta := storedHeaders(hdr)
+	meta.Etag().Del()
+	if err = applyAttributes(meta, r.Attributes().Extended); err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		if err == sftp.ErrSshFxPermissionDenied || err == sftp.ErrSshFxOpUnsupported {
+			return err
+		}
+		return sftp.ErrSshFxFailure
+	}
+
+	defer fs.cache.invalidate(s.Container(), f.name)
+	if err = s.SetMetadata(f.name, meta); err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return sftp.ErrSshFxFailure
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// setstatForTesting returns a Setstat request with extended attributes.
+func setstatForTesting(path string, attrs ...sftp.StatExtended) *sftp.Request {
+	r := sftp.NewRequest("Setstat", path)
+	r.Flags = sshFileXferAttrExtended
+	r.Attrs = ssh.Marshal(struct{ Count uint32 }{uint32(len(attrs))})
+	for _, attr := range attrs {
+		r.Attrs = append(r.Attrs, ssh.Marshal(attr)...)
+	}
+	return r
+}
+
+func TestExtendedAttributes(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{SwiftTimeout: 10, ShowMetadata: true})
+
+	deleteAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	hdr := schwift.NewObjectHeaders()
+	hdr.ContentType().Set("text/plain")
+	hdr.ExpiresAt().Set(deleteAt)
+	hdr.Metadata().Set("owner", "alice")
+	if err := s.Upload("a.txt", strings.NewReader("data"), hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	client := startFakeSftp(t, s)
+	fi, err := client.Stat("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string]string{}
+	for _, attr := range fi.Sys().(*sftp.FileStat).Extended {
+		attrs[attr.ExtType] = attr.ExtData
+	}
+	expected := map[string]string{
+		xattrContentType: "text/plain",
+		xattrEtag:        "8d777f385d3dfec8815d20f7496026dc",
+		xattrDeleteAt:    deleteAt.UTC().Format(time.RFC3339),
+		"user.owner":     "alice",
+	}
+	for k, v := range expected {
+		if attrs[k] != v {
+			t.Errorf("%s: expected %q, but %q", k, v, attrs[k])
+		}
+	}
+
+	// not sent unless show_metadata is set
+	if fi, err = startFakeSftp(t, fakeSwiftClient(f, "c1")).Stat("/a.txt"); err != nil {
+		t.Fatal(err)
+	} else if ext := fi.Sys().(*sftp.FileStat).Extended; len(ext) != 0 {
+		t.Errorf("Unexpected attributes: %v", ext)
+	}
+
+	// directories have no extended attributes
+	upload(t, s, "d/b.txt", "data")
+	if fi, err = client.Stat("/d"); err != nil {
+		t.Fatal(err)
+	} else if ext := fi.Sys().(*sftp.FileStat).Extended; len(ext) != 0 {
+		t.Errorf("Unexpected attributes of a directory: %v", ext)
+	}
+
+	// The response is sent without requests to Swift.
+	var requests int32
+	f.Fail = func(r *http.Request) int {
+		atomic.AddInt32(&requests, 1)
+		return 0
+	}
+	c := newExtensionChannel(nil, NewSwiftFS(s), log)
+	c.statting[1] = "/a.txt"
+	pkt := []byte{0, 0, 0, 9, sshFxpAttrs, 0, 0, 0, 1, 0, 0, 0, 0}
+	if res := c.response(pkt); len(res) != len(pkt) {
+		t.Errorf("Unexpected attributes without a stat handler: %v", res)
+	} else if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("%d requests were sent to Swift", n)
+	}
+}
+
+func TestSetExtendedAttributes(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+
+	deleteAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	hdr := schwift.NewObjectHeaders()
+	hdr.ExpiresAt().Set(deleteAt)
+	hdr.Metadata().Set("owner", "alice")
+	hdr.Metadata().Set("group", "users")
+	if err := s.Upload("a.txt", strings.NewReader("data"), hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewSwiftFS(s)
+	err := fs.Filecmd(setstatForTesting("/a.txt",
+		sftp.StatExtended{ExtType: "user.owner", ExtData: "bob"},
+		sftp.StatExtended{ExtType: "user.group", ExtData: ""},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr, err = s.Get("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if v := hdr.Metadata().Get("owner"); v != "bob" {
+		t.Errorf("Expected bob, but %q", v)
+	}
+	if hdr.Metadata().Get("group") != "" {
+		t.Error("The metadata was not removed")
+	}
+	if !hdr.ExpiresAt().Get().Equal(deleteAt) {
+		t.Errorf("The expiry was changed to %v", hdr.ExpiresAt().Get())
+	}
+
+	// The content type, the ETag and the expiry are read-only.
+	errors := map[*sftp.Request]error{
+		setstatForTesting("/a.txt", sftp.StatExtended{ExtType: xattrEtag, ExtData: "x"}):                                              sftp.ErrSshFxPermissionDenied,
+		setstatForTesting("/a.txt", sftp.StatExtended{ExtType: xattrDeleteAt}):                                                        sftp.ErrSshFxPermissionDenied,
+		setstatForTesting("/a.txt", sftp.StatExtended{ExtType: xattrDeleteAt, ExtData: deleteAt.Add(time.Hour).Format(time.RFC3339)}): sftp.ErrSshFxPermissionDenied,
+		setstatForTesting("/a.txt", sftp.StatExtended{ExtType: xattrContentType, ExtData: "text/csv"}):                                sftp.ErrSshFxPermissionDenied,
+		setstatForTesting("/a.txt", sftp.StatExtended{ExtType: "unknown", ExtData: "x"}):                                              sftp.ErrSshFxOpUnsupported,
+		setstatForTesting("/b.txt", sftp.StatExtended{ExtType: "user.owner", ExtData: "x"}):                                           sftp.ErrSshFxNoSuchFile,
+		sftp.NewRequest("Setstat", "/a.txt"):                                                                                          sftp.ErrSshFxOpUnsupported,
+	}
+	for r, expected := range errors {
+		if err = fs.Filecmd(r); err != expected {
+			t.Errorf("%s %v: expected %v, but %v", r.Filepath, r.Attributes().Extended, expected, err)
+		}
+	}
+	if hdr, err = s.Get("a.txt"); err != nil {
+		t.Fatal(err)
+	} else if !hdr.ExpiresAt().Get().Equal(deleteAt) || hdr.ContentType().Get() == "text/csv" {
+		t.Errorf("Read-only headers were changed %v", hdr.Headers)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+// errCircuitOpen is returned without sending the request while Swift is
+// considered to be down.
+var errCircuitOpen = errors.New("Swift is unavailable, requests are suspended")
+
+// retryPolicy decides how often and how long to wait before transient
+// failures of Swift are retried.
+type retryPolicy struct {
+	max     int // retries, 0 or less disables retries
+	wait    time.Duration
+	maxWait time.Duration
+}
+
+func newRetryPolicy(c Config) retryPolicy {
+	p := retryPolicy{
+		max:     c.RetryMax,
+		wait:    time.Duration(c.RetryWait) * time.Millisecond,
+		maxWait: time.Duration(c.RetryMaxWait) * time.Second,
+	}
+	if p.wait <= 0 {
+		p.wait = 500 * time.Millisecond
+	}
+	if p.maxWait < p.wait {
+		p.maxWait = p.wait
+	}
+	return p
+}
+
+// backoff returns the wait before the n-th retry. It grows exponentially and
+// half of it is random, so that clients do not retry at the same time. A
+// Retry-After header of the response is respected up to maxWait.
+func (p retryPolicy) backoff(n int, resp *http.Response) time.Duration {
+	d := p.wait
+	for i := 1; i < n && d < p.maxWait; i++ {
+		d *= 2
+	}
+	if d > p.maxWait {
+		d = p.maxWait
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+
+	if resp != nil {
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			if after := time.Duration(sec) * time.Second; after > d {
+				d = after
+			}
+			if d > p.maxWait {
+				d = p.maxWait
+			}
+		}
+	}
+	return d
+}
+
+// retryableStatus reports whether a response with the status code is a
+// transient failure.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retriedError is returned by retryTransport for a replayable request, which
+// is not retried again by a retryPolicy.
+type retriedError struct {
+	err error
+}
+
+func (e retriedError) Error() string { return e.err.Error() }
+func (e retriedError) Unwrap() error { return e.err }
+
+// isRetryable reports whether an error returned by schwift or while reading a
+// response body is a transient failure. Only timeouts and connections closed
+// by the peer are transient; TLS, DNS and refused connections are not.
+// Requests are retried at one layer only: the failures of replayable requests
+// were already retried by retryTransport.
+func isRetryable(err error) bool {
+	var retried retriedError
+	if err == nil || errors.Is(err, errCircuitOpen) || errors.As(err, &retried) {
+		return false
+	}
+
+	var statusErr schwift.UnexpectedStatusCodeError
+	if errors.As(err, &statusErr) {
+		if req := statusErr.ActualResponse.Request; req != nil && replayable(req) {
+			return false
+		}
+		return retryableStatus(statusErr.ActualResponse.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// retry calls fn until it succeeds, fails permanently or the retries are
+// exhausted.
+func (p retryPolicy) retry(what string, fn func() error) (err error) {
+	for n := 1; ; n++ {
+		if err = fn(); err == nil || n > p.max || !isRetryable(err) {
+			return err
+		}
+
+		wait := p.backoff(n, nil)
+		log.Infof("Retry %s in %v (%d/%d) [%v]", what, wait, n, p.max, err)
+		time.Sleep(wait)
+	}
+}
+
+// retryTransport retries idempotent requests to Swift which fail with a
+// transient error, and suspends all requests while the circuit breaker is
+// open.
+type retryTransport struct {
+	// Transport sends the requests. http.DefaultTransport is used if nil.
+	Transport http.RoundTripper
+
+	policy  retryPolicy
+	breaker *circuitBreaker
+}
+
+func newRetryTransport(c Config) *retryTransport {
+	return &retryTransport{
+		policy:  newRetryPolicy(c),
+		breaker: newCircuitBreaker(c.CircuitThreshold, time.Duration(c.CircuitTimeout)*time.Second),
+	}
+}
+
+func (t *retryTransport) transport() http.RoundTripper {
+	if t.Transport != nil {
+		return t.Transport
+	}
+	return http.DefaultTransport
+}
+
+// replayable reports whether the request may be sent again.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE", "COPY", "OPTIONS":
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for n := 1; ; n++ {
+		probe, err := t.breaker.allow()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.transport().RoundTrip(req)
+		failed := err != nil || retryableStatus(resp.StatusCode)
+		t.breaker.record(!failed, probe)
+		if !failed || !replayable(req) {
+			// A request which can't be replayed is retried by the caller.
+			return resp, err
+		} else if n > t.policy.max || (err != nil && !isRetryable(err)) {
+			if err != nil {
+				err = retriedError{err}
+			}
+			return resp, err
+		}
+
+		wait := t.policy.backoff(n, resp)
+		if err == nil {
+			err = errors.New(resp.Status)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Infof("Retry %s %s in %v (%d/%d) [%v]", req.Method, req.URL.Path, wait, n, t.policy.max, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// circuitBreaker opens after threshold consecutive failures. While it is
+// open, requests fail with errCircuitOpen. After timeout a single request is
+// let through, and the breaker closes again if it succeeds.
+// All methods do nothing on a nil *circuitBreaker.
+type circuitBreaker struct {
+	threshold int
+	timeout   time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// newCircuitBreaker returns nil if threshold is 0 or less.
+func newCircuitBreaker(threshold int, timeout time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+// allow returns errCircuitOpen if the request must not be sent. probe is
+// true for the request which tests whether Swift is back.
+func (b *circuitBreaker) allow() (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < b.threshold {
+		return false, nil
+	} else if b.probing || time.Now().Before(b.openUntil) {
+		return false, errCircuitOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// record counts the result of a request.
+func (b *circuitBreaker) record(ok bool, probe bool) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	if ok {
+		if b.failures >= b.threshold {
+			log.Infof("Swift is available again, resume requests")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if probe || b.failures == b.threshold {
+			log.Warnf("Swift failed %d times in a row, suspend requests for %v", b.failures, b.timeout)
+		}
+		b.openUntil = time.Now().Add(b.timeout)
+	}
+}
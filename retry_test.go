@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := newRetryPolicy(Config{RetryMax: 5, RetryWait: 100, RetryMaxWait: 1})
+
+	for n, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(n+1, nil); d < max/2 || d > max {
+				t.Errorf("backoff(%d) = %v, expected between %v and %v", n+1, d, max/2, max)
+			}
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"3"}}}
+	if d := p.backoff(1, resp); d != time.Second {
+		t.Errorf("Retry-After must be limited by the maximum wait, got %v", d)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, code := range []int{429, 500, 502, 503, 504} {
+		if !retryableStatus(code) {
+			t.Errorf("status %d must be retried", code)
+		}
+	}
+	for _, code := range []int{200, 401, 404, 409, 416, 422, 501} {
+		if retryableStatus(code) {
+			t.Errorf("status %d must not be retried", code)
+		}
+	}
+
+	if isRetryable(nil) || isRetryable(errors.New("failed")) || isRetryable(errCircuitOpen) {
+		t.Errorf("only transient errors must be retried")
+	}
+
+	opErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://swift", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+	transient := []error{
+		opErr(&os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}),
+		opErr(&os.SyscallError{Syscall: "write", Err: syscall.EPIPE}),
+		&url.Error{Op: "Put", URL: "https://swift", Err: io.EOF},
+		io.ErrUnexpectedEOF,
+		context.DeadlineExceeded,
+		&net.DNSError{Err: "timeout", Name: "swift", IsTimeout: true},
+	}
+	for _, err := range transient {
+		if !isRetryable(err) {
+			t.Errorf("%v must be retried", err)
+		}
+	}
+	permanent := []error{
+		opErr(&os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}),
+		opErr(&net.DNSError{Err: "no such host", Name: "swift", IsNotFound: true}),
+		&url.Error{Op: "Get", URL: "https://swift", Err: x509.UnknownAuthorityError{}},
+		&url.Error{Op: "Get", URL: "https://swift", Err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}},
+		&url.Error{Op: "Get", URL: "https://swift", Err: retriedError{io.EOF}},
+	}
+	for _, err := range permanent {
+		if isRetryable(err) {
+			t.Errorf("%v must not be retried", err)
+		}
+	}
+
+	// status errors are retried by the transport if the request is replayable
+	get, _ := http.NewRequest("GET", "https://swift", nil)
+	put, _ := http.NewRequest("PUT", "https://swift", ioutil.NopCloser(strings.NewReader("data")))
+	for req, retryable := range map[*http.Request]bool{get: false, put: true} {
+		err := schwift.UnexpectedStatusCodeError{ActualResponse: &http.Response{StatusCode: 503, Request: req}}
+		if isRetryable(err) != retryable {
+			t.Errorf("%s: expected retryable %v", req.Method, retryable)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newRetryTransport(Config{RetryMax: 2, RetryWait: 1})}
+
+	// PUT is replayed with the same body
+	req, _ := http.NewRequest("PUT", ts.URL, strings.NewReader("data"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "data" || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("PUT was not retried: status=%d body=%q requests=%d", resp.StatusCode, body, requests)
+	}
+
+	// POST is not idempotent
+	atomic.StoreInt32(&requests, 0)
+	resp, err = client.Post(ts.URL, "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("POST must not be retried: status=%d requests=%d", resp.StatusCode, requests)
+	}
+
+	// The retries are exhausted
+	atomic.StoreInt32(&requests, -10)
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(&requests) != -7 {
+		t.Errorf("GET must be tried 3 times: status=%d requests=%d", resp.StatusCode, requests+10)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	if newCircuitBreaker(0, time.Second) != nil {
+		t.Fatalf("threshold 0 must disable the breaker")
+	}
+
+	b := newCircuitBreaker(3, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := b.allow(); err != nil {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+		b.record(false, false)
+	}
+	if _, err := b.allow(); err != errCircuitOpen {
+		t.Fatalf("breaker must be open after 3 failures")
+	}
+
+	// a single probe is let through after the timeout
+	time.Sleep(60 * time.Millisecond)
+	probe, err := b.allow()
+	if err != nil || !probe {
+		t.Fatalf("probe must be allowed after the timeout")
+	}
+	if _, err := b.allow(); err != errCircuitOpen {
+		t.Errorf("only one probe must be allowed")
+	}
+
+	// a failed probe opens the breaker again
+	b.record(false, true)
+	if _, err := b.allow(); err != errCircuitOpen {
+		t.Errorf("breaker must be open after a failed probe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	probe, _ = b.allow()
+	b.record(true, probe)
+	if _, err := b.allow(); err != nil {
+		t.Errorf("breaker must be closed after a successful probe")
+	}
+}
+
+func TestRetryTransportCircuitOpen(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newRetryTransport(Config{
+		RetryMax: 5, RetryWait: 1, CircuitThreshold: 2, CircuitTimeout: 60,
+	})}
+
+	resp, err := client.Get(ts.URL)
+	if !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected errCircuitOpen, got %v", err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("requests must stop when the breaker opens, sent %d", requests)
+	}
+
+	if _, err = client.Get(ts.URL); !errors.Is(err, errCircuitOpen) || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("requests must fail fast while the breaker is open")
+	}
+}
+
+// truncatingTransport cuts the body of the first n downloads of .dat objects
+// after limit bytes.
+type truncatingTransport struct {
+	n     int32
+	limit int64
+}
+
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+func (t *truncatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || req.Method != "GET" || !strings.HasSuffix(req.URL.Path, ".dat") {
+		return resp, err
+	}
+	if atomic.AddInt32(&t.n, -1) >= 0 {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(io.LimitReader(resp.Body, t.limit), failingReader{io.ErrUnexpectedEOF}), resp.Body}
+	}
+	return resp, nil
+}
+
+func retryConfigForTesting() Config {
+	return Config{SwiftTimeout: 10, RetryMax: 3, RetryWait: 1, RetryMaxWait: 1}
+}
+
+func TestRetryDownloadResume(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", retryConfigForTesting())
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	s.Put("big.dat", bytes.NewReader(data))
+
+	s.transport.Transport = &truncatingTransport{n: 2, limit: 300000}
+	var m sync.Mutex
+	var ranges []string
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "GET" && r.Header.Get("Range") != "" {
+			m.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			m.Unlock()
+		}
+		return 0
+	}
+
+	client := startFakeSftp(t, s)
+	r, err := client.Open("/big.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Fatalf("Downloaded data differs (size=%d)", len(downloaded))
+	}
+	if strings.Join(ranges, ",") != "bytes=300000-,bytes=600000-" {
+		t.Errorf("Download was not resumed %v", ranges)
+	}
+}
+
+func TestRetryUpload(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+
+	// the first PUT of the object and of the second segment fail
+	var failed int32
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "PUT" && (strings.HasSuffix(r.URL.Path, "/a.dat") || strings.HasSuffix(r.URL.Path, "0000000000000002")) {
+			if atomic.AddInt32(&failed, 1)%2 == 1 {
+				return http.StatusServiceUnavailable
+			}
+		}
+		return 0
+	}
+
+	s := fakeSwiftClientWith(f, "c1", retryConfigForTesting())
+	client := startFakeSftp(t, s)
+	w, _ := client.Create("/a.dat")
+	w.Write([]byte("hello world"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(s, "a.dat", 0, 0); err != nil || data != "hello world" {
+		t.Errorf("Uploaded data differs %q %v", data, err)
+	}
+
+	conf := retryConfigForTesting()
+	conf.SegmentSize = 1
+	seg := fakeSwiftClientWith(f, "c2", conf)
+	client = startFakeSftp(t, seg)
+	data := bytes.Repeat([]byte("x"), 3*1024*1024+10)
+	w, _ = client.Create("/big.bin")
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded, err := download(seg, "big.bin", 0, 0); err != nil || uploaded != string(data) {
+		t.Errorf("Segmented upload differs (size=%d) %v", len(uploaded), err)
+	}
+	if n := atomic.LoadInt32(&failed); n < 3 {
+		t.Errorf("Expected failed requests, got %d", n)
+	}
+}
+
+func TestRetryOneLayer(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", retryConfigForTesting())
+
+	// The HEAD before the upload is retried by the transport only.
+	var heads, puts int32
+	f.Fail = func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/a.dat") {
+			if r.Method == "HEAD" {
+				atomic.AddInt32(&heads, 1)
+			} else if r.Method == "PUT" {
+				atomic.AddInt32(&puts, 1)
+			}
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+	client := startFakeSftp(t, s)
+	w, _ := client.Create("/a.dat")
+	w.Write([]byte("hello world"))
+	if err := w.Close(); err == nil {
+		t.Fatal("The upload must fail")
+	}
+	if n := atomic.LoadInt32(&heads); n != 4 {
+		t.Errorf("Expected 4 HEAD requests, got %d", n)
+	}
+	if n := atomic.LoadInt32(&puts); n != 0 {
+		t.Errorf("Expected no PUT requests, got %d", n)
+	}
+
+	// A refused connection is not retried.
+	var dials int32
+	ts := httptest.NewServer(http.NotFoundHandler())
+	addr := ts.Listener.Addr().String()
+	ts.Close()
+	transport := newRetryTransport(retryConfigForTesting())
+	transport.Transport = &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	if _, err := (&http.Client{Transport: transport}).Get("http://swift/"); err == nil {
+		t.Fatal("The request must fail")
+	} else if isRetryable(err) {
+		t.Errorf("%v must not be retried again", err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Expected 1 connection attempt, got %d", n)
+	}
+}
+
+func TestRetrySwiftCircuitBreaker(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	conf := retryConfigForTesting()
+	conf.CircuitThreshold = 3
+	conf.CircuitTimeout = 60
+	s := fakeSwiftClientWith(f, "c1", conf)
+
+	var requests int32
+	f.Fail = func(r *http.Request) int {
+		atomic.AddInt32(&requests, 1)
+		return http.StatusServiceUnavailable
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := readDirectory(s, ""); err == nil {
+			t.Fatal("Listing must fail")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Requests must be suspended after 3 failures, sent %d", n)
+	}
+}
@@ -23,12 +23,17 @@ func StartServer(conf Config) error {
 		return err
 	}
 
+	// tmpfiles
+	if err = InitTmpFiles(conf); err != nil {
+		return err
+	}
+
 	// swift
-	swift := NewSwift(conf)
+	swift := NewBackend(conf)
 	if err = swift.Init(); err != nil {
 		return err
 	}
-	log.Infof("Use Swift backend '%s'", swift.SchwiftClient.Backend().EndpointURL())
+	log.Infof("Use backend '%s'", swift.EndpointURL())
 
 	// Start server
 	listener, err := net.Listen("tcp", conf.BindAddress)
@@ -66,6 +71,7 @@ func StartServer(conf Config) error {
 		log.Infof("Connect from %s port %s", addr, port)
 		go func() {
 			defer func() {
+				nConn.Close()
 				log.Infof("Disconnect from %s port %s", addr, port)
 			}()
 
@@ -214,7 +220,7 @@ func authPassword(conf Config) func(c ssh.ConnMetadata, password []byte) (*ssh.P
 	}
 }
 
-func handleClient(conf Config, sConf *ssh.ServerConfig, swift *Swift, nConn net.Conn) error {
+func handleClient(conf Config, sConf *ssh.ServerConfig, swift Backend, nConn net.Conn) error {
 	conn, chans, reqs, err := ssh.NewServerConn(nConn, sConf)
 	if err != nil {
 		return err
@@ -233,28 +239,50 @@ func handleClient(conf Config, sConf *ssh.ServerConfig, swift *Swift, nConn net.
 		"client": client,
 	})
 
-	container := conn.Permissions.Extensions["swift-sftp-container"]
+	// The container of the session comes first. More containers separated by
+	// comma are permitted as the destination of copies.
+	for _, c := range strings.Split(conn.Permissions.Extensions["swift-sftp-container"], ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			client.Containers = append(client.Containers, c)
+		}
+	}
 
-	swift.setContainer(container)
-	exists, err := swift.ExistsContainer()
-	if err != nil {
-		return err
+	if len(client.Containers) == 0 {
+		return fmt.Errorf("No container is given for %s", client.Username)
 	}
 
-	if !exists {
-		if conf.CreateContainerIfNotExists {
-			if err = swift.CreateContainer(); err != nil {
-				return fmt.Errorf("Couldn't create container. [%s]", err)
-			}
-			log.Infof("Create container '%s'", container)
+	if conf.MultiContainer {
+		// The containers are the top-level directories and the session is not
+		// bound to one of them.
+		swift = swift.WithContainer("")
 
-		} else {
-			return fmt.Errorf("Container '%s' does not exist.", container)
+		clog.Infof("Session %s@%s opened for %s (containers=%s)", client.Username, client.RemoteAddr,
+			swift.EndpointURL(), strings.Join(client.Containers, ","))
+
+	} else {
+		container := client.Containers[0]
+
+		swift = swift.WithContainer(container)
+		exists, err := swift.ExistsContainer()
+		if err != nil {
+			return err
 		}
-	}
 
-	clog.Infof("Session %s@%s opened for %s%s", client.Username, client.RemoteAddr,
-		swift.SchwiftClient.Backend().EndpointURL(), container)
+		if !exists {
+			if conf.CreateContainerIfNotExists {
+				if err = swift.CreateContainer(); err != nil {
+					return fmt.Errorf("Couldn't create container. [%s]", err)
+				}
+				log.Infof("Create container '%s'", container)
+
+			} else {
+				return fmt.Errorf("Container '%s' does not exist.", container)
+			}
+		}
+
+		clog.Infof("Session %s@%s opened for %s%s", client.Username, client.RemoteAddr,
+			swift.EndpointURL(), container)
+	}
 
 	go ssh.DiscardRequests(reqs)
 
@@ -272,22 +300,53 @@ func handleClient(conf Config, sConf *ssh.ServerConfig, swift *Swift, nConn net.
 			return err
 		}
 
+		// The first "subsystem" or "exec" request determines what runs on this channel.
+		var session, command string
+		for req := range requests {
+			clog.Debugf("Handling request [type=%s]", req.Type)
+
+			ok := false
+			switch req.Type {
+			case "subsystem":
+				var msg struct{ Name string }
+				if err := ssh.Unmarshal(req.Payload, &msg); err == nil && msg.Name == "sftp" {
+					session = req.Type
+					ok = true
+				}
+			case "exec":
+				var msg struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+					session = req.Type
+					command = msg.Command
+					ok = true
+				}
+			}
+			req.Reply(ok, nil)
+
+			if ok {
+				break
+			}
+		}
+
 		go func(in <-chan *ssh.Request) {
 			for req := range in {
 				clog.Debugf("Handling request [type=%s]", req.Type)
-
-				// We only handle the request that has type of "subsystem".
-				ok := false
-				if req.Type == "subsystem" && string(req.Payload[4:]) == "sftp" {
-					ok = true
-				}
-				req.Reply(ok, nil)
+				req.Reply(false, nil)
 			}
 		}(requests)
 
-		// sftp
-		if err = StartSftpSession(swift, channel, client); err != nil {
-			return err
+		switch session {
+		case "subsystem":
+			// sftp
+			if err = StartSftpSession(swift, channel, client); err != nil {
+				return err
+			}
+		case "exec":
+			if err = StartExecSession(swift, channel, client, command); err != nil {
+				return err
+			}
+		default:
+			channel.Close()
 		}
 	}
 
@@ -1,56 +1,73 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/pem"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
+// fake Keystone and Swift for all tests
+var testSwift *fakeSwift
+
+// directory for the files created by the tests
+var testDir string
+
 func TestMain(m *testing.M) {
 	l := logrus.New()
 	l.SetLevel(logrus.DebugLevel)
 	log = logrus.NewEntry(l)
 
-	// config
-	c := defaultConfigForTesting()
-
-	// First, delete the container for testing
-	s := NewSwift(c)
-	if err := s.Init(); err != nil {
+	testSwift = newFakeSwift()
+	dir, err := ioutil.TempDir("", "swift-sftp-test")
+	if err != nil {
 		panic(err)
 	}
-	s.DeleteContainer()
-	s.CreateContainer()
+	testDir = dir
 
 	// run
 	code := m.Run()
 
 	// after testing
-	s.DeleteContainer()
+	testSwift.Close()
+	os.RemoveAll(testDir)
 
 	os.Exit(code)
 }
 
+// defaultConfigForTesting returns the configuration of test.toml which
+// authenticates with the fake Keystone.
 func defaultConfigForTesting() Config {
 	c := Config{}
 	c.LoadFromFile("./misc/testing/test.toml")
 
 	// override test.toml
-	c.Container = "ojs-test-container"
-	c.BindAddress = "127.0.0.1:10022"
+	c.BindAddress = "127.0.0.1:0"
+	c.ServerKeyPath = filepath.Join(testDir, "server.key")
 	c.PasswordFilePath = ""
-	c.OsIdentityEndpoint = ""
+	c.OsIdentityEndpoint = testSwift.URL + "/v3"
 	c.OsUserID = ""
-	c.OsUsername = ""
-	c.OsPassword = ""
-	c.OsDomainID = ""
-	c.OsDomainName = ""
-	c.OsTenantID = ""
-	c.OsTenantName = ""
-	c.OsRegion = ""
+	c.OsUsername = "tester"
+	c.OsPassword = "secret"
+	c.OsUserDomainID = ""
+	c.OsUserDomainName = "Default"
+	c.OsProjectID = ""
+	c.OsProjectName = "test"
+	c.OsProjectDomainName = "Default"
+	c.OsRegion = "RegionOne"
+	c.TLSCAFile = ""
 
 	if err := c.Init(); err != nil {
 		panic(err)
@@ -62,12 +79,19 @@ func defaultConfigForTesting() Config {
 
 var _swiftCache *Swift
 
+// swiftForTesting returns a client of the container ojs-test-container of the
+// fake Swift.
 func swiftForTesting() *Swift {
 	if _swiftCache == nil {
-		_swiftCache = NewSwift(defaultConfigForTesting())
-		if err := _swiftCache.Init(); err != nil {
+		s := NewSwift(defaultConfigForTesting())
+		if err := s.Init(); err != nil {
 			panic(err)
 		}
+		s.setContainer("ojs-test-container")
+		if err := s.CreateContainer(); err != nil {
+			panic(err)
+		}
+		_swiftCache = s
 	}
 	return _swiftCache
 }
@@ -112,7 +136,7 @@ func TestInitServerPasswdFile(t *testing.T) {
 func TestInitServerPasswordAuth(t *testing.T) {
 	c := defaultConfigForTesting()
 
-	filename := "./passwd"
+	filename := filepath.Join(testDir, "passwd")
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		t.Fatal(err)
@@ -130,3 +154,312 @@ func TestInitServerPasswordAuth(t *testing.T) {
 		t.Fatal("Password authentication should be enabled")
 	}
 }
+
+// -----------------------------------------------------
+// End-to-end tests with an SSH client against StartServer
+
+// startServerForTesting starts the server on a free port and returns its
+// address. The server runs until the tests finish.
+func startServerForTesting(t *testing.T, c Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.BindAddress = l.Addr().String()
+	l.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- StartServer(c)
+	}()
+
+	for i := 0; i < 100; i++ {
+		select {
+		case err := <-errc:
+			t.Fatalf("Server stopped: %v", err)
+		default:
+		}
+		if conn, err := net.Dial("tcp", c.BindAddress); err == nil {
+			conn.Close()
+			return c.BindAddress
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Server didn't start on %s", c.BindAddress)
+	return ""
+}
+
+// sftpClientForTesting connects to the server and starts an SFTP session.
+func sftpClientForTesting(t *testing.T, addr string, user string, auth ssh.AuthMethod) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return client, nil
+}
+
+// e2eConfigForTesting returns the configuration with a password file and an
+// authorized key, and the signer of the key.
+func e2eConfigForTesting(t *testing.T) (Config, ssh.Signer) {
+	c := defaultConfigForTesting()
+	c.TmpDir = filepath.Join(testDir, "tmp")
+
+	c.PasswordFilePath = filepath.Join(testDir, "e2e-passwd")
+	passwd := "tester:e2e-home,e2e-shared:secret\nother:e2e-other:secret\nadmin:*:secret\n"
+	if err := ioutil.WriteFile(c.PasswordFilePath, []byte(passwd), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AuthorizedKeysPath = filepath.Join(testDir, "e2e-authorized_keys")
+	if err = ioutil.WriteFile(c.AuthorizedKeysPath, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, signer
+}
+
+func readFileForTesting(client *sftp.Client, name string) (string, error) {
+	r, err := client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return string(data), err
+}
+
+func writeFileForTesting(client *sftp.Client, name, content string) error {
+	w, err := client.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte(content)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func TestServerAuth(t *testing.T) {
+	c, signer := e2eConfigForTesting(t)
+	addr := startServerForTesting(t, c)
+
+	if _, err := sftpClientForTesting(t, addr, "tester", ssh.Password("wrong")); err == nil {
+		t.Error("Wrong password was accepted")
+	}
+	if _, err := sftpClientForTesting(t, addr, "nobody", ssh.Password("secret")); err == nil {
+		t.Error("Unknown user was accepted")
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, _ := ssh.NewSignerFromKey(other)
+	if _, err = sftpClientForTesting(t, addr, "tester", ssh.PublicKeys(otherSigner)); err == nil {
+		t.Error("Unknown public key was accepted")
+	}
+
+	// A public key gives no container in single-container mode.
+	if client, err := sftpClientForTesting(t, addr, "tester", ssh.PublicKeys(signer)); err == nil {
+		if _, err = client.ReadDir("/"); err == nil {
+			t.Error("Session without a container was opened")
+		}
+	}
+
+	client, err := sftpClientForTesting(t, addr, "tester", ssh.Password("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.ReadDir("/"); err != nil {
+		t.Error(err)
+	}
+	if exists, err := swiftForTesting().WithContainer("e2e-home").ExistsContainer(); err != nil || !exists {
+		t.Errorf("Container was not created: %v", err)
+	}
+}
+
+func TestServerAuthKeystoneFailure(t *testing.T) {
+	c, _ := e2eConfigForTesting(t)
+	c.OsPassword = "wrong"
+	c.BindAddress = "127.0.0.1:0"
+	if err := StartServer(c); err == nil {
+		t.Error("Server started with wrong credentials")
+	}
+}
+
+func TestServerSftp(t *testing.T) {
+	c, _ := e2eConfigForTesting(t)
+	addr := startServerForTesting(t, c)
+
+	client, err := sftpClientForTesting(t, addr, "tester", ssh.Password("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// put and get
+	if err = writeFileForTesting(client, "/hello.txt", "hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readFileForTesting(client, "/hello.txt"); err != nil || data != "hello world" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	s := swiftForTesting().WithContainer("e2e-home")
+	if hdr, err := s.Get("hello.txt"); err != nil || hdr.SizeBytes().Get() != 11 {
+		t.Errorf("Object was not uploaded: %v", err)
+	}
+
+	// mkdir and list
+	if err = client.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFileForTesting(client, "/dir/a.txt", "a"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+		switch fi.Name() {
+		case "dir":
+			if !fi.IsDir() || fi.Mode().Perm() != 0755 {
+				t.Errorf("Unexpected mode of dir %v", fi.Mode())
+			}
+		case "hello.txt":
+			if fi.IsDir() || fi.Mode().Perm() != 0644 || fi.Size() != 11 {
+				t.Errorf("Unexpected stat of hello.txt %v %d", fi.Mode(), fi.Size())
+			}
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "dir,hello.txt" {
+		t.Errorf("Unexpected listing %v", names)
+	}
+
+	// rename
+	if err = client.Rename("/hello.txt", "/dir/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Stat("/hello.txt"); err == nil {
+		t.Error("Renamed file still exists")
+	}
+	if data, err := readFileForTesting(client, "/dir/renamed.txt"); err != nil || data != "hello world" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	if err = client.Rename("/dir/a.txt", "/dir/renamed.txt"); err == nil {
+		t.Error("Rename overwrote an existing file")
+	}
+
+	// error cases
+	if _, err = client.Open("/missing.txt"); err == nil {
+		t.Error("Missing file was opened")
+	}
+	if _, err = client.Stat("/missing.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	if err = client.Remove("/missing.txt"); err == nil {
+		t.Error("Missing file was removed")
+	}
+	if err = client.RemoveDirectory("/dir"); err == nil {
+		t.Error("Directory which is not empty was removed")
+	}
+
+	// remove
+	for _, name := range []string{"/dir/a.txt", "/dir/renamed.txt"} {
+		if err = client.Remove(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = client.RemoveDirectory("/dir"); err != nil {
+		t.Error(err)
+	}
+	if _, err = client.Stat("/dir"); err == nil {
+		t.Error("Removed directory still exists")
+	}
+}
+
+func TestServerContainerPermissions(t *testing.T) {
+	c, signer := e2eConfigForTesting(t)
+	c.MultiContainer = true
+	addr := startServerForTesting(t, c)
+
+	// A public key gives no container, so it has no access to any of them.
+	if client, err := sftpClientForTesting(t, addr, "admin", ssh.PublicKeys(signer)); err == nil {
+		if _, err = client.ReadDir("/"); err == nil {
+			t.Error("Session without a container was opened")
+		}
+	}
+
+	// "*" permits all containers.
+	admin, err := sftpClientForTesting(t, addr, "admin", ssh.Password("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/e2e-home", "/e2e-shared", "/e2e-other"} {
+		if err = admin.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writeFileForTesting(admin, "/e2e-other/secret.txt", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user sees only the containers of the password file.
+	client, err := sftpClientForTesting(t, addr, "tester", ssh.Password("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if strings.Join(names, ",") != "e2e-home,e2e-shared" {
+		t.Errorf("Unexpected containers %v", names)
+	}
+
+	if err = writeFileForTesting(client, "/e2e-shared/a.txt", "a"); err != nil {
+		t.Error(err)
+	}
+	if _, err = readFileForTesting(client, "/e2e-other/secret.txt"); err == nil {
+		t.Error("File in another container was read")
+	}
+	if err = writeFileForTesting(client, "/e2e-other/b.txt", "b"); err == nil {
+		t.Error("File in another container was written")
+	}
+	if err = client.Remove("/e2e-other/secret.txt"); err == nil {
+		t.Error("File in another container was removed")
+	}
+	if data, err := readFileForTesting(admin, "/e2e-other/secret.txt"); err != nil || data != "secret" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func StartSftpSession(swift *Swift, channel ssh.Channel, client *Client) (err error) {
+func StartSftpSession(swift Backend, channel ssh.Channel, client *Client) (err error) {
 	// logger with client
 	clog := log.WithFields(logrus.Fields{
 		"client": client,
@@ -18,9 +18,16 @@ func StartSftpSession(swift *Swift, channel ssh.Channel, client *Client) (err er
 
 	fs := NewSwiftFS(swift)
 	fs.SetLogger(clog)
-	handler := sftp.Handlers{fs, fs, fs, fs}
+	fs.SetUser(client.Username)
+	fs.SetContainers(client.Containers)
+	handler := sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}
 
-	server := sftp.NewRequestServer(channel, handler)
+	server := sftp.NewRequestServer(newExtensionChannel(channel, fs, clog), handler)
 
 	log.Debug("Initialized sftp server")
 
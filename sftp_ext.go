@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP packet types and status codes used by extensionChannel.
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpLstat         = 7
+	sshFxpFstat         = 8
+	sshFxpRealpath      = 16
+	sshFxpStat          = 17
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpName          = 104
+	sshFxpAttrs         = 105
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+
+	sshFxOk               = 0
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxOpUnsupported    = 8
+
+	maxPacketLength = 256 * 1024
+)
+
+// Extensions which are answered by extensionChannel and advertised in the
+// SSH_FXP_VERSION packet in addition to the ones of sftp.RequestServer.
+var channelExtensions = []struct {
+	Name string
+	Data string
+}{
+	{"check-file", "md5,sha256"},
+	{"copy-file", "1"},
+	{"copy-data", "1"},
+}
+
+// extensionChannel sits between the SSH channel and sftp.RequestServer. It
+// answers the extended requests which sftp.RequestServer does not know and
+// passes every other packet through.
+type extensionChannel struct {
+	io.ReadWriteCloser
+
+	log *logrus.Entry
+	fs  *SwiftFS
+
+	// packets read from the client, not yet consumed by sftp.RequestServer
+	in []byte
+	// packets written by sftp.RequestServer, not yet sent to the client
+	out []byte
+
+	// Paths of the handles returned for SSH_FXP_OPEN, and the paths of
+	// SSH_FXP_OPEN requests waiting for their handles.
+	handleLock sync.Mutex
+	handles    map[string]string
+	opening    map[uint32]string
+	// Paths of the stat requests, whose attributes get the extended
+	// attributes of the file.
+	statting map[uint32]string
+
+	writeLock sync.Mutex
+}
+
+func newExtensionChannel(rwc io.ReadWriteCloser, fs *SwiftFS, clog *logrus.Entry) *extensionChannel {
+	return &extensionChannel{
+		ReadWriteCloser: rwc,
+		log:             clog,
+		fs:              fs,
+		handles:         map[string]string{},
+		opening:         map[uint32]string{},
+		statting:        map[uint32]string{},
+	}
+}
+
+// Read implements io.Reader for sftp.RequestServer.
+func (c *extensionChannel) Read(p []byte) (int, error) {
+	for len(c.in) == 0 {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		if !c.handle(pkt) {
+			c.in = pkt
+		}
+	}
+
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// Write implements io.Writer for sftp.RequestServer.
+func (c *extensionChannel) Write(p []byte) (int, error) {
+	c.out = append(c.out, p...)
+	for len(c.out) >= 4 {
+		length := int(binary.BigEndian.Uint32(c.out)) + 4
+		if len(c.out) < length {
+			break
+		}
+		pkt := append([]byte(nil), c.out[:length]...)
+		c.out = c.out[length:]
+
+		if err := c.writePacket(c.response(pkt)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// readPacket reads a whole packet including the length field.
+func (c *extensionChannel) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.ReadWriteCloser, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > maxPacketLength {
+		return nil, fmt.Errorf("Invalid packet length %d", length)
+	}
+
+	pkt := make([]byte, 4+length)
+	copy(pkt, header)
+	if _, err := io.ReadFull(c.ReadWriteCloser, pkt[4:]); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (c *extensionChannel) writePacket(pkt []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.ReadWriteCloser.Write(pkt)
+	return err
+}
+
+// handle inspects a packet from the client and answers it if it is an
+// extension of extensionChannel. It returns false if the packet has to be
+// passed to sftp.RequestServer.
+func (c *extensionChannel) handle(pkt []byte) bool {
+	body := pkt[5:]
+
+	switch pkt[4] {
+	case sshFxpOpen:
+		var open struct {
+			ID   uint32
+			Path string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(body, &open); err == nil {
+			c.handleLock.Lock()
+			c.opening[open.ID] = cleanRequestPath(open.Path)
+			c.handleLock.Unlock()
+		}
+
+	case sshFxpClose:
+		var req struct {
+			ID     uint32
+			Handle string
+		}
+		if err := ssh.Unmarshal(body, &req); err == nil {
+			c.handleLock.Lock()
+			delete(c.handles, req.Handle)
+			c.handleLock.Unlock()
+		}
+
+	case sshFxpStat, sshFxpLstat:
+		var req struct {
+			ID   uint32
+			Path string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(body, &req); err == nil {
+			c.handleLock.Lock()
+			c.statting[req.ID] = cleanRequestPath(req.Path)
+			c.handleLock.Unlock()
+		}
+
+	case sshFxpFstat:
+		var req struct {
+			ID     uint32
+			Handle string
+			Rest   []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(body, &req); err == nil {
+			if path, ok := c.handlePath(req.Handle); ok {
+				c.handleLock.Lock()
+				c.statting[req.ID] = path
+				c.handleLock.Unlock()
+			}
+		}
+
+	case sshFxpRealpath:
+		// sftp.RequestServer resolves paths against "/" by itself, so the
+		// home directory is applied here.
+		var req struct {
+			ID   uint32
+			Path string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(body, &req); err != nil {
+			return false
+		}
+		c.realPath(req.ID, req.Path)
+		return true
+
+	case sshFxpExtended:
+		var ext struct {
+			ID      uint32
+			Request string
+			Rest    []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(body, &ext); err != nil {
+			return false
+		}
+
+		// Hashes and copies may take long, so they run in their own
+		// goroutines without blocking the other requests of the session.
+		switch ext.Request {
+		case "check-file-name", "check-file-handle":
+			go c.checkFile(ext.ID, ext.Request, body)
+			return true
+		case "copy-file":
+			go c.copyFile(ext.ID, body)
+			return true
+		case "copy-data":
+			go c.copyData(ext.ID, body)
+			return true
+		}
+	}
+	return false
+}
+
+// response inspects a packet from sftp.RequestServer before it is sent.
+func (c *extensionChannel) response(pkt []byte) []byte {
+	switch pkt[4] {
+	case sshFxpVersion:
+		for _, ext := range channelExtensions {
+			pkt = append(pkt, ssh.Marshal(ext)...)
+		}
+		binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+
+	case sshFxpHandle:
+		var handle struct {
+			ID     uint32
+			Handle string
+		}
+		if err := ssh.Unmarshal(pkt[5:], &handle); err == nil {
+			c.handleLock.Lock()
+			if path, ok := c.opening[handle.ID]; ok {
+				c.handles[handle.Handle] = path
+				delete(c.opening, handle.ID)
+			}
+			c.handleLock.Unlock()
+		}
+
+	case sshFxpAttrs:
+		id := binary.BigEndian.Uint32(pkt[5:])
+		c.handleLock.Lock()
+		path, ok := c.statting[id]
+		delete(c.statting, id)
+		c.handleLock.Unlock()
+		if ok {
+			pkt = c.extendAttributes(pkt, path)
+		}
+
+	case sshFxpStatus:
+		// SSH_FXP_OPEN or a stat request failed
+		id := binary.BigEndian.Uint32(pkt[5:])
+		c.handleLock.Lock()
+		delete(c.opening, id)
+		delete(c.statting, id)
+		c.handleLock.Unlock()
+	}
+	return pkt
+}
+
+// extendAttributes appends the extended attributes of the file to an
+// SSH_FXP_ATTRS packet. They are loaded by the stat handler before, because
+// the other responses wait while a packet is written.
+func (c *extensionChannel) extendAttributes(pkt []byte, path string) []byte {
+	if len(pkt) < 13 || !c.fs.swift.Config().ShowMetadata {
+		return pkt
+	}
+	attrs := c.fs.loadedAttributes(path)
+	flags := binary.BigEndian.Uint32(pkt[9:])
+	if flags&sshFileXferAttrExtended != 0 || len(attrs) == 0 {
+		return pkt
+	}
+
+	binary.BigEndian.PutUint32(pkt[9:], flags|sshFileXferAttrExtended)
+	pkt = append(pkt, ssh.Marshal(struct{ Count uint32 }{uint32(len(attrs))})...)
+	for _, attr := range attrs {
+		pkt = append(pkt, ssh.Marshal(attr)...)
+	}
+	binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+	return pkt
+}
+
+// handlePath returns the path of the file opened with handle.
+func (c *extensionChannel) handlePath(handle string) (string, bool) {
+	c.handleLock.Lock()
+	defer c.handleLock.Unlock()
+
+	path, ok := c.handles[handle]
+	return path, ok
+}
+
+func (c *extensionChannel) realPath(id uint32, p string) {
+	reply := struct {
+		ID       uint32
+		Count    uint32
+		Name     string
+		LongName string
+		Flags    uint32 // no attributes
+	}{id, 1, c.fs.RealPath(p), "", 0}
+	c.sendPacket(sshFxpName, reply)
+}
+
+// check-file-name and check-file-handle
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-extensions-00#section-3
+func (c *extensionChannel) checkFile(id uint32, request string, body []byte) {
+	var req struct {
+		ID         uint32
+		Request    string
+		Name       string
+		Algorithms string
+		Offset     uint64
+		Length     uint64
+		BlockSize  uint32
+	}
+	if err := ssh.Unmarshal(body, &req); err != nil {
+		c.sendStatus(id, err)
+		return
+	}
+
+	path := req.Name
+	if request == "check-file-handle" {
+		var ok bool
+		if path, ok = c.handlePath(req.Name); !ok {
+			c.sendStatus(id, errors.New("Invalid handle"))
+			return
+		}
+	}
+
+	algorithm, hashes, err := c.fs.CheckFile(cleanRequestPath(path), strings.Split(req.Algorithms, ","),
+		int64(req.Offset), int64(req.Length), int64(req.BlockSize))
+	if err != nil {
+		c.sendStatus(id, err)
+		return
+	}
+
+	reply := struct {
+		ID        uint32
+		Extension string
+		Algorithm string
+		Hashes    []byte `ssh:"rest"`
+	}{id, "check-file", algorithm, hashes}
+	c.sendPacket(sshFxpExtendedReply, reply)
+}
+
+// copy-file
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-extensions-00#section-6
+func (c *extensionChannel) copyFile(id uint32, body []byte) {
+	var req struct {
+		ID        uint32
+		Request   string
+		Source    string
+		Dest      string
+		Overwrite bool
+	}
+	if err := ssh.Unmarshal(body, &req); err != nil {
+		c.sendStatus(id, err)
+		return
+	}
+
+	c.sendStatus(id, c.fs.CopyFile(req.Source, req.Dest, req.Overwrite))
+}
+
+// copy-data
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-extensions-00#section-7
+func (c *extensionChannel) copyData(id uint32, body []byte) {
+	var req struct {
+		ID          uint32
+		Request     string
+		ReadHandle  string
+		ReadOffset  uint64
+		Length      uint64
+		WriteHandle string
+		WriteOffset uint64
+	}
+	if err := ssh.Unmarshal(body, &req); err != nil {
+		c.sendStatus(id, err)
+		return
+	}
+
+	src, ok := c.handlePath(req.ReadHandle)
+	if !ok {
+		c.sendStatus(id, errors.New("Invalid handle"))
+		return
+	}
+	dest, ok := c.handlePath(req.WriteHandle)
+	if !ok {
+		c.sendStatus(id, errors.New("Invalid handle"))
+		return
+	}
+
+	c.sendStatus(id, c.fs.CopyData(src, int64(req.ReadOffset), int64(req.Length), dest, int64(req.WriteOffset)))
+}
+
+func (c *extensionChannel) sendStatus(id uint32, err error) {
+	status := struct {
+		ID       uint32
+		Code     uint32
+		Message  string
+		Language string
+	}{id, sshFxOk, "", ""}
+
+	if err != nil {
+		status.Message = err.Error()
+		switch err {
+		case sftp.ErrSshFxNoSuchFile:
+			status.Code = sshFxNoSuchFile
+		case sftp.ErrSshFxPermissionDenied:
+			status.Code = sshFxPermissionDenied
+		case sftp.ErrSshFxOpUnsupported:
+			status.Code = sshFxOpUnsupported
+		default:
+			status.Code = sshFxFailure
+		}
+	}
+	c.sendPacket(sshFxpStatus, status)
+}
+
+func (c *extensionChannel) sendPacket(pktType byte, msg interface{}) {
+	data := ssh.Marshal(msg)
+	pkt := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(pkt, uint32(len(data)+1))
+	pkt[4] = pktType
+
+	if err := c.writePacket(append(pkt, data...)); err != nil {
+		c.log.Warnf("Couldn't send packet [%v]", err)
+	}
+}
+
+// cleanRequestPath normalizes a path of a request like sftp.RequestServer does.
+func cleanRequestPath(p string) string {
+	return sftp.NewRequest("", p).Filepath
+}
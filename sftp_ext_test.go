@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// rawSftpForTesting serves an SFTP session on the backend and returns the
+// connection of the client after the version is exchanged.
+func rawSftpForTesting(t *testing.T, b Backend) net.Conn {
+	return rawSftpSessionForTesting(t, NewSwiftFS(b))
+}
+
+func rawSftpSessionForTesting(t *testing.T, fs *SwiftFS) net.Conn {
+	c1, c2 := net.Pipe()
+	handler := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+	server := sftp.NewRequestServer(newExtensionChannel(c2, fs, log), handler)
+	go server.Serve()
+	t.Cleanup(func() {
+		c1.Close()
+		server.Close()
+	})
+
+	sendPacketForTesting(t, c1, sshFxpInit, struct{ Version uint32 }{3})
+	if typ, _ := readPacketForTesting(t, c1); typ != sshFxpVersion {
+		t.Fatalf("Unexpected packet %d", typ)
+	}
+	return c1
+}
+
+func sendPacketForTesting(t *testing.T, conn net.Conn, typ byte, msg interface{}) {
+	data := ssh.Marshal(msg)
+	pkt := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(pkt, uint32(len(data)+1))
+	pkt[4] = typ
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append(pkt, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readPacketForTesting returns the type and the body of a packet.
+func readPacketForTesting(t *testing.T, conn net.Conn) (byte, []byte) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header)-1)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	return header[4], body
+}
+
+type checkFileRequest struct {
+	ID         uint32
+	Request    string
+	Name       string
+	Algorithms string
+	Offset     uint64
+	Length     uint64
+	BlockSize  uint32
+}
+
+func TestCheckFile(t *testing.T) {
+	b := NewMemoryBackend(Config{}).WithContainer("c1")
+	b.CreateContainer()
+	upload(t, b, "a.txt", "hello world")
+	conn := rawSftpForTesting(t, b)
+
+	sum := func(s string) []byte {
+		h := md5.Sum([]byte(s))
+		return h[:]
+	}
+	cases := []struct {
+		offset, length uint64
+		blockSize      uint32
+		expected       []byte
+	}{
+		{0, 0, 0, sum("hello world")},
+		{6, 0, 0, sum("world")},
+		{0, 5, 0, sum("hello")},
+		{0, 0, 4, append(append(sum("hell"), sum("o wo")...), sum("rld")...)},
+	}
+	for i, tc := range cases {
+		sendPacketForTesting(t, conn, sshFxpExtended, checkFileRequest{uint32(i), "check-file-name", "/a.txt", "md5", tc.offset, tc.length, tc.blockSize})
+		typ, body := readPacketForTesting(t, conn)
+		var reply struct {
+			ID        uint32
+			Extension string
+			Algorithm string
+			Hashes    []byte `ssh:"rest"`
+		}
+		if typ != sshFxpExtendedReply {
+			t.Errorf("%d: unexpected packet %d", i, typ)
+		} else if err := ssh.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		} else if reply.Algorithm != "md5" || string(reply.Hashes) != string(tc.expected) {
+			t.Errorf("%d: unexpected hashes %s %x", i, reply.Algorithm, reply.Hashes)
+		}
+	}
+
+	// an offset beyond the end of the file
+	sendPacketForTesting(t, conn, sshFxpExtended, checkFileRequest{10, "check-file-name", "/a.txt", "md5", 12, 0, 0})
+	if typ, body := readPacketForTesting(t, conn); typ != sshFxpStatus || binary.BigEndian.Uint32(body[4:]) != sshFxFailure {
+		t.Errorf("Expected a failure, but %d %v", typ, body)
+	}
+}
+
+// blockingBackend blocks downloads until release is closed.
+type blockingBackend struct {
+	Backend
+	release chan struct{}
+}
+
+func (b *blockingBackend) DownloadRange(name string, offset, length int64) (io.ReadCloser, error) {
+	<-b.release
+	return b.Backend.DownloadRange(name, offset, length)
+}
+
+func TestExtensionNotBlocking(t *testing.T) {
+	b := NewMemoryBackend(Config{}).WithContainer("c1")
+	b.CreateContainer()
+	upload(t, b, "a.txt", "hello world")
+	blocking := &blockingBackend{Backend: b, release: make(chan struct{})}
+	conn := rawSftpForTesting(t, blocking)
+
+	sendPacketForTesting(t, conn, sshFxpExtended, checkFileRequest{1, "check-file-name", "/a.txt", "md5", 6, 0, 0})
+	sendPacketForTesting(t, conn, sshFxpStat, struct {
+		ID   uint32
+		Path string
+	}{2, "/a.txt"})
+
+	// The stat is answered while the hash is computed.
+	if typ, body := readPacketForTesting(t, conn); typ != sshFxpAttrs || binary.BigEndian.Uint32(body) != 2 {
+		t.Fatalf("Expected the attributes of 2, but %d %v", typ, body)
+	}
+	close(blocking.release)
+	if typ, body := readPacketForTesting(t, conn); typ != sshFxpExtendedReply || binary.BigEndian.Uint32(body) != 1 {
+		t.Errorf("Expected the reply of 1, but %d %v", typ, body)
+	}
+}
+
+func TestOpenSSHExtensions(t *testing.T) {
+	b := NewMemoryBackend(Config{}).WithContainer("c1")
+	b.CreateContainer()
+	upload(t, b, "a.txt", "a")
+	upload(t, b, "b.txt", "b")
+	client := startFakeSftp(t, b)
+
+	if vfs, err := client.StatVFS("/"); err != nil {
+		t.Fatal(err)
+	} else if vfs.Bsize != statVFSBlockSize || vfs.Blocks == 0 || vfs.Namemax != maxObjectNameLength {
+		t.Errorf("Unexpected statvfs %+v", vfs)
+	}
+
+	// Rename fails if the target exists, posix-rename overwrites it.
+	if err := client.Rename("/a.txt", "/b.txt"); err == nil {
+		t.Error("The existing target was overwritten by rename")
+	}
+	if err := client.PosixRename("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(b, "b.txt", 0, 0); err != nil || data != "a" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	if _, err := b.Get("a.txt"); !isNotFound(err) {
+		t.Errorf("The source was not removed: %v", err)
+	}
+
+	// A hard link is a copy.
+	if err := client.Link("/b.txt", "/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(b, "c.txt", 0, 0); err != nil || data != "a" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	if err := client.Link("/none.txt", "/d.txt"); err == nil {
+		t.Error("A link to a missing file was created")
+	}
+}
+
+// statusForTesting reads an SSH_FXP_STATUS packet and returns its code.
+func statusForTesting(t *testing.T, conn net.Conn) uint32 {
+	typ, body := readPacketForTesting(t, conn)
+	if typ != sshFxpStatus {
+		t.Fatalf("Expected a status, but %d", typ)
+	}
+	return binary.BigEndian.Uint32(body[4:])
+}
+
+// openForTesting opens the file with the flags and returns the handle.
+func openForTesting(t *testing.T, conn net.Conn, id uint32, path string, pflags uint32) string {
+	sendPacketForTesting(t, conn, sshFxpOpen, struct {
+		ID     uint32
+		Path   string
+		Pflags uint32
+		Flags  uint32
+	}{id, path, pflags, 0})
+	typ, body := readPacketForTesting(t, conn)
+	var reply struct {
+		ID     uint32
+		Handle string
+	}
+	if typ != sshFxpHandle {
+		t.Fatalf("Couldn't open %s: %d", path, typ)
+	} else if err := ssh.Unmarshal(body, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply.Handle
+}
+
+type copyFileRequest struct {
+	ID        uint32
+	Request   string
+	Source    string
+	Dest      string
+	Overwrite bool
+}
+
+func TestCopyFile(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	c2 := s.WithContainer("c2")
+	c2.CreateContainer()
+	c3 := s.WithContainer("c3")
+	c3.CreateContainer()
+	upload(t, s, "a.txt", "hello")
+	upload(t, s, "b.txt", "existing")
+	upload(t, c2, "x.txt", "from c2")
+	upload(t, c3, "y.txt", "from c3")
+
+	// copies on the server side
+	var copies, downloads int32
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "COPY" || r.Header.Get("X-Copy-From") != "" {
+			atomic.AddInt32(&copies, 1)
+		} else if r.Method == http.MethodGet {
+			atomic.AddInt32(&downloads, 1)
+		}
+		return 0
+	}
+
+	fs := NewSwiftFS(s)
+	fs.SetContainers([]string{"c2"})
+	conn := rawSftpSessionForTesting(t, fs)
+
+	cases := []struct {
+		req      copyFileRequest
+		expected uint32
+	}{
+		{copyFileRequest{1, "copy-file", "/a.txt", "/c.txt", false}, sshFxOk},
+		{copyFileRequest{2, "copy-file", "/a.txt", "/b.txt", false}, sshFxFailure},
+		{copyFileRequest{3, "copy-file", "/a.txt", "/b.txt", true}, sshFxOk},
+		{copyFileRequest{4, "copy-file", "/none.txt", "/d.txt", false}, sshFxNoSuchFile},
+		{copyFileRequest{5, "copy-file", "c2:/x.txt", "/x.txt", false}, sshFxOk},
+		{copyFileRequest{6, "copy-file", "/a.txt", "c2:/dir/a.txt", false}, sshFxOk},
+		{copyFileRequest{7, "copy-file", "c3:/y.txt", "/y.txt", false}, sshFxPermissionDenied},
+		{copyFileRequest{8, "copy-file", "/a.txt", "c3:/a.txt", false}, sshFxPermissionDenied},
+	}
+	for _, tc := range cases {
+		sendPacketForTesting(t, conn, sshFxpExtended, tc.req)
+		if code := statusForTesting(t, conn); code != tc.expected {
+			t.Errorf("%s %s: expected %d, but %d", tc.req.Source, tc.req.Dest, tc.expected, code)
+		}
+	}
+	if c, d := atomic.LoadInt32(&copies), atomic.LoadInt32(&downloads); c != 4 || d != 0 {
+		t.Errorf("Expected 4 copies on the server side, but %d copies and %d downloads", c, d)
+	}
+	f.Fail = nil
+
+	for _, expected := range []struct {
+		b       Backend
+		name    string
+		content string
+	}{
+		{s, "c.txt", "hello"},
+		{s, "b.txt", "hello"},
+		{s, "x.txt", "from c2"},
+		{c2, "dir/a.txt", "hello"},
+	} {
+		if data, err := download(expected.b, expected.name, 0, 0); err != nil || data != expected.content {
+			t.Errorf("Unexpected content of %s %q %v", expected.name, data, err)
+		}
+	}
+	if _, err := s.Get("y.txt"); !isNotFound(err) {
+		t.Error("An object of a container which is not permitted was copied")
+	}
+	if _, err := c3.Get("a.txt"); !isNotFound(err) {
+		t.Error("An object was copied to a container which is not permitted")
+	}
+}
+
+type copyDataRequest struct {
+	ID          uint32
+	Request     string
+	ReadHandle  string
+	ReadOffset  uint64
+	Length      uint64
+	WriteHandle string
+	WriteOffset uint64
+}
+
+func TestCopyData(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	upload(t, s, "a.txt", "hello world")
+	conn := rawSftpForTesting(t, s)
+
+	const (
+		read  = 0x01
+		write = 0x02 | 0x08 | 0x10 // WRITE, CREAT and TRUNC
+	)
+	closeHandle := func(id uint32, handle string) {
+		sendPacketForTesting(t, conn, sshFxpClose, struct {
+			ID     uint32
+			Handle string
+		}{id, handle})
+		if code := statusForTesting(t, conn); code != sshFxOk {
+			t.Errorf("Couldn't close the handle %d: %d", id, code)
+		}
+	}
+
+	// the whole file, and a range to the offset of another file
+	src := openForTesting(t, conn, 1, "/a.txt", read)
+	whole := openForTesting(t, conn, 2, "/b.txt", write)
+	part := openForTesting(t, conn, 3, "/c.txt", write)
+	sendPacketForTesting(t, conn, sshFxpExtended, copyDataRequest{4, "copy-data", src, 0, 0, whole, 0})
+	if code := statusForTesting(t, conn); code != sshFxOk {
+		t.Errorf("Couldn't copy the whole file: %d", code)
+	}
+	sendPacketForTesting(t, conn, sshFxpExtended, copyDataRequest{5, "copy-data", src, 6, 5, part, 0})
+	if code := statusForTesting(t, conn); code != sshFxOk {
+		t.Errorf("Couldn't copy the range: %d", code)
+	}
+	sendPacketForTesting(t, conn, sshFxpExtended, copyDataRequest{6, "copy-data", src, 0, 0, "invalid", 0})
+	if code := statusForTesting(t, conn); code != sshFxFailure {
+		t.Errorf("Expected a failure of an invalid handle, but %d", code)
+	}
+	closeHandle(7, whole)
+	closeHandle(8, part)
+	closeHandle(9, src)
+
+	for name, content := range map[string]string{"b.txt": "hello world", "c.txt": "world"} {
+		if data, err := download(s, name, 0, 0); err != nil || data != content {
+			t.Errorf("Unexpected content of %s %q %v", name, data, err)
+		}
+	}
+}
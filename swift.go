@@ -1,11 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/gophercloud/gophercloud"
@@ -14,27 +19,50 @@ import (
 	"github.com/majewsky/schwift/gopherschwift"
 )
 
+const (
+	// Content type of the objects which mark directories
+	directoryContentType = "application/directory"
+
+	// Segments of large objects are stored in the container with this suffix
+	segmentContainerSuffix = "_segments"
+)
+
 type Swift struct {
 	config     Config
 	container  string
 	authClient *gophercloud.ProviderClient
 
+	// Requests to Swift are retried and suspended by this transport
+	transport *retryTransport
+
 	// Need to be exported
 	SchwiftClient *schwift.Account
 }
 
 func NewSwift(c Config) *Swift {
 	return &Swift{
-		config: c,
+		config:    c,
+		transport: newRetryTransport(c),
 	}
 }
 
 func (s *Swift) Init() (err error) {
-	if err = s.initializeAuthClient(); err != nil {
+	if s.transport.Transport, err = newHTTPTransport(s.config); err != nil {
 		return err
 	}
 
-	swiftClient, err := s.getObjectStorageClient()
+	var swiftClient *gophercloud.ServiceClient
+	switch s.config.AuthType {
+	case authTypeTempAuth:
+		swiftClient, err = s.getTempAuthClient()
+	case authTypeStatic:
+		swiftClient = s.getStaticClient()
+	default:
+		if err = s.initializeAuthClient(); err != nil {
+			return err
+		}
+		swiftClient, err = s.getObjectStorageClient()
+	}
 	if err != nil {
 		return err
 	}
@@ -47,10 +75,33 @@ func (s *Swift) Init() (err error) {
 	return nil
 }
 
+func (s *Swift) Config() Config {
+	return s.config
+}
+
+func (s *Swift) Container() string {
+	return s.container
+}
+
+// WithContainer returns a copy of the client which works on another container.
+func (s *Swift) WithContainer(container string) Backend {
+	c := *s
+	c.container = container
+	return &c
+}
+
 func (s *Swift) setContainer(container string) {
 	s.container = container
 }
 
+// EndpointURL returns the URL of the account.
+func (s *Swift) EndpointURL() string {
+	return s.SchwiftClient.Backend().EndpointURL()
+}
+
+func (s *Swift) AccountName() string {
+	return s.SchwiftClient.Name()
+}
 
 func (s *Swift) getContainer() *schwift.Container {
 	return s.SchwiftClient.Container(s.container)
@@ -60,37 +111,101 @@ func (s *Swift) ExistsContainer() (exists bool, err error) {
 	return s.getContainer().Exists()
 }
 
+// CreateContainer creates the container. If versioning is configured, the
+// prior versions of objects are kept in another container.
 func (s *Swift) CreateContainer() (err error) {
+	if s.config.Versioning {
+		return s.createVersionedContainer()
+	}
 	return s.getContainer().Create(nil)
 }
 
-func (s *Swift) GetObject(path string) *schwift.Object {
-	return s.getContainer().Object(path)
+// Usage returns the bytes used by the container and the quota applied to it.
+// The container quota takes precedence over the account quota. A quota of 0
+// means that no quota is set.
+func (s *Swift) Usage() (used uint64, quota uint64, err error) {
+	if s.container == "" {
+		return s.accountUsage()
+	}
+
+	hdr, err := s.getContainer().Headers()
+	if err != nil {
+		return 0, 0, err
+	}
+	used = hdr.BytesUsed().Get()
+	if hdr.BytesUsedQuota().Exists() {
+		return used, hdr.BytesUsedQuota().Get(), nil
+	}
+
+	ahdr, err := s.SchwiftClient.Headers()
+	if err != nil {
+		return 0, 0, err
+	}
+	if ahdr.BytesUsedQuota().Exists() {
+		// Other containers of the account also consume the account quota.
+		aused := ahdr.BytesUsed().Get()
+		aquota := ahdr.BytesUsedQuota().Get()
+		if aused >= aquota {
+			return used, used, nil
+		}
+		return used, used + (aquota - aused), nil
+	}
+	return used, 0, nil
+}
+
+// accountUsage returns the bytes used by the account and its quota.
+func (s *Swift) accountUsage() (used uint64, quota uint64, err error) {
+	hdr, err := s.SchwiftClient.Headers()
+	if err != nil {
+		return 0, 0, err
+	}
+	if hdr.BytesUsedQuota().Exists() {
+		return hdr.BytesUsed().Get(), hdr.BytesUsedQuota().Get(), nil
+	}
+	return hdr.BytesUsed().Get(), 0, nil
 }
 
-func (s *Swift) CreateDirectory(path string) (err error) {
-	obj := s.getContainer().Object(path)
-	hdr := schwift.NewObjectHeaders()
-	hdr.ContentType().Set("application/directory")
-	opts := hdr.ToOpts() //type *schwift.RequestOptions
+// ListContainers returns all containers of the account.
+func (s *Swift) ListContainers() ([]*SwiftFile, error) {
+	containers, err := s.SchwiftClient.Containers().CollectDetailed()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*SwiftFile, 0, len(containers))
+	for _, c := range containers {
+		list = append(list, &SwiftFile{
+			name:    c.Container.Name() + Delimiter,
+			modtime: c.LastModified,
+		})
+	}
+	return list, nil
+}
 
-	buffer := ""
-	return obj.Upload(bytes.NewReader([]byte(buffer)), nil, opts)
+func (s *Swift) GetObject(path string) *schwift.Object {
+	return s.getContainer().Object(path)
 }
 
 func (fs *Swift) GetFileInfo(f schwift.ObjectInfo) *SwiftFile {
 	var name string
 	if f.Object == nil {
 		name = "/" + f.SubDirectory
+	} else if f.ContentType == directoryContentType && !strings.HasSuffix(f.Object.Name(), "/") {
+		// directory marker without a trailing slash
+		name = "/" + f.Object.Name() + "/"
 	} else {
 		name = "/" + f.Object.Name()
 	}
 
 	file := &SwiftFile{
-		name:    name,
-		size:    int64(f.SizeBytes),
-		modtime: f.LastModified,
-		symlink: "",
+		name:        name,
+		size:        int64(f.SizeBytes),
+		modtime:     f.LastModified,
+		symlink:     "",
+		contentType: f.ContentType,
+	}
+	if f.SymlinkTarget != nil {
+		file.symlink = f.SymlinkTarget.FullName()
 	}
 	return file
 }
@@ -103,7 +218,54 @@ func (fs *Swift) GetFileInfos(files []schwift.ObjectInfo) []os.FileInfo {
 	return list
 }
 
-func (s *Swift) ListDirectory(path string) ([]schwift.ObjectInfo, error) {
+// ListDirectory returns a lister of the entries of the directory.
+func (s *Swift) ListDirectory(path string) DirectoryLister {
+	iter, prefix := s.directoryIterator(path)
+	return &swiftLister{swift: s, iter: iter, prefix: prefix, dirs: map[string]bool{}}
+}
+
+// swiftLister lists a directory with the marker of Swift.
+type swiftLister struct {
+	swift  *Swift
+	iter   *schwift.ObjectIterator
+	prefix string
+	dirs   map[string]bool // names of the directories listed so far
+}
+
+func (l *swiftLister) NextPage(limit int) ([]*SwiftFile, error) {
+	for {
+		objs, err := l.iter.NextPageDetailed(limit)
+		if err != nil || len(objs) == 0 {
+			return nil, err
+		}
+
+		page := make([]*SwiftFile, 0, len(objs))
+		for _, oi := range objs {
+			// skip the directory itself
+			if oi.Object != nil && oi.Object.Name() == l.prefix {
+				continue
+			}
+
+			// A marker object "dir" and the subdirectory "dir/" are the same
+			// directory. Names like "dir.txt" may come between them.
+			f := l.swift.GetFileInfo(oi)
+			if f.IsDir() {
+				if l.dirs[f.name] {
+					continue
+				}
+				l.dirs[f.name] = true
+			}
+			page = append(page, f)
+		}
+		if len(page) > 0 {
+			return page, nil
+		}
+	}
+}
+
+// directoryIterator returns an iterator over the entries of the directory and
+// the prefix of the directory.
+func (s *Swift) directoryIterator(path string) (*schwift.ObjectIterator, string) {
 	iter := s.getContainer().Objects()
 	if path != "" {
 		// Directories in swift end always with /
@@ -113,14 +275,19 @@ func (s *Swift) ListDirectory(path string) ([]schwift.ObjectInfo, error) {
 		iter.Prefix = path
 	}
 	iter.Delimiter = "/"
-	ls := make([]schwift.ObjectInfo, 0)
-	err := iter.ForeachDetailed(func(oi schwift.ObjectInfo) error {
-		if oi.Object == nil || oi.Object.Name() != path {
-			ls = append(ls, oi)
-		}
-		return nil
-	})
-	return ls, err
+	return iter, path
+}
+
+// FirstInDirectory returns the first object under the directory including its
+// marker object, or nil if there is none.
+func (s *Swift) FirstInDirectory(path string) (*SwiftFile, error) {
+	iter := s.getContainer().Objects()
+	iter.Prefix = strings.TrimSuffix(path, "/") + "/"
+	objs, err := iter.NextPageDetailed(1)
+	if err != nil || len(objs) == 0 {
+		return nil, err
+	}
+	return s.GetFileInfo(objs[0]), nil
 }
 
 func (s *Swift) List() ([]*schwift.Object, error) {
@@ -131,6 +298,34 @@ func (s *Swift) Get(name string) (schwift.ObjectHeaders, error) {
 	return s.getContainer().Object(name).Headers()
 }
 
+// GetLink returns the headers of the object without following a symlink. If
+// the object is a symlink, the full name of its target is returned too.
+func (s *Swift) GetLink(name string) (schwift.ObjectHeaders, string, error) {
+	hdr, target, err := s.getContainer().Object(name).SymlinkHeaders()
+	if err != nil || target == nil {
+		return hdr, "", err
+	}
+	return hdr, target.FullName(), nil
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+func isDirectoryMarker(hdr schwift.ObjectHeaders) bool {
+	return hdr.ContentType().Get() == directoryContentType
+}
+
+func isLargeObject(hdr schwift.ObjectHeaders) bool {
+	return strings.EqualFold(hdr.Get("X-Static-Large-Object"), "true") || hdr.Get("X-Object-Manifest") != ""
+}
+
 func (s *Swift) Download(name string) (content io.ReadCloser, size int64, err error) {
 	o := s.getContainer().Object(name)
 	hs, err := o.Headers()
@@ -146,23 +341,158 @@ func (s *Swift) Download(name string) (content io.ReadCloser, size int64, err er
 	return rs, int64(hs.SizeBytes().Get()), nil
 }
 
+// DownloadRange downloads length bytes of the object starting at offset. If
+// length is 0, the object is downloaded until the end.
+func (s *Swift) DownloadRange(name string, offset, length int64) (content io.ReadCloser, err error) {
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := schwift.Request{
+		Method:        "GET",
+		ContainerName: s.container,
+		ObjectName:    name,
+		Options: &schwift.RequestOptions{
+			Headers: schwift.Headers{"Range": rng},
+		},
+		ExpectStatusCodes: []int{200, 206},
+	}.Do(s.SchwiftClient.Backend())
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
 func (s *Swift) Put(name string, content io.Reader) error {
 	return s.getContainer().Object(name).Upload(content, nil, nil)
 }
 
+// Upload replaces the object. The segments of a large object are deleted.
+func (s *Swift) Upload(name string, content io.Reader, hdr schwift.ObjectHeaders) error {
+	return s.getContainer().Object(name).Upload(content, &schwift.UploadOptions{DeleteSegments: true}, hdr.ToOpts())
+}
+
+// SetMetadata replaces the metadata of the object.
+func (s *Swift) SetMetadata(name string, hdr schwift.ObjectHeaders) error {
+	return s.getContainer().Object(name).Update(hdr, nil)
+}
+
 func (s *Swift) Delete(name string) error {
 	return s.getContainer().Object(name).Delete(nil, nil)
 }
 
+// DeleteWithSegments deletes the object and the segments of a large object.
+func (s *Swift) DeleteWithSegments(name string) error {
+	return s.getContainer().Object(name).Delete(&schwift.DeleteOptions{DeleteSegments: true}, nil)
+}
+
+// NewLargeObject returns a new static large object whose segments are stored
+// in the segment container. The segments of an existing large object are
+// deleted.
+func (s *Swift) NewLargeObject(name string) (*schwift.LargeObject, error) {
+	sc, err := s.segmentContainer()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetObject(name).AsNewLargeObject(schwift.SegmentingOptions{
+		Strategy:         schwift.StaticLargeObject,
+		SegmentContainer: sc,
+	}, &schwift.TruncateOptions{DeleteSegments: true})
+}
+
+// LargeObject returns the existing large object, or schwift.ErrNotLarge for a
+// regular object.
+func (s *Swift) LargeObject(name string) (*schwift.LargeObject, error) {
+	return s.GetObject(name).AsLargeObject()
+}
+
+// AppendableObject returns the object as a large object to append segments to.
+// A regular object is copied to the first segment of a new static large
+// object.
+func (s *Swift) AppendableObject(name string) (*schwift.LargeObject, error) {
+	obj := s.GetObject(name)
+	lo, err := obj.AsLargeObject()
+	if err != schwift.ErrNotLarge {
+		return lo, err
+	}
+
+	sc, err := s.segmentContainer()
+	if err != nil {
+		return nil, err
+	}
+	lo, err = obj.AsNewLargeObject(schwift.SegmentingOptions{
+		Strategy:         schwift.StaticLargeObject,
+		SegmentContainer: sc,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	first := lo.NextSegmentObject()
+	if err = obj.CopyTo(first, nil, nil); err != nil {
+		return nil, err
+	}
+	hdr, err := first.Headers()
+	if err != nil {
+		return nil, err
+	}
+	return lo, lo.AddSegment(schwift.SegmentInfo{
+		Object:    first,
+		SizeBytes: hdr.SizeBytes().Get(),
+		Etag:      strings.Trim(hdr.Etag().Get(), `"`),
+	})
+}
+
+// segmentContainer returns the container for the segments of large objects,
+// and creates it if it doesn't exist.
+func (s *Swift) segmentContainer() (*schwift.Container, error) {
+	return s.SchwiftClient.Container(s.container + segmentContainerSuffix).EnsureExists()
+}
+
+// Copy copies the object on the server side.
+func (s *Swift) Copy(srcName, destName string) error {
+	return s.CopyTo(srcName, s, destName, schwift.NewObjectHeaders())
+}
+
+// CopyTo copies the object to the container of dest on the server side if
+// dest is Swift too.
+func (s *Swift) CopyTo(srcName string, dest Backend, destName string, hdr schwift.ObjectHeaders) error {
+	d, ok := dest.(*Swift)
+	if !ok {
+		return copyObject(s, srcName, dest, destName, hdr)
+	}
+	return s.getContainer().Object(srcName).CopyTo(d.getContainer().Object(destName), nil, hdr.ToOpts())
+}
+
 func (s *Swift) Rename(oldName, newName string) error {
-	dest := fmt.Sprintf("%s%s%s", s.container, Delimiter, newName)
-	oldObject := s.getContainer().Object(oldName)
-	newObject := s.getContainer().Object(dest)
+	return s.MoveTo(oldName, s, newName)
+}
+
+// MoveTo moves the object to the container of dest. Only the manifest of a
+// large object is moved, its segments stay where they are.
+func (s *Swift) MoveTo(srcName string, dest Backend, destName string) error {
+	d, ok := dest.(*Swift)
+	if !ok {
+		if err := copyObject(s, srcName, dest, destName, schwift.NewObjectHeaders()); err != nil {
+			return err
+		}
+		return s.DeleteWithSegments(srcName)
+	}
 
-	if err := oldObject.CopyTo(newObject, nil, nil); err != nil {
+	hdr, err := s.Get(srcName)
+	if err != nil {
 		return err
 	}
-	return s.Delete(oldName)
+
+	opts := schwift.RequestOptions{Values: url.Values{}}
+	if isLargeObject(hdr) {
+		opts.Values.Set("multipart-manifest", "get")
+	}
+	src := s.getContainer().Object(srcName)
+	if err = src.CopyTo(d.getContainer().Object(destName), nil, &opts); err != nil {
+		return err
+	}
+	return s.Delete(srcName)
 }
 
 func (s *Swift) getObjectStorageClient() (*gophercloud.ServiceClient, error) {
@@ -170,7 +500,15 @@ func (s *Swift) getObjectStorageClient() (*gophercloud.ServiceClient, error) {
 		return nil, errors.New("Auth client must be initialized in advance")
 	}
 
-	opts := gophercloud.EndpointOpts{}
+	if s.config.OsSwiftURL != "" {
+		return s.serviceClient(s.config.OsSwiftURL), nil
+	}
+
+	availability, err := endpointAvailability(s.config.OsInterface)
+	if err != nil {
+		return nil, err
+	}
+	opts := gophercloud.EndpointOpts{Availability: availability}
 	if s.config.OsRegion != "" {
 		opts.Region = s.config.OsRegion
 	}
@@ -178,30 +516,82 @@ func (s *Swift) getObjectStorageClient() (*gophercloud.ServiceClient, error) {
 	return openstack.NewObjectStorageV1(s.authClient, opts)
 }
 
+// serviceClient returns the client of the Swift endpoint.
+func (s *Swift) serviceClient(endpoint string) *gophercloud.ServiceClient {
+	return &gophercloud.ServiceClient{
+		ProviderClient: s.authClient,
+		Endpoint:       gophercloud.NormalizeURL(endpoint),
+		Type:           "object-store",
+	}
+}
+
 func (s *Swift) initializeAuthClient() error {
-	var (
-		err  error
-		opts gophercloud.AuthOptions
-	)
-
-	if (s.config.OsUsername != "") && s.config.OsPassword != "" {
-		opts = gophercloud.AuthOptions{
-			IdentityEndpoint: s.config.OsIdentityEndpoint,
-			Username:         s.config.OsUsername,
-			Password:         s.config.OsPassword,
-			DomainName:       s.config.OsUserDomainName,
-			Scope: &gophercloud.AuthScope{
-				ProjectName: s.config.OsProjectName,
-				DomainName:  s.config.OsProjectDomainName,
-			},
-
-			AllowReauth: true,
-		}
+	opts, err := s.authOptions()
+	if err != nil {
+		return err
+	}
 
-	} else if opts, err = openstack.AuthOptionsFromEnv(); err != nil {
+	s.authClient, err = openstack.NewClient(opts.IdentityEndpoint)
+	if err != nil {
 		return err
 	}
+	s.authClient.HTTPClient = http.Client{Transport: s.transport}
+
+	return openstack.Authenticate(s.authClient, opts)
+}
+
+// authOptions returns the credentials in the configuration, or those in the
+// environment variables if none are configured. Application credentials take
+// precedence over a token, and a token over a password.
+func (s *Swift) authOptions() (gophercloud.AuthOptions, error) {
+	c := s.config
+	if !c.hasOsCredentials() {
+		return openstack.AuthOptionsFromEnv()
+	}
 
-	s.authClient, err = openstack.AuthenticatedClient(opts)
-	return err
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: c.OsIdentityEndpoint,
+		AllowReauth:      true,
+	}
+
+	switch {
+	case c.OsApplicationCredentialID != "" || c.OsApplicationCredentialName != "":
+		// The project is given by the application credential. A name is
+		// unique only for its user.
+		opts.ApplicationCredentialID = c.OsApplicationCredentialID
+		opts.ApplicationCredentialName = c.OsApplicationCredentialName
+		opts.ApplicationCredentialSecret = c.OsApplicationCredentialSecret
+		if opts.ApplicationCredentialID == "" {
+			opts.UserID = c.OsUserID
+			opts.Username = c.OsUsername
+			opts.DomainID = c.OsUserDomainID
+			opts.DomainName = c.OsUserDomainName
+		}
+		return opts, nil
+
+	case c.OsToken != "":
+		// A token can't be issued again when it expires.
+		opts.TokenID = c.OsToken
+		opts.AllowReauth = false
+
+	default:
+		opts.UserID = c.OsUserID
+		opts.Username = c.OsUsername
+		opts.Password = c.OsPassword
+		if opts.UserID == "" {
+			opts.DomainID = c.OsUserDomainID
+			opts.DomainName = c.OsUserDomainName
+		}
+	}
+
+	if c.OsProjectID != "" {
+		opts.Scope = &gophercloud.AuthScope{ProjectID: c.OsProjectID}
+	} else if c.OsProjectName != "" {
+		opts.Scope = &gophercloud.AuthScope{
+			ProjectName: c.OsProjectName,
+			DomainID:    c.OsProjectDomainID,
+			DomainName:  c.OsProjectDomainName,
+		}
+	}
+	return opts, nil
 }
@@ -5,6 +5,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/majewsky/schwift"
 )
 
 // SwiftFile implements os.FileInfo interfaces.
@@ -15,6 +17,11 @@ type SwiftFile struct {
 	modtime time.Time
 	symlink string
 
+	// Headers of the object if it was stat'ed. Entries of listings have none.
+	hdr schwift.ObjectHeaders
+	// Content type of the object in a listing
+	contentType string
+
 	tmpFile *os.File
 }
 
@@ -1,37 +1,65 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/majewsky/schwift"
 	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	Delimiter = "/" // Delimiter is used to split object names.
+
+	listPageSize        = 1000 // objects fetched at once for listing a directory
+	statVFSBlockSize    = 4096
+	maxObjectNameLength = 1024
+	unlimitedQuota      = 1 << 50 // reported as free space if there is no quota
+
+	// Prefixes of hidden objects. Atomic uploads are written to a temporary
+	// object first, and files with a partial suffix are stored under a hidden
+	// name until they are renamed.
+	uploadPrefix  = ".swift-sftp-upload-"
+	partialPrefix = ".swift-sftp-partial-"
 )
 
-// SwiftFS implements sftp.Handlers interface.
+// SwiftFS implements sftp.Handlers interface. The handlers are called
+// concurrently; the fields other than writers and attrs are not modified after
+// the session is set up, and the cache locks itself.
 type SwiftFS struct {
 	log *logrus.Entry
 
-	lock         sync.Mutex
-	swift        *Swift
-	waitReadings []*SwiftFile
-	waitWritings []*SwiftFile
+	swift      Backend
+	user       string
+	containers []string
+	multi      bool // multi-container mode
+	cache      *metaCache
+
+	// Files opened for writing, by path
+	writersLock sync.Mutex
+	writers     map[string]*swiftWriter
+
+	// Extended attributes loaded by the stat handlers for the responses sent
+	// by extensionChannel, by path in the order of the requests
+	attrsLock sync.Mutex
+	attrs     map[string][][]sftp.StatExtended
 }
 
-func NewSwiftFS(s *Swift) *SwiftFS {
+func NewSwiftFS(s Backend) *SwiftFS {
 	fs := &SwiftFS{
-		log:   log,
-		swift: s,
+		log:     log,
+		swift:   s,
+		multi:   s.Config().MultiContainer,
+		cache:   newMetaCache(s.Config()),
+		writers: map[string]*swiftWriter{},
+		attrs:   map[string][][]sftp.StatExtended{},
 	}
 
 	return fs
@@ -41,11 +69,20 @@ func (fs *SwiftFS) SetLogger(clog *logrus.Entry) {
 	fs.log = clog
 }
 
-func (fs *SwiftFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+// SetUser sets the user of the session, to whom the expiry rules apply.
+func (fs *SwiftFS) SetUser(user string) {
+	fs.user = user
+}
+
+// SetContainers sets the containers which may be accessed besides the
+// container of the session. In multi-container mode, these are the containers
+// listed in "/". "*" permits all containers.
+func (fs *SwiftFS) SetContainers(containers []string) {
+	fs.containers = containers
+}
 
-	f, err := fs.lookup(r.Filepath)
+func (fs *SwiftFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	s, f, err := fs.lookup(r.Filepath)
 	if err != nil || f == nil {
 		fs.log.Infof("%s %s", r.Method, r.Filepath)
 
@@ -64,13 +101,13 @@ func (fs *SwiftFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 
 	reader := &swiftReader{
 		log:     fs.log,
-		swift:   fs.swift,
+		swift:   s,
 		sf:      f,
-		timeout: time.Duration(fs.swift.config.SwiftTimeout) * time.Second,
+		timeout: time.Duration(fs.swift.Config().SwiftTimeout) * time.Second,
 
 		afterClosed: func(r *swiftReader) {
-			if r.downloadErr != nil {
-				fs.log.Infof("Faild to transfer '%s' [%s]", f.Name(), r.downloadErr)
+			if err := r.Err(); err != nil {
+				fs.log.Infof("Faild to transfer '%s' [%s]", f.Name(), err)
 			} else {
 				fs.log.Infof("'%s' was successfully transferred", f.Name())
 			}
@@ -90,24 +127,56 @@ func (fs *SwiftFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 }
 
 func (fs *SwiftFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-
 	fs.log.Infof("%s %s", r.Method, r.Filepath)
 
+	s, name, err := fs.object(r.Filepath)
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return nil, err
+	} else if s == nil || name == "" {
+		// No files in the root of multi-container mode
+		fs.log.Warnf("%s Couldn't create a file here", r.Filepath)
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+
 	f := &SwiftFile{
-		name:    r.Filepath[1:], // strip slash
+		name:    name,
 		size:    0,
 		modtime: time.Now(),
 		symlink: "",
 	}
 
+	// Opening without truncation continues the existing object, like reput.
+	// It is appended to only if the first write is not at the beginning, or
+	// for SSH_FXF_APPEND.
+	var appendSize int64
+	flags := r.Pflags()
+	if flags.Append || !flags.Trunc {
+		if cur, err := fs.statObject(s, name); err == nil && !cur.IsDir() {
+			appendSize = cur.Size()
+		}
+	}
+
 	writer := &swiftWriter{
-		log:     fs.log,
-		swift:   fs.swift,
-		sf:      f,
-		timeout: time.Duration(fs.swift.config.SwiftTimeout) * time.Second,
+		log:        fs.log,
+		swift:      s,
+		sf:         f,
+		timeout:    time.Duration(fs.swift.Config().SwiftTimeout) * time.Second,
+		atomic:     fs.swift.Config().AtomicUpload,
+		hashSHA256: fs.swift.Config().ChecksumSHA256,
+
+		segmentSize: int64(fs.swift.Config().SegmentSize) * 1024 * 1024,
+		appendSize:  appendSize,
+		appendOnly:  flags.Append,
+		expiry:      expiryHeaders(fs.swift.Config(), fs.user, r.Filepath, time.Now()),
 		afterClosed: func(w *swiftWriter) {
+			fs.writersLock.Lock()
+			if fs.writers[r.Filepath] == w {
+				delete(fs.writers, r.Filepath)
+			}
+			fs.writersLock.Unlock()
+			fs.cache.invalidate(s.Container(), name)
+
 			if w.uploadErr != nil {
 				fs.log.Infof("Failed to transfer '%s' [%s]", f.Name(), w.uploadErr)
 			} else {
@@ -123,15 +192,16 @@ func (fs *SwiftFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSshFxFailure
 	}
 
+	fs.writersLock.Lock()
+	fs.writers[r.Filepath] = writer
+	fs.writersLock.Unlock()
+
 	fs.log.Infof("Transferring %s ...", r.Filepath)
 
 	return writer, nil
 }
 
 func (fs *SwiftFS) Filecmd(r *sftp.Request) error {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-
 	if r.Target != "" {
 		fs.log.Infof("%s %s %s", r.Method, r.Filepath, r.Target)
 	} else {
@@ -140,44 +210,122 @@ func (fs *SwiftFS) Filecmd(r *sftp.Request) error {
 
 	switch r.Method {
 	case "Rename":
-		f, err := fs.lookup(r.Filepath)
+		return fs.rename(r, false)
+
+	case "Link":
+		// Hard links are emulated with a server-side copy.
+		s, f, err := fs.lookup(r.Filepath)
 		if err != nil {
 			fs.log.Warnf("%s %s", r.Filepath, err.Error())
 			return sftp.ErrSshFxNoSuchFile
 		}
 
-		tf := SwiftFile{
-			name: r.Target,
-		}
-		target := &SwiftFile{
-			name:    tf.Name(),
-			size:    0,
-			modtime: time.Now(),
-			symlink: "",
+		ts, target, err := fs.object(r.Target)
+		if err != nil {
+			fs.log.Warnf("%s %s", r.Target, err.Error())
+			return err
+		} else if ts == nil || target == "" {
+			fs.log.Warnf("%s Couldn't create a file here", r.Target)
+			return sftp.ErrSshFxPermissionDenied
 		}
 
-		return fs.swift.Rename(f.Name(), target.Name())
+		defer fs.cache.invalidate(ts.Container(), target)
+		if err = s.CopyTo(f.name, ts, target, schwift.NewObjectHeaders()); err != nil {
+			fs.log.Warnf("%s %s", r.Target, err.Error())
+			return sftp.ErrSshFxFailure
+		}
+		if err = fs.applyExpiry(ts, target); err != nil {
+			fs.log.Warnf("%s %s", r.Target, err.Error())
+			return sftp.ErrSshFxFailure
+		}
 
 	case "Remove":
-		f, err := fs.lookup(r.Filepath)
+		if _, v := fs.version(r.Filepath); v != nil {
+			fs.log.Warnf("%s Couldn't remove a version", r.Filepath)
+			return sftp.ErrSshFxPermissionDenied
+		}
+
+		s, f, err := fs.lookup(r.Filepath)
+		if err != nil {
+			fs.log.Warnf("%s %s", r.Filepath, err.Error())
+			return sftp.ErrSshFxNoSuchFile
+		}
+
+		defer fs.cache.invalidate(s.Container(), f.name)
+		if fs.swift.Config().Trash && !isTrashed(f.Abs()) {
+			err = fs.moveToTrash(s, f.Abs())
+		} else {
+			err = s.DeleteWithSegments(f.Abs())
+		}
+		if err != nil {
+			fs.log.Warnf("%s %s", r.Filepath, err.Error())
+			return sftp.ErrSshFxFailure
+		}
+
+	case "Rmdir":
+		s, name, err := fs.object(r.Filepath)
+		if err != nil {
+			fs.log.Warnf("%s %s", r.Filepath, err.Error())
+			return err
+		} else if s == nil || name == "" {
+			fs.log.Warnf("%s Couldn't remove a container", r.Filepath)
+			return sftp.ErrSshFxPermissionDenied
+		}
+
+		f, err := fs.statObject(s, name)
 		if err != nil {
 			fs.log.Warnf("%s %s", r.Filepath, err.Error())
 			return sftp.ErrSshFxNoSuchFile
+		} else if !f.IsDir() {
+			fs.log.Warnf("%s Not a directory", r.Filepath)
+			return sftp.ErrSshFxFailure
 		}
 
-		err = fs.swift.Delete(f.Abs())
+		empty, err := isEmptyDirectory(s, name)
 		if err != nil {
 			fs.log.Warnf("%s %s", r.Filepath, err.Error())
 			return sftp.ErrSshFxFailure
+		} else if !empty {
+			fs.log.Warnf("%s Directory not empty", r.Filepath)
+			return sftp.ErrSshFxFailure
+		}
+
+		defer fs.cache.invalidate(s.Container(), name)
+		if err = deleteDirectory(s, name); err != nil {
+			fs.log.Warnf("%s %s", r.Filepath, err.Error())
+			return sftp.ErrSshFxFailure
 		}
 
 	case "Mkdir":
+		s, name, err := fs.object(r.Filepath)
+		if err != nil {
+			fs.log.Warnf("%s %s", r.Filepath, err.Error())
+			return err
+		} else if s == nil {
+			fs.log.Warnf("%s already exists", r.Filepath)
+			return sftp.ErrSshFxFailure
+		}
+
+		if name == "" {
+			// A directory in the root of multi-container mode is a container.
+			fs.log.Infof("Creating container %s ...", s.Container())
+			if err = s.CreateContainer(); err != nil {
+				fs.log.Warnf("%s %s", r.Filepath, err.Error())
+				return sftp.ErrSshFxFailure
+			}
+			break
+		}
+
 		fs.log.Infof("Creating directory %s ...", r.Filepath)
-		if err := fs.swift.CreateDirectory(r.Filepath[1:] + "/"); err != nil {
+		defer fs.cache.invalidate(s.Container(), name)
+		if err = createDirectory(s, name+"/"); err != nil {
 			fs.log.Warnf("%s %s", r.Filepath, err.Error())
 			return sftp.ErrSshFxFailure
 		}
 
+	case "Setstat":
+		return fs.setAttributes(r)
+
 	default:
 		fs.log.Warnf("Unsupported operation (method=%s, target=%s)", r.Method, r.Target)
 		return sftp.ErrSshFxOpUnsupported
@@ -185,117 +333,669 @@ func (fs *SwiftFS) Filecmd(r *sftp.Request) error {
 	return nil
 }
 
-func (fs *SwiftFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+// PosixRename implements sftp.PosixRenameFileCmder. Unlike Rename, an existing
+// target is overwritten.
+func (fs *SwiftFS) PosixRename(r *sftp.Request) error {
+	fs.log.Infof("%s %s %s", r.Method, r.Filepath, r.Target)
+
+	return fs.rename(r, true)
+}
+
+func (fs *SwiftFS) rename(r *sftp.Request, overwrite bool) error {
+	s, f, err := fs.lookup(r.Filepath)
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return sftp.ErrSshFxNoSuchFile
+	}
+
+	ts, target, err := fs.object(r.Target)
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Target, err.Error())
+		return err
+	} else if ts == nil || target == "" {
+		fs.log.Warnf("%s Couldn't create a file here", r.Target)
+		return sftp.ErrSshFxPermissionDenied
+	}
+
+	// Renaming a version restores it. The version is copied, and the file
+	// it replaces is kept as another version.
+	_, v := fs.version(r.Filepath)
+	if v != nil && v.version == "" {
+		fs.log.Warnf("%s Couldn't rename a versions directory", r.Filepath)
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if !overwrite && v == nil {
+		if _, err = ts.Get(target); err == nil {
+			fs.log.Warnf("%s already exists", r.Target)
+			return sftp.ErrSshFxFailure
+		}
+	}
+
+	defer fs.cache.invalidate(s.Container(), f.name)
+	defer fs.cache.invalidate(ts.Container(), target)
+	if v != nil {
+		err = s.CopyTo(f.name, ts, target, schwift.NewObjectHeaders())
+	} else {
+		err = s.MoveTo(f.name, ts, target)
+	}
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return sftp.ErrSshFxFailure
+	}
+
+	// A file moved out of the trash expires like a new file there. A file in
+	// the trash keeps its expiry.
+	if !isTrashed(target) {
+		if err = fs.applyExpiry(ts, target); err != nil {
+			fs.log.Warnf("%s %s", r.Target, err.Error())
+			return sftp.ErrSshFxFailure
+		}
+	}
+	return nil
+}
 
+// StatVFS implements sftp.StatVFSFileCmder. The capacity is reported from the
+// quota of the container or the account.
+func (fs *SwiftFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	fs.log.Infof("%s %s", r.Method, r.Filepath)
+
+	s, _, err := fs.object(r.Filepath)
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return nil, err
+	} else if s == nil {
+		// the account in the root of multi-container mode
+		s = fs.swift
+	}
+
+	used, quota, err := s.Usage()
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return nil, sftp.ErrSshFxFailure
+	}
+	if quota == 0 {
+		quota = used + unlimitedQuota
+	} else if quota < used {
+		quota = used
+	}
+
+	return &sftp.StatVFS{
+		Bsize:   statVFSBlockSize,
+		Frsize:  statVFSBlockSize,
+		Blocks:  quota / statVFSBlockSize,
+		Bfree:   (quota - used) / statVFSBlockSize,
+		Bavail:  (quota - used) / statVFSBlockSize,
+		Namemax: maxObjectNameLength,
+	}, nil
+}
+
+// CheckFile returns the hash of the file for the first supported algorithm of
+// algorithms. If blockSize is not 0, a hash for each block is returned.
+func (fs *SwiftFS) CheckFile(filepath string, algorithms []string, offset, length int64, blockSize int64) (algorithm string, hashes []byte, err error) {
+	fs.log.Infof("CheckFile %s %v", filepath, algorithms)
+
+	for _, a := range algorithms {
+		if a == "md5" || a == "sha256" {
+			algorithm = a
+			break
+		}
+	}
+	if algorithm == "" {
+		return "", nil, sftp.ErrSshFxOpUnsupported
+	}
+
+	s, f, err := fs.lookup(filepath)
+	if err != nil {
+		fs.log.Warnf("%s %s", filepath, err.Error())
+		return "", nil, sftp.ErrSshFxNoSuchFile
+	}
+	if offset < 0 || offset > f.Size() {
+		fs.log.Warnf("%s Offset %d is beyond the end of the file", filepath, offset)
+		return "", nil, sftp.ErrSshFxFailure
+	}
+	if length == 0 || offset+length > f.Size() {
+		length = f.Size() - offset
+	}
+
+	// The whole file in one block is answered from the ETag or the metadata.
+	if offset == 0 && length == f.Size() && (blockSize == 0 || blockSize >= length) {
+		sum, err := checksum(s, f.name, algorithm)
+		if err != nil {
+			fs.log.Warnf("%s %s", filepath, err.Error())
+			return "", nil, sftp.ErrSshFxFailure
+		}
+		hashes, err = hex.DecodeString(sum)
+		if err != nil {
+			fs.log.Warnf("%s %s", filepath, err.Error())
+			return "", nil, sftp.ErrSshFxFailure
+		}
+		return algorithm, hashes, nil
+	}
+
+	body, err := s.DownloadRange(f.name, offset, length)
+	if err != nil {
+		fs.log.Warnf("%s %s", filepath, err.Error())
+		return "", nil, sftp.ErrSshFxFailure
+	}
+	defer body.Close()
+
+	if blockSize == 0 {
+		blockSize = length
+	}
+	for remaining := length; remaining > 0; remaining -= blockSize {
+		n := blockSize
+		if remaining < n {
+			n = remaining
+		}
+		h := newHash(algorithm)
+		if _, err = io.CopyN(h, body, n); err != nil {
+			fs.log.Warnf("%s %s", filepath, err.Error())
+			return "", nil, sftp.ErrSshFxFailure
+		}
+		hashes = h.Sum(hashes)
+	}
+	return algorithm, hashes, nil
+}
+
+// CopyFile copies the file on the server side. The paths may refer to other
+// permitted containers like "container:/path".
+func (fs *SwiftFS) CopyFile(src, dest string, overwrite bool) error {
+	fs.log.Infof("Copy %s %s", src, dest)
+
+	srcSwift, srcName, err := fs.resolve(src)
+	if err != nil {
+		fs.log.Warnf("%s %s", src, err.Error())
+		return err
+	}
+	destSwift, destName, err := fs.resolve(dest)
+	if err != nil {
+		fs.log.Warnf("%s %s", dest, err.Error())
+		return err
+	}
+	if srcSwift == nil || destSwift == nil {
+		fs.log.Warnf("%s %s is not a file", src, dest)
+		return sftp.ErrSshFxFailure
+	}
+
+	if _, err = srcSwift.Get(srcName); err != nil {
+		fs.log.Warnf("%s %s", src, err.Error())
+		return sftp.ErrSshFxNoSuchFile
+	}
+	if !overwrite {
+		if _, err = destSwift.Get(destName); err == nil {
+			fs.log.Warnf("%s already exists", dest)
+			return sftp.ErrSshFxFailure
+		}
+	}
+
+	defer fs.cache.invalidate(destSwift.Container(), destName)
+	if err = srcSwift.CopyTo(srcName, destSwift, destName, schwift.NewObjectHeaders()); err != nil {
+		fs.log.Warnf("%s %s", dest, err.Error())
+		if isForbidden(err) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		return sftp.ErrSshFxFailure
+	}
+	if err = fs.applyExpiry(destSwift, destName); err != nil {
+		fs.log.Warnf("%s %s", dest, err.Error())
+		return sftp.ErrSshFxFailure
+	}
+	return nil
+}
+
+// CopyData copies length bytes of src starting at srcOffset to the file dest
+// opened for writing. Copying a whole file to a new file happens on the server
+// side when the file is closed.
+func (fs *SwiftFS) CopyData(src string, srcOffset, length int64, dest string, destOffset int64) error {
+	fs.log.Infof("CopyData %s %s", src, dest)
+
+	fs.writersLock.Lock()
+	w, ok := fs.writers[dest]
+	fs.writersLock.Unlock()
+	if !ok {
+		fs.log.Warnf("%s is not opened for writing", dest)
+		return sftp.ErrSshFxFailure
+	}
+
+	srcSwift, srcName, err := fs.resolve(src)
+	if err != nil {
+		fs.log.Warnf("%s %s", src, err.Error())
+		return err
+	} else if srcSwift == nil {
+		fs.log.Warnf("%s is not a file", src)
+		return sftp.ErrSshFxFailure
+	}
+
+	if err = w.CopyFrom(srcSwift, srcName, srcOffset, length, destOffset); err != nil {
+		fs.log.Warnf("%s %s", src, err.Error())
+		return sftp.ErrSshFxFailure
+	}
+	return nil
+}
+
+// resolve returns the client of the container and the object name for a path.
+// A path like "container:/path" refers to a container set by SetContainers.
+func (fs *SwiftFS) resolve(p string) (Backend, string, error) {
+	container, p := splitContainerPath(p)
+	if container == "" {
+		return fs.object(fs.RealPath(p))
+	}
+
+	if !fs.permitted(container) {
+		return nil, "", sftp.ErrSshFxPermissionDenied
+	}
+	s := fs.swift.WithContainer(container)
+	name := fs.filepath2object(cleanRequestPath(p))
+	if fs.versionPath(s, name) != nil {
+		return nil, "", sftp.ErrSshFxPermissionDenied
+	}
+	return s, fs.partialName(name), nil
+}
+
+// object returns the client of the container and the object name for a path.
+// In multi-container mode, the first element of the path is the container, and
+// the client is nil for the root. Versions directories are read-only.
+func (fs *SwiftFS) object(p string) (Backend, string, error) {
+	s, name, err := fs.container(p)
+	if err != nil || s == nil {
+		return s, name, err
+	} else if fs.versionPath(s, name) != nil {
+		return nil, "", sftp.ErrSshFxPermissionDenied
+	}
+	return s, fs.partialName(name), nil
+}
+
+// container is like object, but returns the name of the path as it is.
+func (fs *SwiftFS) container(p string) (Backend, string, error) {
+	name := fs.filepath2object(p)
+	if !fs.multi {
+		return fs.swift, name, nil
+	} else if name == "" {
+		return nil, "", nil
+	}
+
+	container := name
+	name = ""
+	if pos := strings.Index(container, Delimiter); pos >= 0 {
+		container, name = container[:pos], container[pos+1:]
+	}
+	if !fs.permitted(container) {
+		return nil, "", sftp.ErrSshFxPermissionDenied
+	}
+	return fs.swift.WithContainer(container), name, nil
+}
+
+// partialName returns the hidden object name for a file with a partial suffix,
+// otherwise the name as it is.
+func (fs *SwiftFS) partialName(name string) string {
+	base := path.Base(name)
+	for _, suffix := range fs.swift.Config().PartialSuffixes {
+		if suffix != "" && base != suffix && strings.HasSuffix(base, suffix) {
+			return hiddenName(name, partialPrefix)
+		}
+	}
+	return name
+}
+
+// hiddenName prepends the prefix to the base name of the object.
+func hiddenName(name, prefix string) string {
+	dir, base := path.Split(name)
+	return dir + prefix + base
+}
+
+// visibleFile returns an entry of a listing as the client sees it. Temporary
+// objects of uploads are not visible.
+func visibleFile(f *SwiftFile) (*SwiftFile, bool) {
+	if f.IsDir() {
+		return f, true
+	}
+
+	dir, base := path.Split(f.name)
+	if strings.HasPrefix(base, uploadPrefix) {
+		return nil, false
+	} else if strings.HasPrefix(base, partialPrefix) {
+		v := *f
+		v.name = dir + strings.TrimPrefix(base, partialPrefix)
+		return &v, true
+	}
+	return f, true
+}
+
+// permitted returns true if the client may access the container. Only the
+// containers set by SetContainers are permitted, all of them with "*".
+func (fs *SwiftFS) permitted(container string) bool {
+	if container == fs.swift.Container() {
+		return true
+	}
+	for _, c := range fs.containers {
+		if c == container || c == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// listContainers returns the containers which the client may access.
+func (fs *SwiftFS) listContainers() ([]os.FileInfo, error) {
+	containers, err := fs.swift.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]os.FileInfo, 0, len(containers))
+	for _, c := range containers {
+		if fs.permitted(c.Name()) {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+// splitContainerPath splits "container:/path" into the container and the path.
+// Absolute and relative paths without a container are returned as they are.
+func splitContainerPath(p string) (container string, path string) {
+	if strings.HasPrefix(p, Delimiter) {
+		return "", p
+	}
+	pos := strings.Index(p, ":/")
+	if pos <= 0 || strings.Contains(p[:pos], Delimiter) {
+		return "", p
+	}
+	return p[:pos], p[pos+1:]
+}
+
+func (fs *SwiftFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	fs.log.Infof("%s %s", r.Method, r.Filepath)
 
 	switch r.Method {
 	case "List":
-		files, err := fs.swift.ListDirectory(fs.filepath2object(r.Filepath))
+		if s, v := fs.version(r.Filepath); v != nil {
+			ret, err := fs.listVersions(s, v)
+			if err != nil {
+				fs.log.Warnf("%s %s", r.Filepath, err.Error())
+				return nil, sftp.ErrSshFxFailure
+			}
+			return listerat(ret), nil
+		}
+
+		s, name, err := fs.object(r.Filepath)
 		if err != nil {
 			fs.log.Warnf("%s %s", r.Filepath, err.Error())
-			return nil, sftp.ErrSshFxFailure
+			return nil, err
+		} else if s == nil {
+			ret, err := fs.listContainers()
+			if err != nil {
+				fs.log.Warnf("%s %s", r.Filepath, err.Error())
+				return nil, sftp.ErrSshFxFailure
+			}
+			return listerat(ret), nil
 		}
-		ret := fs.swift.GetFileInfos(files)
-		return listerat(ret), nil
+
+		return newPagedLister(s, name, fs.cache), nil
 	case "Stat":
-		// root path is not on the object storage and return it manually.
-		if r.Filepath == "/" {
-			fakeRoot := []os.FileInfo{
-				&SwiftFile{
-					name:    "/",
-					modtime: time.Now(),
-				},
-			}
-			return listerat(fakeRoot), nil
+		lister, err := fs.stat(r, true)
+		if err == nil {
+			fs.loadAttributes(r.Filepath)
 		}
+		return lister, err
 
-		// Check for xyz and xyz/
-		subdir := fs.filepath2object(path.Dir(r.Filepath))
-		files, err := fs.swift.ListDirectory(subdir)
+	case "Readlink":
+		lister, err := fs.stat(r, false)
 		if err != nil {
-			fs.log.Warnf("%s %s", subdir, err.Error())
+			return nil, err
+		}
+		f := lister.(listerat)[0].(*SwiftFile)
+		if f.symlink == "" {
+			fs.log.Warnf("%s Not a symbolic link", r.Filepath)
 			return nil, sftp.ErrSshFxFailure
 		}
+		// Readlink answers the name of the entry.
+		return listerat([]os.FileInfo{&linkTarget{f}}), nil
+	}
 
-		for _, f := range files {
-			fileInfo := fs.swift.GetFileInfo(f)
-			if r.Filepath == fileInfo.Abs() {
-				return listerat([]os.FileInfo{fileInfo}), nil
-			}
+	return nil, sftp.ErrSshFxFailure
+}
+
+// Lstat implements sftp.LstatFileLister. Unlike Stat, symlinks of Swift are
+// not followed.
+func (fs *SwiftFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fs.log.Infof("%s %s", r.Method, r.Filepath)
+
+	lister, err := fs.stat(r, false)
+	if err == nil {
+		fs.loadAttributes(r.Filepath)
+	}
+	return lister, err
+}
+
+func (fs *SwiftFS) stat(r *sftp.Request, follow bool) (sftp.ListerAt, error) {
+	// root path is not on the object storage and return it manually.
+	if r.Filepath == "/" {
+		fakeRoot := []os.FileInfo{
+			&SwiftFile{
+				name:    "/",
+				modtime: time.Now(),
+			},
 		}
-		return nil, os.ErrNotExist
+		return listerat(fakeRoot), nil
 	}
 
-	return nil, sftp.ErrSshFxFailure
+	if s, v := fs.version(r.Filepath); v != nil {
+		f, err := fs.statVersion(s, v)
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		} else if err != nil {
+			fs.log.Warnf("%s %s", r.Filepath, err.Error())
+			return nil, sftp.ErrSshFxFailure
+		}
+		return listerat([]os.FileInfo{f}), nil
+	}
+
+	s, name, err := fs.object(r.Filepath)
+	if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return nil, err
+	} else if name == "" {
+		// container in multi-container mode
+		_, f, err := fs.lookup(r.Filepath)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		return listerat([]os.FileInfo{f}), nil
+	}
+
+	var f *SwiftFile
+	if follow {
+		f, err = fs.statObject(s, name)
+	} else {
+		f, err = fs.lstatObject(s, name)
+	}
+	if err == os.ErrNotExist {
+		return nil, err
+	} else if err != nil {
+		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return nil, sftp.ErrSshFxFailure
+	}
+	return listerat([]os.FileInfo{f}), nil
 }
 
-func (fs *SwiftFS) filepath2object(path string) string {
-	return strings.TrimPrefix(path, "/")
+// lstatObject is like statObject, but returns a symlink itself with the path of
+// its target.
+func (fs *SwiftFS) lstatObject(s Backend, name string) (*SwiftFile, error) {
+	hdr, target, err := s.GetLink(name)
+	if isNotFound(err) {
+		// directory
+		return fs.statObject(s, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	f := &SwiftFile{
+		name:    name,
+		size:    int64(hdr.SizeBytes().Get()),
+		modtime: hdr.UpdatedAt().Get(),
+		hdr:     hdr,
+	}
+	if target != "" {
+		f.size = 0
+		container, object := target, ""
+		if pos := strings.Index(target, Delimiter); pos >= 0 {
+			container, object = target[:pos], target[pos+1:]
+		}
+		f.symlink = fs.linkPath(container, object)
+		return f, nil
+	}
+
+	if isDirectoryMarker(hdr) {
+		f.name += Delimiter
+		f.size = 0
+	}
+	fs.cache.put(s.Container(), f)
+	return f, nil
 }
-func (fs *SwiftFS) object2filepath(name string) string {
+
+// linkPath returns the path of the object for the client.
+func (fs *SwiftFS) linkPath(container, name string) string {
+	if fs.multi {
+		return Delimiter + container + Delimiter + name
+	} else if container != fs.swift.Container() {
+		return container + ":" + Delimiter + name
+	}
 	return Delimiter + name
 }
 
-// Return SwiftFile object with the path
-func (fs *SwiftFS) lookup(path string) (*SwiftFile, error) {
-	// root path is not on the object storage and return it manually.
-	if path == "/" {
+// Home returns the home directory of the client. It is the first container of
+// the client in multi-container mode, otherwise the root.
+func (fs *SwiftFS) Home() string {
+	if fs.multi && len(fs.containers) > 0 && fs.containers[0] != "*" {
+		return Delimiter + fs.containers[0]
+	}
+	return Delimiter
+}
+
+// RealPath returns the canonical absolute path. Relative paths and "~" are
+// relative to the home directory.
+func (fs *SwiftFS) RealPath(p string) string {
+	home := fs.Home()
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = home + p[1:]
+	} else if !strings.HasPrefix(p, Delimiter) {
+		p = home + Delimiter + p
+	}
+	return path.Clean(p)
+}
+
+// statObject returns the file or the directory with the name. A directory is
+// a marker object, or a prefix which only exists implicitly by the objects
+// under it.
+func (fs *SwiftFS) statObject(s Backend, name string) (*SwiftFile, error) {
+	subdir := path.Dir(name)
+	if subdir == "." {
+		subdir = ""
+	}
+	if f, ok := fs.cache.get(s.Container(), name); ok {
+		return f, nil
+	} else if fs.cache.isListed(s.Container(), subdir) {
+		return nil, os.ErrNotExist
+	}
+
+	hdr, err := s.Get(name)
+	if err == nil {
 		f := &SwiftFile{
-			name:    "/",
-			modtime: time.Now(),
+			name:    name,
+			size:    int64(hdr.SizeBytes().Get()),
+			modtime: hdr.UpdatedAt().Get(),
+			hdr:     hdr,
+		}
+		if isDirectoryMarker(hdr) {
+			f.name += Delimiter
+			f.size = 0
 		}
+		fs.cache.put(s.Container(), f)
 		return f, nil
+
+	} else if !isNotFound(err) {
+		return nil, err
 	}
 
-	name := fs.filepath2object(path)
-	header, err := fs.swift.Get(name)
+	// A marker object "name/" or any object under the directory
+	obj, err := s.FirstInDirectory(name)
 	if err != nil {
 		return nil, err
+	} else if obj == nil {
+		return nil, os.ErrNotExist
 	}
 
 	f := &SwiftFile{
-		name:    name,
-		size:    int64(header.SizeBytes().Get()),
-		modtime: header.UpdatedAt().Get(),
-		symlink: "",
+		name:    name + Delimiter,
+		modtime: obj.modtime,
 	}
+	fs.cache.put(s.Container(), f)
 	return f, nil
+}
 
+func (fs *SwiftFS) filepath2object(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+func (fs *SwiftFS) object2filepath(name string) string {
+	return Delimiter + name
 }
 
-// To synchronize objects on object storage and fs.files
-func (fs *SwiftFS) allFiles() ([]*SwiftFile, error) {
-	fs.log.Debugf("Updating file list...")
+// Return SwiftFile object with the path and the client of its container
+func (fs *SwiftFS) lookup(path string) (Backend, *SwiftFile, error) {
+	// root path is not on the object storage and return it manually.
+	if path == "/" {
+		f := &SwiftFile{
+			name:    "/",
+			modtime: time.Now(),
+		}
+		return fs.swift, f, nil
+	}
 
-	// Get object list from object storage
-	objs, err := fs.swift.List()
+	if s, v := fs.version(path); v != nil {
+		return fs.lookupVersion(s, v)
+	}
+
+	s, name, err := fs.object(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	files := make([]*SwiftFile, len(objs))
-	for i, obj := range objs {
-		isDir := strings.HasSuffix(obj.Name(), "/")
-		var objName string
-		if isDir {
-			objName = filepath.Clean(obj.Name())
-		} else {
-			objName = obj.Name()
-		}
-		headers, err := obj.Headers()
+	if name == "" {
+		// container in multi-container mode
+		exists, err := s.ExistsContainer()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		} else if !exists {
+			return nil, nil, os.ErrNotExist
 		}
-		files[i] = &SwiftFile{
-			name:    objName,
-			size:    int64(headers.SizeBytes().Get()),
-			modtime: headers.UpdatedAt().Get(),
+		f := &SwiftFile{
+			name:    s.Container() + Delimiter,
+			modtime: time.Now(),
 		}
+		return s, f, nil
 	}
-	return files, nil
+
+	// Directories in the cache are not objects.
+	if f, ok := fs.cache.get(s.Container(), name); ok && !f.IsDir() {
+		return s, f, nil
+	}
+
+	header, err := s.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f := &SwiftFile{
+		name:    name,
+		size:    int64(header.SizeBytes().Get()),
+		modtime: header.UpdatedAt().Get(),
+		symlink: "",
+		hdr:     header,
+	}
+	fs.cache.put(s.Container(), f)
+	return s, f, nil
+
 }
 
 // Modeled after strings.Reader's ReadAt() implementation
@@ -312,3 +1012,107 @@ func (f listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
 	}
 	return n, nil
 }
+
+// pagedLister implements sftp.ListerAt for a directory. The entries are fetched
+// page by page as the client reads on, and only the current page is held.
+type pagedLister struct {
+	swift Backend
+	path  string
+	cache *metaCache
+
+	lock      sync.Mutex
+	lister    DirectoryLister
+	page      []os.FileInfo
+	offset    int64 // offset of page[0]
+	eof       bool
+	startedAt time.Time
+}
+
+func newPagedLister(s Backend, path string, cache *metaCache) *pagedLister {
+	l := &pagedLister{
+		swift: s,
+		path:  path,
+		cache: cache,
+	}
+	l.reset()
+	return l
+}
+
+// reset starts the listing over from the beginning.
+func (l *pagedLister) reset() {
+	l.lister = l.swift.ListDirectory(l.path)
+	l.page = nil
+	l.offset = 0
+	l.eof = false
+	l.startedAt = time.Now()
+}
+
+func (l *pagedLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if offset < l.offset {
+		l.reset()
+	}
+
+	n := 0
+	for n < len(ls) {
+		i := offset + int64(n) - l.offset
+		if i < int64(len(l.page)) {
+			n += copy(ls[n:], l.page[i:])
+			continue
+		}
+
+		if l.eof {
+			return n, io.EOF
+		}
+		if err := l.nextPage(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// nextPage replaces the current page with the next one.
+func (l *pagedLister) nextPage() error {
+	files, err := l.lister.NextPage(listPageSize)
+	if err != nil {
+		return err
+	}
+
+	l.offset += int64(len(l.page))
+	l.page = make([]os.FileInfo, 0, len(files))
+	if len(files) == 0 {
+		// The listing has been read from the beginning to the end.
+		l.eof = true
+		l.cache.setListed(l.swift.Container(), l.path, l.startedAt)
+		return nil
+	}
+
+	for _, f := range files {
+		if f.symlink == "" {
+			l.cache.put(l.swift.Container(), cachedFile(f))
+		}
+		if f, ok := visibleFile(f); ok {
+			l.page = append(l.page, f)
+		}
+	}
+	return nil
+}
+
+// cachedFile converts an entry of a listing, whose name starts with a slash,
+// to the metadata of the object.
+func cachedFile(f *SwiftFile) *SwiftFile {
+	c := *f
+	c.name = strings.TrimPrefix(f.name, Delimiter)
+	return &c
+}
+
+// linkTarget is a symlink whose name is the path of its target, for Readlink.
+type linkTarget struct {
+	*SwiftFile
+}
+
+func (l *linkTarget) Name() string {
+	return l.symlink
+}
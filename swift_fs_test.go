@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/gophercloud/gophercloud"
+	"github.com/majewsky/schwift"
 	"github.com/pkg/sftp"
 )
 
@@ -105,11 +109,7 @@ func TestFilecmd(t *testing.T) {
 		t.Error(err)
 	}
 
-	if _, err = s.Get(filename); err == nil {
-		t.Error("Original file that should be deleted exists")
-	}
-	_, ok := err.(gophercloud.ErrDefault404)
-	if !ok {
+	if _, err = s.Get(filename); !isNotFound(err) {
 		t.Error("Original file that should be deleted exists")
 	}
 
@@ -123,11 +123,7 @@ func TestFilecmd(t *testing.T) {
 		t.Error(err)
 	}
 
-	if _, err = s.Get(targetName); err == nil {
-		t.Error("File that should be deleted exists")
-	}
-	_, ok = err.(gophercloud.ErrDefault404)
-	if !ok {
+	if _, err = s.Get(targetName); !isNotFound(err) {
 		t.Error("File that should be deleted exists")
 	}
 }
@@ -203,3 +199,513 @@ func TestFilelist(t *testing.T) {
 		}
 	}
 }
+
+func TestDirectories(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+
+	// a marker without a trailing slash, entries sorted between it and its
+	// subdirectory, a directory of a prefix only and an empty directory
+	marker := schwift.NewObjectHeaders()
+	marker.ContentType().Set(directoryContentType)
+	if err := s.Upload("dir", strings.NewReader(""), marker); err != nil {
+		t.Fatal(err)
+	}
+	upload(t, s, "dir-a", "a")
+	upload(t, s, "dir.txt", "txt")
+	upload(t, s, "dir/x", "x")
+	upload(t, s, "prefix/y", "y")
+	if err := createDirectory(s, "empty/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each directory is listed once, also across pages.
+	var names []string
+	for l := s.ListDirectory(""); ; {
+		page, err := l.NextPage(1)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(page) == 0 {
+			break
+		}
+		names = append(names, page[0].Name())
+	}
+	if strings.Join(names, ",") != "dir,dir-a,dir.txt,empty,prefix" {
+		t.Errorf("Unexpected listing %v", names)
+	}
+
+	client := startFakeSftp(t, s)
+	for _, dir := range []string{"/dir", "/prefix", "/empty"} {
+		if fi, err := client.Stat(dir); err != nil || !fi.IsDir() {
+			t.Errorf("%s is not a directory: %v", dir, err)
+		}
+		if fi, err := client.Lstat(dir); err != nil || !fi.IsDir() {
+			t.Errorf("%s is not a directory by lstat: %v", dir, err)
+		}
+	}
+	if fi, err := client.Stat("/dir.txt"); err != nil || fi.IsDir() || fi.Size() != 3 {
+		t.Errorf("Unexpected file %v %v", fi, err)
+	}
+
+	// Only empty directories are removed.
+	if err := client.RemoveDirectory("/dir"); err == nil {
+		t.Error("A directory which is not empty was removed")
+	}
+	if err := client.RemoveDirectory("/dir.txt"); err == nil {
+		t.Error("A file was removed as a directory")
+	}
+	if err := client.RemoveDirectory("/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Stat("/empty"); err == nil {
+		t.Error("The removed directory still exists")
+	}
+}
+
+func TestRealPath(t *testing.T) {
+	tests := []struct {
+		multi    bool
+		path     string
+		expected string
+	}{
+		{false, ".", "/"},
+		{false, "", "/"},
+		{false, "dir/../file.dat", "/file.dat"},
+		{false, "/dir/./sub/../file.dat", "/dir/file.dat"},
+		{false, "../../..", "/"},
+		{false, "~/file.dat", "/file.dat"},
+		{true, ".", "/home"},
+		{true, "~", "/home"},
+		{true, "file.dat", "/home/file.dat"},
+		{true, "..", "/"},
+		{true, "/other/file.dat", "/other/file.dat"},
+	}
+
+	for _, test := range tests {
+		fs := NewSwiftFS(NewSwift(Config{MultiContainer: test.multi}))
+		fs.SetContainers([]string{"home"})
+
+		if p := fs.RealPath(test.path); p != test.expected {
+			t.Errorf("RealPath(%q) = %q, expected %q", test.path, p, test.expected)
+		}
+	}
+}
+
+func TestMultiContainer(t *testing.T) {
+	account := NewMemoryBackend(Config{MultiContainer: true}).WithContainer("")
+	for _, c := range []string{"c1", "c2", "c3"} {
+		b := account.WithContainer(c)
+		b.CreateContainer()
+		upload(t, b, "a.txt", "in "+c)
+	}
+
+	list := func(client *sftp.Client) string {
+		infos, err := client.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+		return strings.Join(names, ",")
+	}
+
+	// Paths are /container/object in the permitted containers.
+	fs := NewSwiftFS(account)
+	fs.SetContainers([]string{"c1", "c2"})
+	client := startFakeSftpSession(t, fs)
+	if names := list(client); names != "c1,c2" {
+		t.Errorf("Unexpected containers %s", names)
+	}
+	if data, err := readFileForTesting(client, "/c2/a.txt"); err != nil || data != "in c2" {
+		t.Errorf("Unexpected content %q %v", data, err)
+	}
+	if err := writeFileForTesting(client, "/c1/dir/b.txt", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := download(account.WithContainer("c1"), "dir/b.txt", 0, 0); err != nil || data != "b" {
+		t.Errorf("Unexpected object %q %v", data, err)
+	}
+	if _, err := readFileForTesting(client, "/c3/a.txt"); err == nil {
+		t.Error("A container which is not permitted was read")
+	}
+	if err := writeFileForTesting(client, "/c3/b.txt", "b"); err == nil {
+		t.Error("A container which is not permitted was written")
+	}
+	if err := client.Mkdir("/c4"); err == nil {
+		t.Error("A container which is not permitted was created")
+	}
+
+	// No container permits none of them.
+	client = startFakeSftpSession(t, NewSwiftFS(account))
+	if names := list(client); names != "" {
+		t.Errorf("Unexpected containers %s", names)
+	}
+	if _, err := readFileForTesting(client, "/c1/a.txt"); err == nil {
+		t.Error("A container was read without permission")
+	}
+
+	// "*" permits all containers.
+	fs = NewSwiftFS(account)
+	fs.SetContainers([]string{"*"})
+	client = startFakeSftpSession(t, fs)
+	if err := client.Mkdir("/c4"); err != nil {
+		t.Fatal(err)
+	}
+	if names := list(client); names != "c1,c2,c3,c4" {
+		t.Errorf("Unexpected containers %s", names)
+	}
+}
+
+func TestPartialName(t *testing.T) {
+	fs := NewSwiftFS(NewSwift(Config{PartialSuffixes: []string{".part", ".filepart"}}))
+
+	tests := map[string]string{
+		"file.dat":              "file.dat",
+		"file.dat.part":         ".swift-sftp-partial-file.dat.part",
+		"dir/file.dat.filepart": "dir/.swift-sftp-partial-file.dat.filepart",
+		"dir/.part":             "dir/.part",
+	}
+	for name, expected := range tests {
+		hidden := fs.partialName(name)
+		if hidden != expected {
+			t.Errorf("partialName(%q) = %q, expected %q", name, hidden, expected)
+			continue
+		}
+
+		f, ok := visibleFile(&SwiftFile{name: "/" + hidden})
+		if !ok || f.name != "/"+name {
+			t.Errorf("visibleFile(%q) = %v, %v", hidden, f, ok)
+		}
+	}
+
+	if _, ok := visibleFile(&SwiftFile{name: "/dir/.swift-sftp-upload-0123-file.dat"}); ok {
+		t.Errorf("temporary object is visible")
+	}
+}
+
+func TestAtomicUpload(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.config.AtomicUpload = true
+	s.config.PartialSuffixes = []string{".part", ".filepart"}
+
+	var m sync.Mutex
+	var puts []string
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "PUT" {
+			m.Lock()
+			puts = append(puts, r.URL.Path)
+			m.Unlock()
+		}
+		return 0
+	}
+
+	client := startFakeSftp(t, s)
+	w, err := client.Create("/d/a.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range puts {
+		if strings.HasSuffix(p, "/d/a.dat") {
+			t.Errorf("The file was uploaded directly: %s", p)
+		}
+	}
+	if _, err = s.Get("d/a.dat"); err != nil {
+		t.Error(err)
+	}
+	objects, _ := readDirectory(s, "d")
+	for _, obj := range objects {
+		if strings.Contains(obj.name, uploadPrefix) {
+			t.Errorf("Temporary object remains: %s", obj.name)
+		}
+	}
+
+	// partial files are hidden until they are renamed
+	w, _ = client.Create("/d/b.dat.filepart")
+	w.Write([]byte("partial"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("d/b.dat.filepart"); err == nil {
+		t.Error("Partial file is visible in Swift")
+	}
+	if _, err = s.Get("d/" + partialPrefix + "b.dat.filepart"); err != nil {
+		t.Errorf("Partial file is not hidden: %v", err)
+	}
+	infos, _ := client.ReadDir("/d")
+	names := []string{}
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a.dat,b.dat.filepart" {
+		t.Errorf("Unexpected listing %v", names)
+	}
+	if fi, err := client.Stat("/d/b.dat.filepart"); err != nil || fi.Size() != 7 {
+		t.Errorf("Partial file is not found: %v", err)
+	}
+	if err = client.Rename("/d/b.dat.filepart", "/d/b.dat"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("d/b.dat"); err != nil {
+		t.Error(err)
+	}
+	if _, err = s.Get("d/" + partialPrefix + "b.dat.filepart"); err == nil {
+		t.Error("Hidden partial file remains")
+	}
+}
+
+func TestPagedLister(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	createDirectory(s, "d/")
+	for i := 0; i < 2500; i++ {
+		s.Put(fmt.Sprintf("d/f%05d", i), strings.NewReader("x"))
+	}
+	s.Put("d/sub/x", strings.NewReader("x"))
+
+	l := newPagedLister(s, "d", nil)
+	var names []string
+	list := make([]os.FileInfo, 100)
+	for offset := int64(0); ; {
+		n, err := l.ListAt(list, offset)
+		for _, fi := range list[:n] {
+			names = append(names, fi.Name())
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(names) != 2501 || names[0] != "f00000" || names[2500] != "sub" {
+		t.Fatalf("Unexpected listing of %d entries", len(names))
+	}
+
+	// an offset which was listed before
+	if n, err := l.ListAt(list, 5); n != 100 || err != nil || list[0].Name() != "f00005" {
+		t.Errorf("Unexpected page %d %v", n, err)
+	}
+
+	client := startFakeSftp(t, s)
+	if infos, err := client.ReadDir("/d"); err != nil || len(infos) != 2501 {
+		t.Errorf("Unexpected listing of %d entries %v", len(infos), err)
+	}
+}
+
+func TestPagedListerRequests(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	for i := 0; i < 2*listPageSize+1; i++ {
+		s.Put(fmt.Sprintf("d/f%05d", i), strings.NewReader("x"))
+	}
+
+	// listings of the container
+	var lock sync.Mutex
+	var queries []string
+	f.Fail = func(r *http.Request) int {
+		if r.Method == http.MethodGet && strings.Trim(r.URL.Path, "/") == "v1/"+fakeSwiftAccount+"/c1" {
+			lock.Lock()
+			queries = append(queries, r.URL.Query().Get("limit")+" "+r.URL.Query().Get("marker"))
+			lock.Unlock()
+		}
+		return 0
+	}
+	defer func() { f.Fail = nil }()
+
+	// Only the pages read by the client are fetched.
+	l := newPagedLister(s, "d", nil)
+	list := make([]os.FileInfo, 10)
+	if n, err := l.ListAt(list, 0); n != 10 || err != nil {
+		t.Fatalf("Unexpected page %d %v", n, err)
+	}
+	limit := fmt.Sprint(listPageSize)
+	if !reflect.DeepEqual(queries, []string{limit + " "}) {
+		t.Errorf("Unexpected requests %q", queries)
+	}
+
+	// The next page starts at the last entry of the page before.
+	if n, err := l.ListAt(list, listPageSize); n != 10 || err != nil || list[0].Name() != fmt.Sprintf("f%05d", listPageSize) {
+		t.Fatalf("Unexpected page %d %v", n, err)
+	}
+	expected := []string{limit + " ", limit + " " + fmt.Sprintf("d/f%05d", listPageSize-1)}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Errorf("Unexpected requests %q", queries)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.Put("slow.dat", strings.NewReader("slow"))
+	s.Put("fast.dat", strings.NewReader("fast"))
+	f.Fail = func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/slow.dat") {
+			time.Sleep(time.Second)
+		}
+		return 0
+	}
+
+	// a slow request doesn't block the others
+	fs := NewSwiftFS(s)
+	done := make(chan struct{})
+	go func() {
+		fs.Filelist(sftp.NewRequest("Stat", "/slow.dat"))
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := fs.Filelist(sftp.NewRequest("Stat", "/fast.dat")); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Stat was blocked by a slow request for %v", d)
+	}
+	<-done
+
+	// parallel uploads and downloads over one connection
+	f.Fail = nil
+	client := startFakeSftp(t, s)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("/p%d.dat", i)
+			data := bytes.Repeat([]byte{byte(i)}, 100000+i)
+			w, err := client.Create(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			w.Write(data)
+			if err = w.Close(); err != nil {
+				t.Error(err)
+				return
+			}
+			r, err := client.Open(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			downloaded, _ := ioutil.ReadAll(r)
+			r.Close()
+			if !bytes.Equal(downloaded, data) {
+				t.Errorf("%s differs", name)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentTransfers(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.Put("a.dat", strings.NewReader("hello"))
+	for i := 0; i < 4; i++ {
+		s.Put(fmt.Sprintf("s%d.dat", i), strings.NewReader("slow"))
+	}
+	uploading := make(chan struct{})
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/slow.dat") {
+			close(uploading)
+			time.Sleep(time.Second)
+		} else if r.Method == "GET" && strings.Contains(r.URL.Path, "/s") {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return 0
+	}
+
+	// the handlers are not blocked by a slow upload
+	fs := NewSwiftFS(s)
+	wa, err := fs.Filewrite(sftp.NewRequest("Put", "/slow.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wa.(*swiftWriter)
+	w.WriteAt([]byte("slow"), 0)
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	<-uploading
+
+	start := time.Now()
+	if _, err = fs.Filelist(sftp.NewRequest("List", "/")); err != nil {
+		t.Error(err)
+	}
+	ra, err := fs.Fileread(sftp.NewRequest("Get", "/a.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, _ := ra.ReadAt(buf, 0); string(buf[:n]) != "hello" {
+		t.Errorf("Unexpected content %q", buf[:n])
+	}
+	ra.(io.Closer).Close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("The handlers were blocked by a slow upload for %v", d)
+	}
+	if err = <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	// slow downloads over one connection run in parallel
+	client := startFakeSftp(t, s)
+	files := make([]*sftp.File, 4)
+	for i := range files {
+		if files[i], err = client.Open(fmt.Sprintf("/s%d.dat", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start = time.Now()
+	var wg sync.WaitGroup
+	for _, r := range files {
+		wg.Add(1)
+		go func(r *sftp.File) {
+			defer wg.Done()
+			if data, _ := ioutil.ReadAll(r); string(data) != "slow" {
+				t.Errorf("Unexpected content %q", data)
+			}
+			r.Close()
+		}(r)
+	}
+	wg.Wait()
+	if d := time.Since(start); d > 1500*time.Millisecond {
+		t.Errorf("The downloads were serialized (%v)", d)
+	}
+
+	// files opened and closed concurrently under the same name
+	f.Fail = nil
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w, err := client.Create("/same.dat")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			w.Write([]byte{byte('0' + i)})
+			if err = w.Close(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if fi, err := client.Stat("/same.dat"); err != nil || fi.Size() != 1 {
+		t.Errorf("Unexpected stat %v %v", fi, err)
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,16 +23,20 @@ import (
 type swiftReader struct {
 	// Required to set in initialized
 	log     *logrus.Entry
-	swift   *Swift
+	swift   Backend
 	sf      *SwiftFile
 	timeout time.Duration
 
 	// Not required
-	m            sync.Mutex
 	tmpfile      *os.File
-	downloadErr  error
 	downloadSize int64
-	readSize     int64
+	reserved     int64 // temporary space reserved for the download
+
+	// Progress of the download, which runs while the client reads
+	m           sync.Mutex
+	downloaded  int64
+	finished    bool
+	downloadErr error
 
 	afterClosed func(r *swiftReader)
 }
@@ -47,6 +54,11 @@ func (r *swiftReader) Begin() (err error) {
 		return fmt.Errorf("Couldn't detect download size (Missing Content-length header).")
 	}
 
+	if err = tmpBudget.acquire(r.downloadSize); err != nil {
+		return err
+	}
+	r.reserved = r.downloadSize
+
 	// Create tmpfile
 	fname, err := createTmpFile()
 	if err != nil {
@@ -62,13 +74,47 @@ func (r *swiftReader) Begin() (err error) {
 
 	// start download
 	go func() {
-		if err := r.download(fname); err != nil {
-			r.downloadErr = err
-		}
+		err := r.download(fname)
+
+		r.m.Lock()
+		r.finished = true
+		r.downloadErr = err
+		r.m.Unlock()
 	}()
 	return nil
 }
 
+// progress returns how much of the object is in the tmpfile.
+func (r *swiftReader) progress() (downloaded int64, finished bool, err error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.downloaded, r.finished, r.downloadErr
+}
+
+// Err returns the error of the download.
+func (r *swiftReader) Err() error {
+	_, _, err := r.progress()
+	return err
+}
+
+// written counts the data written to the tmpfile by the download.
+func (r *swiftReader) written(n int) {
+	r.m.Lock()
+	r.downloaded += int64(n)
+	r.m.Unlock()
+}
+
+type progressWriter struct {
+	io.Writer
+	r *swiftReader
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.r.written(n)
+	return n, err
+}
+
 func (r *swiftReader) download(tmpFileName string) (err error) {
 	r.log.Debugf("Create tmpfile. [%s]", tmpFileName)
 	fw, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_TRUNC, 0000)
@@ -82,10 +128,29 @@ func (r *swiftReader) download(tmpFileName string) (err error) {
 	if err != nil {
 		return err
 	}
-	defer body.Close()
 
 	r.log.Debugf("Download '%s' (size=%d) from Object Storage", r.sf.Abs(), size)
-	_, err = io.Copy(fw, body)
+	_, err = io.Copy(progressWriter{fw, r}, body)
+	body.Close()
+
+	// An interrupted download resumes from the last received byte.
+	retries := newRetryPolicy(r.swift.Config())
+	for n := 1; isRetryable(err) && n <= retries.max; n++ {
+		offset, _, _ := r.progress()
+		if offset >= size {
+			err = nil
+			break
+		}
+		wait := retries.backoff(n, nil)
+		r.log.Infof("Resume download of '%s' at %d in %v (%d/%d) [%v]", r.sf.Abs(), offset, wait, n, retries.max, err)
+		time.Sleep(wait)
+
+		var rest io.ReadCloser
+		if rest, err = r.swift.DownloadRange(r.sf.Abs(), offset, 0); err == nil {
+			_, err = io.Copy(progressWriter{fw, r}, rest)
+			rest.Close()
+		}
+	}
 	if err != nil {
 		r.log.Warnf("Error occured during copying [%v]", err.Error())
 		return err
@@ -95,17 +160,37 @@ func (r *swiftReader) download(tmpFileName string) (err error) {
 	return nil
 }
 
+// ReadAt waits until the requested data is downloaded. It may be called
+// concurrently.
 func (r *swiftReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= r.downloadSize {
+		r.log.Debugf("Send EOF to client. [%s]", r.sf.Name())
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > r.downloadSize {
+		end = r.downloadSize
+	}
+
 	start := time.Now()
 	for {
-		n, err = r.tmpfile.ReadAt(p, off)
-		if n != 0 {
-			r.readSize += int64(n)
+		downloaded, finished, downloadErr := r.progress()
+		if downloadErr != nil {
+			return 0, downloadErr
+		} else if downloaded >= end || finished {
+			if off >= downloaded {
+				r.log.Debugf("Send EOF to client. [%s]", r.sf.Name())
+				return 0, io.EOF
+			} else if end > downloaded {
+				end = downloaded
+			}
+
+			n, err = r.tmpfile.ReadAt(p[:end-off], off)
+			if err == nil && n < len(p) {
+				err = io.EOF
+			}
 			return n, err
-
-		} else if r.readSize == r.downloadSize {
-			r.log.Debugf("Send EOF to client. [%s]", r.sf.Name())
-			return n, io.EOF
 		}
 
 		time.Sleep(100 * time.Millisecond)
@@ -117,8 +202,11 @@ func (r *swiftReader) ReadAt(p []byte, off int64) (n int, err error) {
 		}
 	}
 
-	r.downloadErr = errors.New("Timeout for downloading")
-	return -1, r.downloadErr
+	err = errors.New("Timeout for downloading")
+	r.m.Lock()
+	r.downloadErr = err
+	r.m.Unlock()
+	return 0, err
 }
 
 func (r *swiftReader) Close() error {
@@ -130,23 +218,87 @@ func (r *swiftReader) Close() error {
 	if r.tmpfile != nil {
 		os.Remove(r.tmpfile.Name())
 	}
+	tmpBudget.release(r.reserved)
+	r.reserved = 0
 
 	return nil
 }
 
+// errChecksumMismatch is returned by swiftWriter.Close if the checksum of the
+// object stored in Swift differs from the data sent by the client.
+var errChecksumMismatch = errors.New("Checksum mismatch, the file was corrupted during the upload")
+
+// errSizeMismatch is returned by swiftWriter.Close if a large object has not
+// the size of the data sent by the client.
+var errSizeMismatch = errors.New("Size mismatch, the file was not stored completely")
+
 // swiftWriter implements io.WriteAt interface
 type swiftWriter struct {
 	// Required to set in initialized
 	log     *logrus.Entry
-	swift   *Swift
+	swift   Backend
 	sf      *SwiftFile
 	timeout time.Duration
 
 	// Not required
+	m              sync.Mutex
 	tmpfile        *os.File
+	written        bool
 	uploadComplete bool
 	uploadErr      error
 
+	// If set, the tmpfile is uploaded to a temporary object which is renamed
+	// to the file when the upload is complete.
+	atomic bool
+
+	// Files larger than segmentSize are uploaded as static large objects.
+	segmentSize int64
+
+	// If set, the file is opened for appending to the object of this size.
+	// The data written after it is uploaded as new segments. appendOnly is set
+	// for SSH_FXF_APPEND. If the first write is before appendSize then, the
+	// offsets are taken as relative to the end of the object.
+	appendSize  int64
+	appendOnly  bool
+	appendShift int64 // added to the offsets if they are relative to the end
+
+	// If the first write is at the beginning of the file without appendOnly,
+	// the object of this size is overwritten instead of appended to. Its data
+	// after the written data is downloaded only if it is kept.
+	overwrittenSize int64
+
+	// Custom metadata of the object which is continued. It is kept when the
+	// file is stored.
+	continued bool
+	metadata  map[string]string
+
+	// Temporary space reserved for the tmpfile, and the end of the data in it
+	reserved int64
+	extent   int64
+
+	// Checksums of the data are computed while it is written sequentially. The
+	// MD5 is sent as ETag, the SHA-256 is stored in the metadata if hashSHA256
+	// is set.
+	hashSHA256 bool
+	md5Hash    hash.Hash
+	sha256Hash hash.Hash
+	hashed     int64 // bytes written to the hashes
+	unhashed   bool  // the data was not written sequentially
+	md5sum     string
+	sha256sum  string
+
+	// If set, the object is copied from copyName on the server side instead of
+	// uploading the tmpfile.
+	copySwift Backend
+	copyName  string
+
+	// Headers of the expiry of the object
+	expiry schwift.ObjectHeaders
+
+	// Detected when the upload starts
+	contentType     string
+	contentEncoding string
+
 	afterClosed func(w *swiftWriter)
 }
 
@@ -162,45 +314,528 @@ func (w *swiftWriter) Begin() (err error) {
 	// Open tmpfile
 	w.tmpfile, err = os.OpenFile(fname, os.O_WRONLY, 0000)
 	if err != nil {
-		w.log.Error("Couldn't open tmpfile. [%v]", err.Error())
+		w.log.Errorf("Couldn't open tmpfile. [%v]", err.Error())
 		return err
 	}
+
+	// The data before appendSize is not in the tmpfile.
+	w.extent = w.appendSize
+	w.continued = w.appendSize > 0
+
+	w.md5Hash = md5.New()
+	if w.hashSHA256 {
+		w.sha256Hash = sha256.New()
+	}
 	return nil
 }
 
-func (w *swiftWriter) upload() (err error) {
-	fname := w.tmpfile.Name()
-	w.log.Debugf("Upload: create tmpfile. [%s]", fname)
-	fr, err := os.OpenFile(fname, os.O_RDONLY, 000)
+func (w *swiftWriter) upload(name string) (err error) {
+	hdr := w.headers()
+	hdr.Etag().Set(w.md5sum)
+	if w.sha256sum != "" {
+		hdr.Metadata().Set("sha256", w.sha256sum)
+	}
+
+	// The tmpfile is opened for each attempt because the request closes it.
+	err = newRetryPolicy(w.swift.Config()).retry("upload of "+name, func() error {
+		fname := w.tmpfile.Name()
+		w.log.Debugf("Upload: create tmpfile. [%s]", fname)
+		fr, err := os.OpenFile(fname, os.O_RDONLY, 000)
+		if err != nil {
+			w.log.Errorf("%v", err.Error())
+			return err
+		}
+		defer fr.Close()
+
+		return w.swift.Upload(name, fr, hdr)
+	})
+	if schwift.Is(err, http.StatusUnprocessableEntity) || err == schwift.ErrChecksumMismatch {
+		w.log.Warnf("Checksum mismatch for '%s' (md5=%s)", name, w.md5sum)
+		return errChecksumMismatch
+	}
+	return err
+}
+
+// uploadSegments uploads the tmpfile as a static large object. The MD5 of the
+// whole file is stored in the metadata because the ETag of a large object is
+// not the MD5 of its content.
+func (w *swiftWriter) uploadSegments(b largeObjectBackend, size int64) error {
+	fr, err := os.Open(w.tmpfile.Name())
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	lo, err := b.NewLargeObject(w.sf.Abs())
+	if err != nil {
+		return err
+	}
+	w.log.Debugf("Upload '%s' in segments of %d bytes", w.sf.Abs(), w.segmentSize)
+	if err = w.appendSegments(lo, fr, 0, size); err != nil {
+		return w.segmentError(err)
+	}
+
+	hdr := w.headers()
+	hdr.Metadata().Set("md5", w.md5sum)
+	if w.sha256sum != "" {
+		hdr.Metadata().Set("sha256", w.sha256sum)
+	}
+	if err = lo.WriteManifest(hdr.ToOpts()); err != nil {
+		return err
+	}
+	return w.verifySize(size)
+}
+
+// uploadAppended appends the data written after appendSize to the object as
+// new segments.
+func (w *swiftWriter) uploadAppended(b largeObjectBackend, size int64) error {
+	if size <= w.appendSize {
+		w.log.Debugf("Nothing was appended to '%s'", w.sf.Abs())
+		return nil
+	}
+
+	fr, err := os.Open(w.tmpfile.Name())
 	if err != nil {
-		w.log.Error("%v", err.Error())
 		return err
 	}
 	defer fr.Close()
 
-	obj := w.swift.getContainer().Object(w.sf.Abs())
+	lo, err := b.AppendableObject(w.sf.Abs())
+	if err != nil {
+		return err
+	}
+	w.log.Debugf("Append %d bytes to '%s' (size=%d)", size-w.appendSize, w.sf.Abs(), w.appendSize)
+	if err = w.appendSegments(lo, fr, w.appendSize, size); err != nil {
+		return w.segmentError(err)
+	}
+
+	// The manifest replaces the object with the metadata loaded before, but
+	// without the checksums which are not valid anymore.
+	if err = lo.WriteManifest(w.headers().ToOpts()); err != nil {
+		return err
+	}
+	return w.verifySize(size)
+}
+
+// appendSegments uploads the data of the file between off and size as
+// segments of the large object. A failed segment is uploaded again.
+func (w *swiftWriter) appendSegments(lo *schwift.LargeObject, f io.ReaderAt, off, size int64) error {
+	opts := w.headers().ToOpts()
+	retries := newRetryPolicy(w.swift.Config())
+	for off < size {
+		n := size - off
+		if w.segmentSize > 0 && n > w.segmentSize {
+			n = w.segmentSize
+		}
+
+		err := retries.retry("upload of a segment of "+w.sf.Abs(), func() error {
+			return lo.Append(io.NewSectionReader(f, off, n), n, opts)
+		})
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+func (w *swiftWriter) segmentError(err error) error {
+	if schwift.Is(err, http.StatusUnprocessableEntity) || err == schwift.ErrChecksumMismatch {
+		w.log.Warnf("Checksum mismatch for a segment of '%s'", w.sf.Abs())
+		return errChecksumMismatch
+	}
+	return err
+}
+
+// verifySize checks the size of the large object after the manifest is
+// written. Swift verifies the ETags of the segments in the manifest.
+func (w *swiftWriter) verifySize(size int64) error {
+	hdr, err := w.swift.Get(w.sf.Abs())
+	if err != nil {
+		return err
+	} else if stored := int64(hdr.SizeBytes().Get()); stored != size {
+		w.log.Warnf("Size mismatch for '%s' (size=%d, stored=%d)", w.sf.Abs(), size, stored)
+		return errSizeMismatch
+	}
+	return nil
+}
+
+// checksums sets the checksums of the tmpfile. They are computed again from the
+// tmpfile if the data was not written sequentially.
+func (w *swiftWriter) checksums(size int64) error {
+	if w.unhashed || w.hashed != size {
+		w.log.Debugf("Compute checksums of '%s' from tmpfile", w.sf.Abs())
+
+		fr, err := os.Open(w.tmpfile.Name())
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+
+		w.md5Hash.Reset()
+		hashes := []io.Writer{w.md5Hash}
+		if w.sha256Hash != nil {
+			w.sha256Hash.Reset()
+			hashes = append(hashes, w.sha256Hash)
+		}
+		if _, err = io.Copy(io.MultiWriter(hashes...), fr); err != nil {
+			return err
+		}
+	}
+
+	w.md5sum = hex.EncodeToString(w.md5Hash.Sum(nil))
+	if w.sha256Hash != nil {
+		w.sha256sum = hex.EncodeToString(w.sha256Hash.Sum(nil))
+	}
+	return nil
+}
+
+// uploadAtomically uploads the tmpfile to a hidden temporary object and
+// renames it to the file, so the file never appears partially written.
+func (w *swiftWriter) uploadAtomically() error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpName := hiddenName(w.sf.Abs(), uploadPrefix+hex.EncodeToString(suffix)+"-")
+
+	defer func() {
+		if err := w.swift.Delete(tmpName); err != nil && !isNotFound(err) {
+			w.log.Warnf("Couldn't delete temporary object '%s' [%v]", tmpName, err)
+		}
+	}()
+
+	w.log.Debugf("Upload '%s' to temporary object '%s'", w.sf.Abs(), tmpName)
+	if err := w.upload(tmpName); err != nil {
+		return err
+	}
+
+	return w.swift.CopyTo(tmpName, w.swift, w.sf.Abs(), w.headers())
+}
+
+// headers returns the headers for the uploaded object.
+func (w *swiftWriter) headers() schwift.ObjectHeaders {
 	hdr := schwift.NewObjectHeaders()
-	if w.swift.config.SwiftExpire > 0 {
-		hdr.Set("X-Delete-After", strconv.Itoa(w.swift.config.SwiftExpire))
+	for k, v := range w.expiry.Headers {
+		hdr.Set(k, v)
+	}
+	if w.contentType != "" {
+		hdr.ContentType().Set(w.contentType)
 	}
-	opts := hdr.ToOpts() //type *schwift.RequestOptions
+	if w.contentEncoding != "" {
+		hdr.Set("Content-Encoding", w.contentEncoding)
+	}
+	for k, v := range w.metadata {
+		hdr.Set(k, v)
+	}
+	return hdr
+}
 
-	return obj.Upload(fr, nil, opts)
+// loadMetadata loads the custom metadata of the object which is continued.
+// The checksums are not kept because they are not valid for the new content.
+func (w *swiftWriter) loadMetadata() error {
+	hdr, err := w.swift.Get(w.sf.Abs())
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	w.metadata = make(map[string]string)
+	for k, v := range hdr.Headers {
+		if !strings.HasPrefix(k, objectMetaPrefix) {
+			continue
+		}
+		switch strings.ToLower(strings.TrimPrefix(k, objectMetaPrefix)) {
+		case "md5", "sha256":
+		default:
+			w.metadata[k] = v
+		}
+	}
+	return nil
+}
+
+// detectContentType detects the content type of the file from its name and
+// the beginning of the tmpfile. Only the name is used if the beginning of the
+// file is not in the tmpfile.
+func (w *swiftWriter) detectContentType() {
+	var head []byte
+	if w.appendSize == 0 {
+		if f, err := os.Open(w.tmpfile.Name()); err == nil {
+			head = make([]byte, sniffLength)
+			n, _ := f.ReadAt(head, 0)
+			head = head[:n]
+			f.Close()
+		}
+	}
+	w.contentType, w.contentEncoding = detectContentType(w.swift.Config(), w.sf.Abs(), head)
+	if w.contentType != "" {
+		w.log.Debugf("Content type of '%s' is %s %s", w.sf.Abs(), w.contentType, w.contentEncoding)
+	}
+}
+
+// CopyFrom writes length bytes of the object name starting at offset to the
+// file at off. If length is 0, the object is copied until the end. If the whole
+// object is copied to the beginning of an empty file, the data is not
+// downloaded and the object is copied on the server side by Close.
+func (w *swiftWriter) CopyFrom(s Backend, name string, offset, length, off int64) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	hdr, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+	size := int64(hdr.SizeBytes().Get())
+
+	if offset == 0 && (length == 0 || length == size) && off == 0 && !w.written && w.copySwift == nil && w.appendSize == 0 {
+		w.log.Debugf("Copy '%s' to '%s' on the server side", name, w.sf.Abs())
+		w.copySwift = s
+		w.copyName = name
+		return nil
+	}
+
+	if err = w.materialize(); err != nil {
+		return err
+	}
+	if off, err = w.position(off); err != nil {
+		return err
+	}
+	w.written = true
+
+	body, err := s.DownloadRange(name, offset, length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return w.writeFrom(body, off)
+}
+
+// materialize downloads the object to be copied on the server side into the
+// tmpfile because the file is going to be modified.
+func (w *swiftWriter) materialize() error {
+	if w.copySwift == nil {
+		return nil
+	}
+
+	body, _, err := w.copySwift.Download(w.copyName)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	w.copySwift = nil
+	return w.writeFrom(body, 0)
+}
+
+// writeFrom writes the content of the reader to the tmpfile at off.
+func (w *swiftWriter) writeFrom(r io.Reader, off int64) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.writeTmp(buf[:n], off); werr != nil {
+				return werr
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
 }
 
 func (w *swiftWriter) WriteAt(p []byte, off int64) (n int, err error) {
-	n, err = w.tmpfile.WriteAt(p, off)
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err = w.materialize(); err != nil {
+		w.log.Debugf("%v", err)
+		return 0, err
+	}
+	if off, err = w.position(off); err != nil {
+		w.log.Debugf("%v", err)
+		return 0, err
+	}
+	w.written = true
+
+	n, err = w.writeTmp(p, off)
 	if err != nil {
 		w.log.Debugf("%v", err)
 	}
 	return n, err
 }
 
+// reserve reserves n bytes of temporary space more for the tmpfile.
+func (w *swiftWriter) reserve(n int64) error {
+	if err := tmpBudget.acquire(n); err != nil {
+		w.log.Warnf("Couldn't reserve %d bytes for '%s' [%v]", n, w.sf.Abs(), err)
+		return err
+	}
+	w.reserved += n
+	return nil
+}
+
+// position returns the offset in the file for data written at off. If data
+// before the appended data is modified, the object is downloaded into the
+// tmpfile and uploaded as a whole.
+func (w *swiftWriter) position(off int64) (int64, error) {
+	if w.appendSize == 0 {
+		if w.overwrittenSize > 0 && off > w.extent {
+			// A hole would hide the data of the overwritten object.
+			if err := w.downloadOverwritten(); err != nil {
+				return 0, err
+			}
+		}
+		return off, nil
+	}
+
+	if !w.appendOnly && !w.written && off == 0 {
+		w.log.Debugf("Overwrite '%s' (size=%d)", w.sf.Abs(), w.appendSize)
+		w.overwrittenSize = w.appendSize
+		w.appendSize = 0
+		w.extent = 0
+		return off, nil
+	}
+	if w.appendOnly && !w.written && off < w.appendSize {
+		w.appendShift = w.appendSize
+	}
+	off += w.appendShift
+	if off >= w.appendSize {
+		return off, nil
+	}
+
+	w.log.Debugf("Download '%s' to modify it", w.sf.Abs())
+	if err := w.downloadAppended(); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// downloadAppended downloads the object which is appended to into the
+// tmpfile, so that the tmpfile has the whole file.
+func (w *swiftWriter) downloadAppended() error {
+	if err := w.reserve(w.appendSize); err != nil {
+		return err
+	}
+	body, err := w.swift.DownloadRange(w.sf.Abs(), 0, w.appendSize)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err = w.writeFrom(body, 0); err != nil {
+		return err
+	}
+	w.appendSize = 0
+	return nil
+}
+
+// downloadOverwritten downloads the data of the overwritten object after the
+// data in the tmpfile, so that the tmpfile has the whole file.
+func (w *swiftWriter) downloadOverwritten() error {
+	off, size := w.extent, w.overwrittenSize
+	w.overwrittenSize = 0
+	if off >= size {
+		return nil
+	}
+
+	body, err := w.swift.DownloadRange(w.sf.Abs(), off, size-off)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return w.writeFrom(body, off)
+}
+
+// writeTmp writes to the tmpfile and updates the checksums if the data follows
+// the data written before.
+func (w *swiftWriter) writeTmp(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > w.extent {
+		if err := w.reserve(end - w.extent); err != nil {
+			return 0, err
+		}
+		w.extent = end
+	}
+
+	n, err := w.tmpfile.WriteAt(p, off)
+	if off != w.hashed {
+		w.unhashed = true
+	} else if !w.unhashed {
+		w.md5Hash.Write(p[:n])
+		if w.sha256Hash != nil {
+			w.sha256Hash.Write(p[:n])
+		}
+		w.hashed += int64(n)
+	}
+	return n, err
+}
+
+// store uploads the tmpfile of the size, or copies the object on the server
+// side.
+func (w *swiftWriter) store(size int64) error {
+	if w.continued {
+		if err := w.loadMetadata(); err != nil {
+			return err
+		}
+	}
+	if w.overwrittenSize > 0 {
+		if err := w.downloadOverwritten(); err != nil {
+			return err
+		}
+		size = w.extent
+	}
+
+	lob, segmented := w.swift.(largeObjectBackend)
+	if w.copySwift != nil {
+		w.log.Debugf("Copy '%s' to '%s' on the server side", w.copyName, w.sf.Abs())
+		if err := w.copySwift.CopyTo(w.copyName, w.swift, w.sf.Abs(), w.headers()); err != nil {
+			return err
+		} else if len(w.expiry.Headers) == 0 {
+			// Swift keeps the expiry of the source.
+			return setExpiry(w.swift, w.sf.Abs(), time.Time{})
+		}
+		return nil
+	} else if w.appendSize > 0 && segmented {
+		w.detectContentType()
+		return w.uploadAppended(lob, size)
+	} else if w.appendSize > 0 && size > w.appendSize {
+		// The backend can't append, so the file is uploaded as a whole.
+		w.log.Debugf("Download '%s' to append to it", w.sf.Abs())
+		if err := w.downloadAppended(); err != nil {
+			return err
+		}
+	} else if w.appendSize > 0 {
+		w.log.Debugf("Nothing was appended to '%s'", w.sf.Abs())
+		return nil
+	}
+
+	w.detectContentType()
+	if err := w.checksums(size); err != nil {
+		return err
+	}
+	if segmented && w.segmentSize > 0 && size > w.segmentSize {
+		// The manifest is written when all segments are uploaded, so the
+		// upload is atomic anyway.
+		return w.uploadSegments(lob, size)
+	} else if w.atomic {
+		return w.uploadAtomically()
+	}
+	return w.upload(w.sf.Abs())
+}
+
 func (w *swiftWriter) Close() error {
 	if w.afterClosed != nil {
 		defer w.afterClosed(w)
 	}
 
+	// wait for the writes in progress
+	w.m.Lock()
+	defer w.m.Unlock()
+
 	// start uploading
 	if w.tmpfile != nil {
 
@@ -216,17 +851,26 @@ func (w *swiftWriter) Close() error {
 			w.uploadComplete = true
 		}()
 
-		if err := w.upload(); err != nil {
+		if err := w.store(s.Size()); err != nil {
 			w.uploadErr = err
 			w.log.Debugf("Upload: complete with error. [%v]", err)
 		}
 
 		// remove temporary file
 		os.Remove(w.tmpfile.Name())
+		tmpBudget.release(w.reserved)
+		w.reserved = 0
 
 		if w.uploadErr != nil {
 			return w.uploadErr
 		}
+		if w.md5sum != "" {
+			sums := "md5=" + w.md5sum
+			if w.sha256sum != "" {
+				sums += " sha256=" + w.sha256sum
+			}
+			w.log.Infof("'%s' was verified [%s]", w.sf.Abs(), sums)
+		}
 		w.log.Debugf("'%s' was uploaded successfully", w.sf.Abs())
 
 		//}()
@@ -238,20 +882,6 @@ func (w *swiftWriter) Close() error {
 	return nil
 }
 
-func createTmpFile() (string, error) {
-	t := time.Now().Format(time.RFC3339Nano)
-	h := sha256.Sum256([]byte(t))
-	fname := filepath.Join(os.TempDir(), "ojs-"+hex.EncodeToString(h[:]))
-
-	f, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, 0600)
-	if err != nil {
-		return "", err
-	}
-	f.Close()
-
-	return fname, nil
-}
-
 // From https://stackoverflow.com/questions/46019484/buffer-implementing-io-writerat-in-go
 
 // WriteBuffer is a simple type that implements io.WriterAt on an in-memory buffer.
@@ -2,12 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/pkg/sftp"
 )
 
 func generateTestFile(filename string, size int64) (data []byte, err error) {
@@ -56,9 +65,9 @@ func TestReaderDownload(t *testing.T) {
 	}
 
 	f := &SwiftFile{
-		objectname: filename,
-		size:       0,
-		modtime:    time.Now(),
+		name:    filename,
+		size:    0,
+		modtime: time.Now(),
 	}
 
 	r := swiftReader{
@@ -109,9 +118,9 @@ func TestWriterUpload(t *testing.T) {
 	}
 
 	f := &SwiftFile{
-		objectname: filename,
-		size:       0,
-		modtime:    time.Now(),
+		name:    filename,
+		size:    0,
+		modtime: time.Now(),
 	}
 
 	w := swiftWriter{
@@ -155,3 +164,372 @@ func TestWriterUpload(t *testing.T) {
 		t.Errorf("Temporary file is sill exist")
 	}
 }
+
+func TestUploadChecksum(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.config.ChecksumSHA256 = true
+	fs := NewSwiftFS(s)
+
+	data := []byte("hello world, this is the content")
+	md5sum := md5.Sum(data)
+	sha256sum := sha256.Sum256(data)
+
+	// sequential and out-of-order writes
+	for _, order := range [][]int{{0, 1}, {1, 0}} {
+		wa, err := fs.Filewrite(sftp.NewRequest("Put", "/a.dat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := wa.(*swiftWriter)
+		parts := [][]byte{data[:10], data[10:]}
+		offsets := []int64{0, 10}
+		for _, i := range order {
+			w.WriteAt(parts[i], offsets[i])
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, err := s.Get("a.dat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Etag().Get() != hex.EncodeToString(md5sum[:]) {
+			t.Errorf("Unexpected ETag %s", hdr.Etag().Get())
+		}
+		if hdr.Metadata().Get("sha256") != hex.EncodeToString(sha256sum[:]) {
+			t.Errorf("Unexpected SHA-256 %s", hdr.Metadata().Get("sha256"))
+		}
+	}
+
+	// the tmpfile is corrupted before the upload
+	wa, _ := fs.Filewrite(sftp.NewRequest("Put", "/b.dat"))
+	w := wa.(*swiftWriter)
+	w.WriteAt(data, 0)
+	tf, _ := os.OpenFile(w.tmpfile.Name(), os.O_WRONLY, 0)
+	tf.WriteAt([]byte("X"), 3)
+	tf.Close()
+	if err := w.Close(); err != errChecksumMismatch {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+	if _, err := s.Get("b.dat"); err == nil {
+		t.Error("Corrupted object was stored")
+	}
+}
+
+func TestUploadEtagMismatch(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	client := startFakeSftp(t, s)
+
+	// Swift rejects the data as if it was corrupted on the way.
+	var rejected int32
+	var etag atomic.Value
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/a.dat") {
+			etag.Store(r.Header.Get("Etag"))
+		}
+		segment := strings.Contains(r.URL.Path, "/c1_segments/") && !strings.HasSuffix(r.URL.Path, "/")
+		if r.Method == "PUT" && (segment || strings.HasSuffix(r.URL.Path, "/a.dat")) {
+			atomic.AddInt32(&rejected, 1)
+			return http.StatusUnprocessableEntity
+		}
+		return 0
+	}
+
+	w, err := client.Create("/a.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello world"))
+	if err = w.Close(); err == nil {
+		t.Error("The rejected upload succeeded")
+	}
+	if _, err = s.Get("a.dat"); !isNotFound(err) {
+		t.Errorf("The rejected object was stored: %v", err)
+	}
+	if sum := md5.Sum([]byte("hello world")); etag.Load() != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected ETag %v", etag.Load())
+	}
+
+	// a rejected segment fails the whole upload
+	s.config.SegmentSize = 1
+	w, _ = client.Create("/b.dat")
+	w.Write(bytes.Repeat([]byte("x"), 1024*1024+1))
+	if err = w.Close(); err == nil {
+		t.Error("The upload with a rejected segment succeeded")
+	}
+	if _, err = s.Get("b.dat"); !isNotFound(err) {
+		t.Errorf("The manifest was written: %v", err)
+	}
+	if atomic.LoadInt32(&rejected) < 2 {
+		t.Errorf("Unexpected number of rejected uploads %d", rejected)
+	}
+
+	// the ETag of an upload is the MD5 of the data
+	f.Fail = nil
+	hdr := schwift.NewObjectHeaders()
+	hdr.Etag().Set("0123456789abcdef0123456789abcdef")
+	if err = s.Upload("c.dat", strings.NewReader("data"), hdr); err == nil {
+		t.Error("The upload with a wrong ETag succeeded")
+	} else if _, err = s.Get("c.dat"); !isNotFound(err) {
+		t.Errorf("The object with a wrong ETag was stored: %v", err)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.config.SegmentSize = 1
+	client := startFakeSftp(t, s)
+
+	data := make([]byte, 2*1024*1024+12345)
+	rand.Read(data)
+	check := func(name string, expected []byte) {
+		t.Helper()
+		r, err := client.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		downloaded, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(downloaded, expected) {
+			t.Errorf("%s: content differs (size=%d, expected %d)", name, len(downloaded), len(expected))
+		}
+	}
+
+	// segmented upload
+	w, _ := client.Create("/big.dat")
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, _ := s.Get("big.dat")
+	if !isLargeObject(hdr) {
+		t.Error("big.dat is not a large object")
+	}
+	check("/big.dat", data)
+	if sum, _ := checksum(s, "big.dat", "md5"); sum != hdr.Metadata().Get("md5") {
+		t.Errorf("Unexpected MD5 %s", sum)
+	}
+
+	// an interrupted upload continued with absolute offsets
+	cut := 1024*1024 + 777
+	w, _ = client.Create("/resume.dat")
+	w.Write(data[:cut])
+	w.Close()
+	w, err := client.OpenFile("/resume.dat", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Seek(int64(cut), io.SeekStart)
+	w.Write(data[cut:])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check("/resume.dat", data)
+
+	// append mode with offsets relative to the end of a large object
+	w, _ = client.Create("/append.dat")
+	w.Write(data[:cut])
+	w.Close()
+	w, _ = client.OpenFile("/append.dat", os.O_WRONLY|os.O_APPEND)
+	w.Write(data[cut:])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check("/append.dat", data)
+	if hdr, _ = s.Get("append.dat"); hdr.Metadata().Get("md5") != "" {
+		t.Error("Stale MD5 metadata remains")
+	}
+
+	// appending to a regular object converts it to a large object
+	w, _ = client.Create("/plain.dat")
+	w.Write([]byte("abc"))
+	w.Close()
+	w, _ = client.OpenFile("/plain.dat", os.O_WRONLY|os.O_APPEND)
+	w.Write([]byte("def"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check("/plain.dat", []byte("abcdef"))
+	if hdr, _ = s.Get("plain.dat"); !isLargeObject(hdr) {
+		t.Error("plain.dat is not a large object")
+	}
+
+	// modifying the beginning without truncation
+	w, _ = client.OpenFile("/small.dat", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	w.Write([]byte("hello world"))
+	w.Close()
+	w, _ = client.OpenFile("/small.dat", os.O_WRONLY)
+	w.Write([]byte("HELLO"))
+	w.Close()
+	check("/small.dat", []byte("HELLO world"))
+
+	// rename moves the manifest, remove deletes the segments
+	if err = client.Rename("/big.dat", "/moved.dat"); err != nil {
+		t.Fatal(err)
+	}
+	check("/moved.dat", data)
+	segments := s.WithContainer("c1_segments")
+	before, _ := readDirectory(segments, "")
+	if err = client.Remove("/moved.dat"); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := readDirectory(segments, "")
+	if len(after) >= len(before) {
+		t.Errorf("Segments were not deleted (%d -> %d)", len(before), len(after))
+	}
+}
+
+func TestResumeInterruptedUpload(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.config.SegmentSize = 1
+
+	var segments int32
+	f.Fail = func(r *http.Request) int {
+		if r.Method == "PUT" && strings.Contains(r.URL.Path, "/c1_segments/") && !strings.HasSuffix(r.URL.Path, "/") {
+			atomic.AddInt32(&segments, 1)
+		}
+		return 0
+	}
+
+	data := make([]byte, 2*1024*1024+12345)
+	rand.Read(data)
+	cut := 1024*1024 + 777
+
+	// the connection drops in the middle of the upload
+	client := startFakeSftp(t, s)
+	w, err := client.Create("/big.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data[:cut])
+	client.Close()
+
+	// the received data is stored when the server closes the file
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if hdr, err := s.Get("big.dat"); err == nil && hdr.SizeBytes().Get() == uint64(cut) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("The received data was not stored: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// reput continues at the size of the stored object
+	atomic.StoreInt32(&segments, 0)
+	client = startFakeSftp(t, s)
+	fi, err := client.Stat("/big.dat")
+	if err != nil || fi.Size() != int64(cut) {
+		t.Fatalf("Unexpected stat %v %v", fi, err)
+	}
+	if w, err = client.OpenFile("/big.dat", os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+	w.Seek(fi.Size(), io.SeekStart)
+	w.Write(data[cut:])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := client.Open("/big.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(downloaded, data) {
+		t.Errorf("Content differs (size=%d, expected %d)", len(downloaded), len(data))
+	}
+
+	// only the rest is uploaded, in two segments of at most 1 MiB
+	if n := atomic.LoadInt32(&segments); n != 2 {
+		t.Errorf("Expected 2 new segments, but %d", n)
+	}
+}
+
+func TestAppendMetadata(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClient(f, "c1")
+	s.config.SegmentSize = 1
+	s.config.ChecksumSHA256 = true
+	client := startFakeSftp(t, s)
+
+	var gets int32
+	f.Fail = func(r *http.Request) int {
+		// the manifest is read to delete the old segments
+		if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/c1/a.dat") && r.URL.RawQuery == "" {
+			atomic.AddInt32(&gets, 1)
+		}
+		return 0
+	}
+
+	put := func(name string, flags int, off int64, data string) {
+		t.Helper()
+		w, err := client.OpenFile(name, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Seek(off, io.SeekStart)
+		w.Write([]byte(data))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(expected string, large bool) {
+		t.Helper()
+		if data, err := download(s, "a.dat", 0, 0); err != nil || data != expected {
+			t.Errorf("Unexpected content %q %v", data, err)
+		}
+		hdr, err := s.Get("a.dat")
+		if err != nil {
+			t.Fatal(err)
+		} else if isLargeObject(hdr) != large {
+			t.Errorf("Unexpected large object %v", isLargeObject(hdr))
+		}
+		if owner := hdr.Metadata().Get("owner"); owner != "alice" {
+			t.Errorf("The metadata was not kept (owner=%q)", owner)
+		}
+		sum := sha256.Sum256([]byte(expected))
+		if stored := hdr.Metadata().Get("sha256"); stored != "" && stored != hex.EncodeToString(sum[:]) {
+			t.Errorf("Stale SHA-256 %s", stored)
+		}
+	}
+
+	put("/a.dat", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0, "hello")
+	hdr := schwift.NewObjectHeaders()
+	hdr.Metadata().Set("owner", "alice")
+	if err := s.SetMetadata("a.dat", hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	// appended in segments
+	put("/a.dat", os.O_WRONLY|os.O_APPEND, 0, " world")
+	check("hello world", true)
+
+	// continued at the end
+	put("/a.dat", os.O_WRONLY, 11, "!")
+	check("hello world!", true)
+
+	// overwritten from the beginning without truncation, without downloading
+	// the object
+	atomic.StoreInt32(&gets, 0)
+	put("/a.dat", os.O_WRONLY, 0, "HELLO WORLD!")
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Errorf("The object was downloaded %d times", n)
+	}
+	check("HELLO WORLD!", false)
+
+	// the rest of the object is kept
+	put("/a.dat", os.O_WRONLY, 0, "Hello")
+	check("Hello WORLD!", false)
+}
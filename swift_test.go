@@ -16,6 +16,40 @@ func TestAuthFromEnv(t *testing.T) {
 	}
 }
 
+func TestAuthKeystone(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *Config)
+		ok    bool
+	}{
+		{"password", func(c *Config) {}, true},
+		{"wrong password", func(c *Config) { c.OsPassword = "wrong" }, false},
+		{"application credential", func(c *Config) {
+			c.OsUsername, c.OsPassword = "", ""
+			c.OsApplicationCredentialID = "app"
+			c.OsApplicationCredentialSecret = "secret"
+		}, true},
+		{"token", func(c *Config) {
+			c.OsUsername, c.OsPassword = "", ""
+			c.OsToken = fakeSwiftToken
+		}, true},
+	}
+
+	for _, test := range tests {
+		c := defaultConfigForTesting()
+		test.setup(&c)
+		s := NewSwift(c)
+		err := s.Init()
+		if test.ok && err == nil {
+			s.setContainer("ojs-test-container")
+			_, err = s.ExistsContainer()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
+
 func TestPut(t *testing.T) {
 	s := swiftForTesting()
 
@@ -40,9 +74,9 @@ func TestPut(t *testing.T) {
 	tmpfilename := "tmp-" + filename
 	existTestfile := false
 	for _, obj := range ls {
-		if obj.Name == filename {
+		if obj.Name() == filename {
 			existTestfile = true
-		} else if obj.Name == tmpfilename {
+		} else if obj.Name() == tmpfilename {
 			t.Errorf("Temporary file '%s' exists", tmpfilename)
 		}
 	}
@@ -61,7 +95,7 @@ func TestGet(t *testing.T) {
 	if err != nil {
 		t.Errorf("%v\n", err)
 		t.Fail()
-	} else if header == nil {
+	} else if !header.SizeBytes().Exists() {
 		t.Errorf("Couldn't get the header of the object")
 		t.Fail()
 	}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// Authentication methods without Keystone
+const (
+	authTypeKeystone = "keystone"
+	authTypeTempAuth = "tempauth"
+	authTypeStatic   = "static"
+)
+
+// tempAuthFromEnv sets the TempAuth parameters which are not configured to
+// the environment variables of python-swiftclient.
+func (c *Config) tempAuthFromEnv() {
+	if c.SwiftAuthURL == "" {
+		c.SwiftAuthURL = os.Getenv("ST_AUTH")
+	}
+	if c.SwiftUser == "" {
+		c.SwiftUser = os.Getenv("ST_USER")
+	}
+	if c.SwiftKey == "" {
+		c.SwiftKey = os.Getenv("ST_KEY")
+	}
+}
+
+// validateAuthType checks that the parameters of the authentication method
+// are configured.
+func (c *Config) validateAuthType() error {
+	switch c.AuthType {
+	case "", authTypeKeystone:
+	case authTypeTempAuth:
+		if c.SwiftAuthURL == "" || c.SwiftUser == "" || c.SwiftKey == "" {
+			return fmt.Errorf("swift_auth_url, swift_user and swift_key are required for TempAuth")
+		}
+	case authTypeStatic:
+		if c.OsSwiftURL == "" || c.OsToken == "" {
+			return fmt.Errorf("os_swift_url and os_token are required for the static authentication")
+		}
+	default:
+		return fmt.Errorf("Invalid auth_type '%s', must be keystone, tempauth or static", c.AuthType)
+	}
+	return nil
+}
+
+// getTempAuthClient authenticates with the v1.0 API of TempAuth (or other
+// auth middlewares which are compatible with it). The token is issued again
+// when it expires.
+func (s *Swift) getTempAuthClient() (*gophercloud.ServiceClient, error) {
+	s.authClient = &gophercloud.ProviderClient{
+		HTTPClient: http.Client{Transport: s.transport},
+	}
+	s.authClient.UseTokenLock()
+
+	storageURL, token, err := s.tempAuth()
+	if err != nil {
+		return nil, err
+	}
+	s.authClient.SetToken(token)
+	s.authClient.ReauthFunc = func() error {
+		_, token, err := s.tempAuth()
+		if err != nil {
+			return err
+		}
+		s.authClient.SetToken(token)
+		return nil
+	}
+
+	// The storage URL in the response may be unreachable from this server.
+	if s.config.OsSwiftURL != "" {
+		storageURL = s.config.OsSwiftURL
+	}
+	return s.serviceClient(storageURL), nil
+}
+
+// tempAuth requests a token and returns it with the storage URL.
+func (s *Swift) tempAuth() (storageURL string, token string, err error) {
+	req, err := http.NewRequest("GET", s.config.SwiftAuthURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Auth-User", s.config.SwiftUser)
+	req.Header.Set("X-Auth-Key", s.config.SwiftKey)
+
+	resp, err := s.authClient.HTTPClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", "", fmt.Errorf("TempAuth failed for '%s' [%s]", s.config.SwiftUser, resp.Status)
+	}
+
+	storageURL = resp.Header.Get("X-Storage-Url")
+	token = resp.Header.Get("X-Auth-Token")
+	if token == "" {
+		token = resp.Header.Get("X-Storage-Token")
+	}
+	if storageURL == "" || token == "" {
+		return "", "", fmt.Errorf("TempAuth returned no storage URL or token")
+	}
+
+	log.Debugf("Authenticated '%s' by TempAuth (storage=%s)", s.config.SwiftUser, storageURL)
+	return storageURL, token, nil
+}
+
+// getStaticClient uses the configured storage URL and token. The token can't
+// be issued again when it expires.
+func (s *Swift) getStaticClient() *gophercloud.ServiceClient {
+	s.authClient = &gophercloud.ProviderClient{
+		HTTPClient: http.Client{Transport: s.transport},
+	}
+	s.authClient.UseTokenLock()
+	s.authClient.SetToken(s.config.OsToken)
+
+	return s.serviceClient(s.config.OsSwiftURL)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tempAuthServer issues a new token for every authentication and accepts
+// only the latest one.
+type tempAuthServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	tokens int
+}
+
+func newTempAuthServer() *tempAuthServer {
+	ts := &tempAuthServer{}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.lock.Lock()
+		defer ts.lock.Unlock()
+
+		if r.URL.Path == "/auth/v1.0" {
+			if r.Header.Get("X-Auth-User") != "test:tester" || r.Header.Get("X-Auth-Key") != "testing" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			ts.tokens++
+			w.Header().Set("X-Storage-Url", ts.URL+"/v1/AUTH_test")
+			w.Header().Set("X-Auth-Token", ts.token())
+			return
+		}
+
+		if strings.TrimSuffix(r.URL.Path, "/") != "/v1/AUTH_test" || r.Header.Get("X-Auth-Token") != ts.token() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Account-Bytes-Used", "42")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return ts
+}
+
+func (ts *tempAuthServer) token() string {
+	return "AUTH_tk" + string(rune('0'+ts.tokens))
+}
+
+func TestTempAuth(t *testing.T) {
+	ts := newTempAuthServer()
+	defer ts.Close()
+
+	s := NewSwift(Config{
+		AuthType:     authTypeTempAuth,
+		SwiftAuthURL: ts.URL + "/auth/v1.0",
+		SwiftUser:    "test:tester",
+		SwiftKey:     "testing",
+	})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	used, _, err := s.Usage()
+	if err != nil || used != 42 {
+		t.Fatalf("unexpected usage %d %v", used, err)
+	}
+
+	// the token expires and is issued again
+	ts.lock.Lock()
+	ts.tokens++
+	ts.lock.Unlock()
+	if _, _, err = s.Usage(); err != nil {
+		t.Errorf("token was not issued again: %v", err)
+	}
+
+	s = NewSwift(Config{
+		AuthType:     authTypeTempAuth,
+		SwiftAuthURL: ts.URL + "/auth/v1.0",
+		SwiftUser:    "test:tester",
+		SwiftKey:     "wrong",
+	})
+	if err := s.Init(); err == nil {
+		t.Errorf("wrong key must be an error")
+	}
+}
+
+func TestStaticAuth(t *testing.T) {
+	ts := newTempAuthServer()
+	defer ts.Close()
+
+	s := NewSwift(Config{
+		AuthType:   authTypeStatic,
+		OsSwiftURL: ts.URL + "/v1/AUTH_test",
+		OsToken:    ts.token(),
+	})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, err := s.Usage(); err != nil || used != 42 {
+		t.Errorf("unexpected usage %d %v", used, err)
+	}
+}
+
+func TestValidateAuthType(t *testing.T) {
+	for _, c := range []Config{
+		{AuthType: "kerberos"},
+		{AuthType: authTypeTempAuth, SwiftAuthURL: "http://localhost:8080/auth/v1.0"},
+		{AuthType: authTypeStatic, OsToken: "token"},
+	} {
+		if err := c.validateAuthType(); err == nil {
+			t.Errorf("%+v must be invalid", c)
+		}
+	}
+}
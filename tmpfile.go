@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Prefix of the names of tmpfiles
+const tmpFilePrefix = "ojs-"
+
+var (
+	// Directory for tmpfiles. os.TempDir() is used if it is empty.
+	tmpDir string
+
+	// Total size of the tmpfiles, nil for no limit
+	tmpBudget *tmpSpace
+)
+
+// errTmpSpace is returned if a transfer needs more temporary space than is
+// available.
+var errTmpSpace = errors.New("Not enough temporary space for the transfer")
+
+// InitTmpFiles sets up the directory and the budget of tmpfiles, and removes
+// the tmpfiles left over by a previous process in the directory.
+func InitTmpFiles(conf Config) error {
+	tmpDir = conf.TmpDir
+	if tmpDir != "" {
+		if err := os.MkdirAll(tmpDir, 0700); err != nil {
+			return err
+		}
+	}
+
+	if conf.TmpMaxSize > 0 {
+		tmpBudget = newTmpSpace(int64(conf.TmpMaxSize)*1024*1024, time.Duration(conf.TmpWait)*time.Second)
+	} else {
+		tmpBudget = nil
+	}
+
+	if tmpDir == "" {
+		// The temporary directory of the system may be shared with other
+		// servers, so their tmpfiles are kept.
+		return nil
+	}
+	return sweepTmpFiles()
+}
+
+// sweepTmpFiles removes all tmpfiles in tmpDir. The directory must not be
+// shared with another running server.
+func sweepTmpFiles() error {
+	names, err := filepath.Glob(filepath.Join(tmpDirectory(), tmpFilePrefix+"*"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			log.Warnf("Couldn't remove stale tmpfile '%s' [%v]", name, err)
+			continue
+		}
+		log.Debugf("Removed stale tmpfile '%s'", name)
+	}
+	if len(names) > 0 {
+		log.Infof("Removed %d stale tmpfiles in %s", len(names), tmpDirectory())
+	}
+	return nil
+}
+
+func tmpDirectory() string {
+	if tmpDir != "" {
+		return tmpDir
+	}
+	return os.TempDir()
+}
+
+// createTmpFile creates an empty tmpfile with a unique name and returns the
+// name.
+func createTmpFile() (string, error) {
+	f, err := ioutil.TempFile(tmpDirectory(), tmpFilePrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	return f.Name(), nil
+}
+
+// tmpSpace limits the total size of the tmpfiles. Transfers which exceed the
+// limit wait until other transfers release their space, or fail after wait.
+// All methods do nothing on a nil *tmpSpace.
+type tmpSpace struct {
+	limit int64
+	wait  time.Duration
+
+	lock     sync.Mutex
+	used     int64
+	released chan struct{} // closed when space is released
+}
+
+func newTmpSpace(limit int64, wait time.Duration) *tmpSpace {
+	return &tmpSpace{
+		limit:    limit,
+		wait:     wait,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire reserves n bytes.
+func (t *tmpSpace) acquire(n int64) error {
+	if t == nil || n <= 0 {
+		return nil
+	} else if n > t.limit {
+		return errTmpSpace
+	}
+
+	timeout := time.NewTimer(t.wait)
+	defer timeout.Stop()
+
+	for {
+		t.lock.Lock()
+		if t.used+n <= t.limit {
+			t.used += n
+			t.lock.Unlock()
+			return nil
+		}
+		released := t.released
+		t.lock.Unlock()
+
+		select {
+		case <-released:
+		case <-timeout.C:
+			return errTmpSpace
+		}
+	}
+}
+
+// release frees n bytes reserved by acquire.
+func (t *tmpSpace) release(n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.used -= n
+	close(t.released)
+	t.released = make(chan struct{})
+}
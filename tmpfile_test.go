@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTmpSpace(t *testing.T) {
+	space := newTmpSpace(100, 0)
+	if err := space.acquire(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := space.acquire(60); err != errTmpSpace {
+		t.Errorf("acquire over the limit returned %v", err)
+	}
+	if err := space.acquire(101); err != errTmpSpace {
+		t.Errorf("acquire of more than the limit returned %v", err)
+	}
+
+	// A waiting transfer gets the space when it is released.
+	space.wait = 5 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		space.release(60)
+	}()
+	if err := space.acquire(60); err != nil {
+		t.Errorf("acquire after release returned %v", err)
+	}
+
+	var unlimited *tmpSpace
+	if err := unlimited.acquire(1 << 40); err != nil {
+		t.Errorf("unlimited acquire returned %v", err)
+	}
+	unlimited.release(1 << 40)
+}
+
+func TestInitTmpFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swift-sftp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		tmpDir = ""
+		tmpBudget = nil
+	}()
+
+	stale := filepath.Join(dir, tmpFilePrefix+"stale")
+	other := filepath.Join(dir, "other")
+	ioutil.WriteFile(stale, []byte("x"), 0600)
+	ioutil.WriteFile(other, []byte("x"), 0600)
+
+	if err = InitTmpFiles(Config{TmpDir: dir, TmpMaxSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale tmpfile was not removed")
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Errorf("other file was removed")
+	}
+	if tmpBudget == nil || tmpBudget.limit != 1024*1024 {
+		t.Errorf("budget is not set")
+	}
+
+	name1, _ := createTmpFile()
+	name2, _ := createTmpFile()
+	if name1 == name2 || filepath.Dir(name1) != dir {
+		t.Errorf("unexpected tmpfiles %s %s", name1, name2)
+	}
+
+	// The temporary directory of the system is not swept.
+	prev, ok := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer func() {
+		if ok {
+			os.Setenv("TMPDIR", prev)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+	}()
+	if err = InitTmpFiles(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(name1); err != nil {
+		t.Errorf("tmpfile in the system directory was removed")
+	}
+}
+
+func TestTmpSpaceTransfer(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	client := startFakeSftp(t, fakeSwiftClient(f, "c1"))
+
+	tmpBudget = newTmpSpace(1024, 0)
+	defer func() { tmpBudget = nil }()
+
+	w, _ := client.Create("/small.dat")
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tmpBudget.used != 0 {
+		t.Errorf("Space was not released: %d", tmpBudget.used)
+	}
+
+	w, _ = client.Create("/big.dat")
+	if _, err := w.Write(make([]byte, 2000)); err == nil {
+		t.Error("Write over the budget succeeded")
+	}
+	w.Close()
+
+	r, err := client.Open("/small.dat")
+	if err != nil {
+		t.Fatalf("Read within the budget failed: %v", err)
+	}
+	defer r.Close()
+	if tmpBudget.used != 1000 {
+		t.Errorf("Reader did not reserve the space: %d", tmpBudget.used)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// newHTTPTransport returns the transport for the requests to Keystone and
+// Swift, configured with the TLS, proxy and timeout options.
+func newHTTPTransport(c Config) (http.RoundTripper, error) {
+	connectTimeout := 30 * time.Second
+	if c.SwiftConnectTimeout > 0 {
+		connectTimeout = time.Duration(c.SwiftConnectTimeout) * time.Second
+	}
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   connectTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: time.Duration(c.SwiftResponseTimeout) * time.Second,
+		// Objects stored with Content-Encoding are downloaded as they are,
+		// not decompressed.
+		DisableCompression: true,
+	}
+
+	if c.HTTPProxy != "" {
+		u, err := url.Parse(c.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy '%s' [%v]", c.HTTPProxy, err)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+
+	// The debug transport logs the requests if it is enabled.
+	if _, ok := http.DefaultTransport.(*DebugTransport); ok {
+		return &DebugTransport{Transport: t}, nil
+	}
+	return t, nil
+}
+
+// newTLSConfig returns the TLS configuration with the CA bundle and the client
+// certificate, or nil if none is configured.
+func newTLSConfig(c Config) (*tls.Config, error) {
+	if c.TLSCAFile == "" && c.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates are found in '%s'", c.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load the client certificate '%s' [%v]", c.TLSCertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// endpointAvailability returns the interface of the endpoint in the service
+// catalog.
+func endpointAvailability(name string) (gophercloud.Availability, error) {
+	switch name {
+	case "", "public":
+		return gophercloud.AvailabilityPublic, nil
+	case "internal":
+		return gophercloud.AvailabilityInternal, nil
+	case "admin":
+		return gophercloud.AvailabilityAdmin, nil
+	}
+	return "", fmt.Errorf("Invalid interface '%s', must be public, internal or admin", name)
+}
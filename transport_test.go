@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// writeClientCert writes a self-signed client certificate and its key.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "swift-sftp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := x509.MarshalECPrivateKey(key)
+
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encoded}), 0600)
+	return certFile, keyFile
+}
+
+func TestHTTPTransportTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swift-sftp-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	get := func(c Config) (int, error) {
+		transport, err := newHTTPTransport(c)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if _, err := get(Config{}); err == nil {
+		t.Errorf("server must not be trusted without the CA bundle")
+	}
+	if code, err := get(Config{TLSCAFile: caFile}); err != nil || code != http.StatusForbidden {
+		t.Errorf("expected 403 without a client certificate, got %d %v", code, err)
+	}
+	if code, err := get(Config{TLSCAFile: caFile, TLSCertFile: certFile, TLSKeyFile: keyFile}); err != nil || code != http.StatusOK {
+		t.Errorf("expected 200 with a client certificate, got %d %v", code, err)
+	}
+
+	if _, err := newHTTPTransport(Config{TLSCAFile: keyFile}); err == nil {
+		t.Errorf("CA bundle without certificates must be an error")
+	}
+}
+
+func TestHTTPTransportProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	transport, err := newHTTPTransport(Config{HTTPProxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://swift.example.com/v1/AUTH_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proxied != "http://swift.example.com/v1/AUTH_test" {
+		t.Errorf("request was not sent through the proxy: %q", proxied)
+	}
+}
+
+func TestObjectStorageEndpoint(t *testing.T) {
+	s := NewSwift(Config{OsSwiftURL: "https://swift.example.com/v1/AUTH_test"})
+	s.authClient = &gophercloud.ProviderClient{}
+	sc, err := s.getObjectStorageClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Endpoint != "https://swift.example.com/v1/AUTH_test/" {
+		t.Errorf("unexpected endpoint %s", sc.Endpoint)
+	}
+
+	for name, expected := range map[string]gophercloud.Availability{
+		"":         gophercloud.AvailabilityPublic,
+		"internal": gophercloud.AvailabilityInternal,
+		"admin":    gophercloud.AvailabilityAdmin,
+	} {
+		if a, err := endpointAvailability(name); err != nil || a != expected {
+			t.Errorf("interface '%s' is %s, expected %s", name, a, expected)
+		}
+	}
+	if _, err := endpointAvailability("private"); err == nil {
+		t.Errorf("unknown interface must be an error")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+const (
+	// Directory in each container where removed files are moved in trash mode,
+	// as ".trash/<date>/<path>"
+	trashDir = ".trash"
+	// Names of the directories of the dates in the trash
+	trashDateLayout = "2006-01-02"
+	// Suffix of a file removed again on the same day, to keep both
+	trashTimeLayout = "15-04-05"
+)
+
+// isTrashed returns true if the object is in the trash.
+func isTrashed(name string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(name, Delimiter), trashDir+Delimiter)
+}
+
+// trashName returns the name of the object in the trash when it is removed at
+// the time. A file removed again on the same day gets the time as a suffix.
+func trashName(s Backend, name string, now time.Time) string {
+	trashed := path.Join(trashDir, now.Format(trashDateLayout), name)
+	if _, err := s.Get(trashed); err == nil {
+		trashed += "." + now.Format(trashTimeLayout)
+	}
+	return trashed
+}
+
+// moveToTrash moves the object to the trash of its container. It expires after
+// trash_days, or never if it is negative.
+func (fs *SwiftFS) moveToTrash(s Backend, name string) error {
+	trashed := trashName(s, name, time.Now())
+	if err := s.MoveTo(name, s, trashed); err != nil {
+		return err
+	}
+	fs.log.Debugf("'%s' was moved to '%s'", name, trashed)
+
+	days := fs.swift.Config().TrashDays
+	if days <= 0 {
+		return nil
+	}
+
+	// A file which expires earlier is not kept longer.
+	at := time.Now().AddDate(0, 0, days)
+	if hdr, err := s.Get(trashed); err != nil {
+		return err
+	} else if hdr.ExpiresAt().Exists() && hdr.ExpiresAt().Get().Before(at) {
+		at = hdr.ExpiresAt().Get()
+	}
+	return setExpiry(s, trashed, at)
+}
+
+// setExpiry sets X-Delete-At of the object keeping its metadata. If at is
+// zero, the expiry is removed. The segments of a large object expire with it.
+func setExpiry(s Backend, name string, at time.Time) error {
+	hdr, err := s.Get(name)
+	if err != nil {
+		return err
+	} else if at.IsZero() && !hdr.ExpiresAt().Exists() {
+		return nil
+	}
+
+	expiry := schwift.NewObjectHeaders()
+	if at.IsZero() {
+		expiry.ExpiresAt().Clear()
+	} else {
+		expiry.ExpiresAt().Set(at)
+	}
+
+	if lob, ok := s.(largeObjectBackend); ok && isLargeObject(hdr) {
+		lo, err := lob.LargeObject(name)
+		if err != nil {
+			return err
+		}
+		segments, err := lo.Segments()
+		if err != nil {
+			return err
+		}
+		for _, seg := range segments {
+			if err = seg.Object.Update(expiry, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	meta := storedHeaders(hdr)
+	meta.Etag().Del()
+	meta.Set("X-Delete-At", expiry.Get("X-Delete-At"))
+	return s.SetMetadata(name, meta)
+}
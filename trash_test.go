@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+func TestTrash(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{SwiftTimeout: 10, Trash: true, TrashDays: 7})
+	upload(t, s, "d/a.txt", "v1")
+
+	client := startFakeSftp(t, s)
+	if err := client.Remove("/d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("d/a.txt"); !isNotFound(err) {
+		t.Errorf("The file was not removed: %v", err)
+	}
+
+	now := time.Now()
+	trashed := path.Join(trashDir, now.Format(trashDateLayout), "d/a.txt")
+	hdr, err := s.Get(trashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := now.Add(7 * 24 * time.Hour)
+	if at := hdr.ExpiresAt().Get(); at.Before(expected.Add(-time.Minute)) || at.After(expected.Add(time.Minute)) {
+		t.Errorf("Unexpected expiry %v", at)
+	}
+
+	// A file removed again on the same day is kept too.
+	upload(t, s, "d/a.txt", "v2")
+	if err = client.Remove("/d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := client.ReadDir("/" + path.Dir(trashed))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Errorf("Expected 2 files in the trash, but %v", entries)
+	}
+
+	// Renaming a file out of the trash restores it without the expiry.
+	if err = client.Rename("/"+trashed, "/d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if hdr, err = s.Get("d/a.txt"); err != nil {
+		t.Fatal(err)
+	} else if hdr.ExpiresAt().Exists() {
+		t.Errorf("The restored file expires at %v", hdr.ExpiresAt().Get())
+	}
+	if content, err := download(s, "d/a.txt", 0, 0); err != nil || content != "v1" {
+		t.Errorf("Expected v1 restored, but %q %v", content, err)
+	}
+
+	// Files in the trash are removed permanently.
+	for _, e := range entries {
+		name := path.Join(path.Dir(trashed), e.Name())
+		if name == trashed {
+			continue
+		}
+		if err = client.Remove("/" + name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.Get(name); !isNotFound(err) {
+			t.Errorf("%s was not removed: %v", name, err)
+		}
+	}
+	if files, _ := readDirectory(s, path.Dir(trashed)); len(files) != 0 {
+		t.Errorf("Unexpected files in the trash: %v", names(files))
+	}
+}
+
+func TestTrashDisabled(t *testing.T) {
+	b := NewMemoryBackend(Config{}).WithContainer("c1")
+	b.CreateContainer()
+	upload(t, b, "a.txt", "v1")
+
+	client := startFakeSftp(t, b)
+	if err := client.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := b.FirstInDirectory(trashDir); f != nil {
+		t.Errorf("The file was moved to the trash: %s", f.name)
+	}
+}
+
+func TestTrashExpiry(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{SwiftTimeout: 10, Trash: true, TrashDays: 7, SegmentSize: 1})
+	client := startFakeSftp(t, s)
+	now := time.Now()
+	dir := path.Join(trashDir, now.Format(trashDateLayout))
+
+	// A file which expires earlier is not kept longer in the trash.
+	hdr := schwift.NewObjectHeaders()
+	hdr.ExpiresAt().Set(now.Add(time.Hour))
+	if err := s.Upload("a.txt", strings.NewReader("data"), hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if hdr, err := s.Get(path.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	} else if at := hdr.ExpiresAt().Get(); at.After(now.Add(time.Hour + time.Minute)) {
+		t.Errorf("The expiry was extended to %v", at)
+	}
+
+	// The segments of a large object expire with it.
+	w, _ := client.Create("/big.dat")
+	w.Write(bytes.Repeat([]byte("x"), 2*1024*1024+1))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove("/big.dat"); err != nil {
+		t.Fatal(err)
+	}
+	trashed := path.Join(dir, "big.dat")
+	hdr, err := s.Get(trashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSegments := func(expected string) {
+		t.Helper()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		segments := f.containers["c1_segments"].objects
+		if len(segments) != 3 {
+			t.Fatalf("Expected 3 segments, but %d", len(segments))
+		}
+		for name, o := range segments {
+			if at := o.headers.Get("X-Delete-At"); at != expected {
+				t.Errorf("%s expires at %q, expected %q", name, at, expected)
+			}
+		}
+	}
+	checkSegments(hdr.Get("X-Delete-At"))
+
+	// Restoring the file removes the expiry of the segments too.
+	if err = client.Rename("/"+trashed, "/big.dat"); err != nil {
+		t.Fatal(err)
+	}
+	checkSegments("")
+
+	// -1 keeps the files in the trash until they are removed.
+	s.config.TrashDays = -1
+	upload(t, s, "b.txt", "data")
+	if err = client.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if hdr, err = s.Get(path.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	} else if hdr.ExpiresAt().Exists() {
+		t.Errorf("The file expires at %v", hdr.ExpiresAt().Get())
+	}
+}
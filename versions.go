@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// Virtual directory in each directory which lists the prior versions of
+	// its files as "<file>/<time>"
+	versionsDir = ".versions"
+	// Prior versions are kept in the container with this suffix
+	versionsContainerSuffix = "_versions"
+	// Names of the versions in the versions directory, without colons for
+	// Windows clients
+	versionTimeLayout = "2006-01-02T15-04-05.00000Z"
+	// Content type of the markers of deleted objects in the history container
+	deleteMarkerContentType = "application/x-deleted"
+)
+
+// versionedBackend is implemented by the backends which keep the prior
+// versions of objects.
+type versionedBackend interface {
+	// Versions returns the backend of the container of the prior versions and
+	// the versions of the object, oldest first. The names of the versions are
+	// objects of that container. The backend is nil if versioning is not
+	// enabled for the container.
+	Versions(name string) (Backend, []*SwiftFile, error)
+}
+
+// createVersionedContainer creates the container with a history container,
+// which keeps the prior version of an object when it is overwritten or
+// deleted.
+func (s *Swift) createVersionedContainer() error {
+	location := s.container + versionsContainerSuffix
+	if err := s.SchwiftClient.Container(location).Create(nil); err != nil {
+		return err
+	}
+
+	hdr := schwift.NewContainerHeaders()
+	hdr.HistoryLocation().Set(location)
+	return s.getContainer().Create(hdr.ToOpts())
+}
+
+// historyLocation returns the container of the prior versions, or "" if
+// versioning is not enabled for the container.
+func (s *Swift) historyLocation() (string, error) {
+	hdr, err := s.getContainer().Headers()
+	if err != nil {
+		return "", err
+	}
+	if location := hdr.HistoryLocation().Get(); location != "" {
+		return location, nil
+	}
+	return hdr.VersionsLocation().Get(), nil
+}
+
+// Versions returns the prior versions of the object. Swift stores them as
+// "<length><name>/<timestamp>" in the history container, where length is the
+// length of the name in 3 hex digits. Markers of deletions are skipped.
+func (s *Swift) Versions(name string) (Backend, []*SwiftFile, error) {
+	location, err := s.historyLocation()
+	if err != nil || location == "" {
+		return nil, nil, err
+	}
+	history := s.WithContainer(location).(*Swift)
+
+	prefix := fmt.Sprintf("%03x%s/", len(name), name)
+	iter := history.getContainer().Objects()
+	iter.Prefix = prefix
+	objs, err := iter.CollectDetailed()
+	if isNotFound(err) {
+		return history, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	versions := make([]*SwiftFile, 0, len(objs))
+	for _, oi := range objs {
+		if strings.HasPrefix(oi.ContentType, deleteMarkerContentType) {
+			continue
+		}
+		t, err := parseSwiftTimestamp(strings.TrimPrefix(oi.Object.Name(), prefix))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, &SwiftFile{
+			name:        oi.Object.Name(),
+			size:        int64(oi.SizeBytes),
+			modtime:     t,
+			contentType: oi.ContentType,
+		})
+	}
+	return history, versions, nil
+}
+
+// parseSwiftTimestamp parses a timestamp of Swift like "1700000000.12345".
+func parseSwiftTimestamp(ts string) (time.Time, error) {
+	sec, frac := ts, ""
+	if pos := strings.Index(ts, "."); pos >= 0 {
+		sec, frac = ts[:pos], ts[pos+1:]
+	}
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var ns int64
+	if frac != "" {
+		if ns, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(s, ns).UTC(), nil
+}
+
+// versionName returns the name of a version in the versions directory.
+func versionName(f *SwiftFile) string {
+	return f.modtime.UTC().Format(versionTimeLayout)
+}
+
+// versionPath is a path in a versions directory: the directory itself, the
+// directory of a file whose versions are listed, or a version of the file.
+type versionPath struct {
+	dir     string // directory which contains the versions directory
+	object  string // the file, "" for the versions directory itself
+	version string // name of the version, "" for the directory of the file
+}
+
+// path returns the path of the entry in the container.
+func (v *versionPath) path() string {
+	p := path.Join(v.dir, versionsDir)
+	if v.object != "" {
+		p = path.Join(p, path.Base(v.object), v.version)
+	}
+	return p
+}
+
+// versionPath returns the path in a versions directory for the object name, or
+// nil if the name is not in one or the versions are not exposed.
+func (fs *SwiftFS) versionPath(s Backend, name string) *versionPath {
+	if _, ok := s.(versionedBackend); !ok || !fs.swift.Config().ShowVersions {
+		return nil
+	}
+
+	elems := strings.Split(name, Delimiter)
+	for i, e := range elems {
+		if e != versionsDir {
+			continue
+		}
+		v := &versionPath{dir: strings.Join(elems[:i], Delimiter)}
+		if rest := elems[i+1:]; len(rest) > 0 {
+			v.object = path.Join(v.dir, rest[0])
+			v.version = strings.Join(rest[1:], Delimiter)
+		}
+		return v
+	}
+	return nil
+}
+
+// version returns the client of the container and the path in a versions
+// directory, or nil if the path is not in one.
+func (fs *SwiftFS) version(p string) (Backend, *versionPath) {
+	s, name, err := fs.container(p)
+	if err != nil || s == nil {
+		return nil, nil
+	}
+	v := fs.versionPath(s, name)
+	if v == nil {
+		return nil, nil
+	}
+	return s, v
+}
+
+// lookupVersion returns the entry of the path in a versions directory. A
+// version is returned as the object of the history container with its client.
+func (fs *SwiftFS) lookupVersion(s Backend, v *versionPath) (Backend, *SwiftFile, error) {
+	if v.object == "" {
+		return s, &SwiftFile{name: v.path() + Delimiter, modtime: time.Now()}, nil
+	}
+
+	history, versions, err := s.(versionedBackend).Versions(v.object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if v.version == "" {
+		// The file has versions or exists now.
+		f := &SwiftFile{name: v.path() + Delimiter, modtime: time.Now()}
+		if len(versions) > 0 {
+			f.modtime = versions[len(versions)-1].modtime
+			return s, f, nil
+		}
+		if hdr, err := s.Get(v.object); err != nil {
+			return nil, nil, err
+		} else if isDirectoryMarker(hdr) {
+			return nil, nil, os.ErrNotExist
+		}
+		return s, f, nil
+	}
+
+	for _, f := range versions {
+		if versionName(f) == v.version {
+			return history, f, nil
+		}
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// statVersion returns the entry of the path in a versions directory as the
+// client sees it.
+func (fs *SwiftFS) statVersion(s Backend, v *versionPath) (*SwiftFile, error) {
+	_, f, err := fs.lookupVersion(s, v)
+	if err != nil {
+		return nil, err
+	} else if v.version == "" {
+		return f, nil
+	}
+
+	entry := *f
+	entry.name = v.path()
+	return &entry, nil
+}
+
+// listVersions lists the versions directory, which has a directory for each
+// file of its directory, or the versions of a file.
+func (fs *SwiftFS) listVersions(s Backend, v *versionPath) ([]os.FileInfo, error) {
+	if v.object == "" {
+		files, err := readDirectory(s, v.dir)
+		if err != nil {
+			return nil, err
+		}
+
+		list := make([]os.FileInfo, 0, len(files))
+		for _, f := range files {
+			if f, ok := visibleFile(f); ok && !f.IsDir() {
+				list = append(list, &SwiftFile{
+					name:    path.Join(v.path(), f.Name()) + Delimiter,
+					modtime: f.modtime,
+				})
+			}
+		}
+		return list, nil
+	}
+
+	if v.version != "" {
+		return nil, sftp.ErrSshFxFailure
+	}
+	_, versions, err := s.(versionedBackend).Versions(v.object)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]os.FileInfo, 0, len(versions))
+	for _, f := range versions {
+		list = append(list, &SwiftFile{
+			name:    path.Join(v.path(), versionName(f)),
+			size:    f.size,
+			modtime: f.modtime,
+		})
+	}
+	return list, nil
+}
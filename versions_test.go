@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSwiftTimestamp(t *testing.T) {
+	cases := map[string]time.Time{
+		"1700000000":         time.Unix(1700000000, 0).UTC(),
+		"1700000000.12345":   time.Unix(1700000000, 123450000).UTC(),
+		"1700000000.0000001": time.Unix(1700000000, 100).UTC(),
+	}
+	for ts, expected := range cases {
+		if actual, err := parseSwiftTimestamp(ts); err != nil {
+			t.Errorf("%s %v", ts, err)
+		} else if !actual.Equal(expected) {
+			t.Errorf("%s expected %v, but %v", ts, expected, actual)
+		}
+	}
+	if _, err := parseSwiftTimestamp("x.1"); err == nil {
+		t.Error("Invalid timestamp was parsed")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{SwiftTimeout: 10, Versioning: true, ShowVersions: true})
+
+	client := startFakeSftp(t, s)
+	for _, content := range []string{"v1", "v2", "v3"} {
+		w, err := client.Create("/d/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The versions directory is not listed, but can be entered.
+	entries, err := client.ReadDir("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == versionsDir {
+			t.Errorf("%s is listed", versionsDir)
+		}
+	}
+	if fi, err := client.Stat("/d/.versions"); err != nil || !fi.IsDir() {
+		t.Errorf("Stat of the versions directory: %v %v", fi, err)
+	}
+
+	entries, err = client.ReadDir("/d/.versions")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Name() != "a.txt" || !entries[0].IsDir() {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+
+	versions, err := client.ReadDir("/d/.versions/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, but %d", len(versions))
+	}
+
+	// The oldest version is downloadable.
+	oldest := "/d/.versions/a.txt/" + versions[0].Name()
+	r, err := client.Open(oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "v1" {
+		t.Errorf("Expected v1, but %q", data)
+	}
+	if fi, err := client.Stat(oldest); err != nil || fi.Size() != 2 {
+		t.Errorf("Stat of the version: %v %v", fi, err)
+	}
+
+	// The versions directory is read-only.
+	if _, err = client.Create("/d/.versions/a.txt/x"); err == nil {
+		t.Error("A file was created in the versions directory")
+	}
+	if err = client.Mkdir("/d/.versions/x"); err == nil {
+		t.Error("A directory was created in the versions directory")
+	}
+	if err = client.Remove(oldest); err == nil {
+		t.Error("A version was removed")
+	}
+
+	// Renaming a version restores it.
+	if err = client.Rename(oldest, "/d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := download(s, "d/a.txt", 0, -1); err != nil || content != "v1" {
+		t.Errorf("Expected v1 restored, but %q %v", content, err)
+	}
+	if versions, err = client.ReadDir("/d/.versions/a.txt"); err != nil || len(versions) != 3 {
+		t.Errorf("Expected 3 versions, but %v %v", versions, err)
+	}
+
+	// A deleted file keeps its versions.
+	if err = client.Remove("/d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err = client.ReadDir("/d/.versions/a.txt"); err != nil || len(versions) != 4 {
+		t.Errorf("Expected 4 versions, but %v %v", versions, err)
+	}
+	if _, err = client.Stat("/d/.versions/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected not found, but %v", err)
+	}
+}
+
+func TestVersionsHidden(t *testing.T) {
+	f := newFakeSwift()
+	defer f.Close()
+	s := fakeSwiftClientWith(f, "c1", Config{SwiftTimeout: 10, Versioning: true})
+	if _, ok := f.containers["c1"+versionsContainerSuffix]; !ok {
+		t.Fatal("The history container was not created")
+	}
+
+	upload(t, s, "a.txt", "v1")
+	upload(t, s, "a.txt", "v2")
+
+	client := startFakeSftp(t, s)
+	if _, err := client.Stat("/.versions/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected not found, but %v", err)
+	}
+}